@@ -14,7 +14,9 @@ const (
 	permHostBans = 1
 	permRoles    = 2
 	permUsers    = 3
-	permCount    = 4
+	permBackups  = 4
+	permAudit    = 5
+	permCount    = 6
 	accessNone   = 0
 	accessView   = 1
 	accessManage = 2
@@ -75,6 +77,8 @@ func (aam *adminAuthMiddleware) checkAdminCredentials(r *http.Request) (bool, er
 			permHostBans: user.Role.AccessHostBans,
 			permRoles:    user.Role.AccessRoles,
 			permUsers:    user.Role.AccessUsers,
+			permBackups:  user.Role.AccessBackups,
+			permAudit:    user.Role.AccessAudit,
 		},
 	}
 }
@@ -98,7 +102,7 @@ func hashPassword(password string) (string, error) {
 
 func clampAccess(ctx *adminContext, perm int) int {
 	access := ctx.access[perm]
-	if perm == permRoles || perm == permUsers {
+	if perm == permRoles || perm == permUsers || perm == permAudit {
 		if access >= accessView {
 			return accessView
 		} else {
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+// How long writing an audit log entry may take
+const auditInsertTimeout = 10 * time.Second
+
+// What's recorded about a session an admin changed. The full admin view
+// isn't, since it includes the update key.
+type auditSession struct {
+	Id           int64  `json:"id"`
+	Title        string `json:"title"`
+	Owner        string `json:"owner"`
+	Unlisted     bool   `json:"unlisted"`
+	UnlistReason string `json:"unlistreason,omitempty"`
+	Pending      bool   `json:"pending,omitempty"`
+}
+
+// What's recorded about a user account. Passwords only show up as having
+// been changed.
+type auditUser struct {
+	Name            string `json:"name"`
+	Role            string `json:"role"`
+	PasswordChanged bool   `json:"passwordchanged,omitempty"`
+}
+
+// Look up the sessions with the given ids, as they are before a change
+func findAuditSessions(ctx apiContext, ids []int64, reqCtx context.Context) ([]auditSession, error) {
+	sessions, err := ctx.db.AdminQuerySessions(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []auditSession{}
+	for _, s := range sessions {
+		if containsId(ids, s.Id) {
+			found = append(found, auditSession{
+				Id:           s.Id,
+				Title:        s.Title,
+				Owner:        s.Owner,
+				Unlisted:     s.Unlisted,
+				UnlistReason: s.UnlistReason,
+				Pending:      s.Pending,
+			})
+		}
+	}
+	return found, nil
+}
+
+func findHostBan(ctx apiContext, id int64, reqCtx context.Context) (*db.AdminHostBan, error) {
+	bans, err := ctx.db.AdminQueryHostBans(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bans {
+		if bans[i].Id == id {
+			return &bans[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findTitleFilter(ctx apiContext, id int64, reqCtx context.Context) (*db.TitleFilter, error) {
+	filters, err := ctx.db.QueryTitleFilters(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range filters {
+		if filters[i].Id == id {
+			return &filters[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findSessionOverlay(ctx apiContext, id int64, reqCtx context.Context) (*db.SessionOverlay, error) {
+	overlays, err := ctx.db.QuerySessionOverlays(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range overlays {
+		if overlays[i].Id == id {
+			return &overlays[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findRole(ctx apiContext, id int64, reqCtx context.Context) (*db.AdminRole, error) {
+	roles, err := ctx.db.AdminQueryRoles(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range roles {
+		if roles[i].Id == id {
+			return &roles[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findUser(ctx apiContext, id int64, reqCtx context.Context) (*auditUser, error) {
+	users, err := ctx.db.AdminQueryUsers(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Id == id {
+			return &auditUser{Name: u.Name, Role: u.Role}, nil
+		}
+	}
+	return nil, nil
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Nil values, including nil pointers, are left out of the entry
+func marshalAuditValue(value interface{}) (json.RawMessage, error) {
+	if value == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Record a change made through the admin API in the audit log. The change
+// has already been made at this point, so a failure to record it is only
+// logged rather than failing the request.
+func recordAudit(r *http.Request, action string, targetIds []int64, before interface{}, after interface{}) {
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	adminCtx := r.Context().Value(adminCtxKey).(adminContext)
+
+	entry := db.AuditEntry{
+		UserId:    adminCtx.userId,
+		UserName:  adminCtx.userName,
+		Action:    action,
+		TargetIds: targetIds,
+	}
+	if clientIP := parseIp(r.RemoteAddr); clientIP != nil {
+		entry.ClientIp = clientIP.String()
+	}
+
+	// Not tied to the request, so that the entry is still written if the
+	// client goes away right after the change
+	insertCtx, cancel := context.WithTimeout(context.Background(), auditInsertTimeout)
+	defer cancel()
+
+	var err error
+	if entry.Before, err = marshalAuditValue(before); err == nil {
+		if entry.After, err = marshalAuditValue(after); err == nil {
+			_, err = ctx.db.InsertAuditEntry(entry, insertCtx)
+		}
+	}
+	if err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
+
+func apiAdminAuditListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permAudit, accessView) {
+		return ErrorResponse("You're not allowed to view the audit log", http.StatusForbidden)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return ErrorResponse("Bad request", http.StatusBadRequest)
+	}
+
+	opts := db.AuditQueryOptions{
+		User:   strings.TrimSpace(r.Form.Get("user")),
+		Action: strings.TrimSpace(r.Form.Get("action")),
+		From:   r.Form.Get("from"),
+		To:     r.Form.Get("to"),
+		Limit:  100,
+		Offset: 0,
+	}
+
+	if target := r.Form.Get("target"); target != "" {
+		value, err := strconv.ParseInt(target, 10, 64)
+		if err != nil || value < 1 {
+			return ErrorResponse("Invalid target id", http.StatusBadRequest)
+		}
+		opts.TargetId = value
+	}
+
+	for _, date := range []string{opts.From, opts.To} {
+		if date != "" {
+			if _, err := time.Parse("2006-01-02", date); err != nil {
+				return ErrorResponse("Dates have wrong format, should be YYYY-mm-dd", http.StatusBadRequest)
+			}
+		}
+	}
+
+	if limit := r.Form.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > 1000 {
+			return ErrorResponse("Limit must be between 1 and 1000", http.StatusBadRequest)
+		}
+		opts.Limit = value
+	}
+
+	if offset := r.Form.Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return ErrorResponse("Invalid offset", http.StatusBadRequest)
+		}
+		opts.Offset = value
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	entries, err := ctx.db.AdminQueryAuditLog(opts, r.Context())
+	if err != nil {
+		log.Println("List audit log error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(entries)
+}
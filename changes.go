@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+	"github.com/drawpile/listserver/inclsrv"
+)
+
+// Keeps track of when the public session list last changed, for answering
+// If-Modified-Since requests.
+type changeTracker struct {
+	mutex    sync.Mutex
+	last     time.Time
+	timeout  time.Duration
+	enabled  bool
+	included bool
+}
+
+// Changes can only be tracked if they all go through this instance. With a
+// shared database, other instances may change the list behind our back.
+func newChangeTracker(cfg *config) *changeTracker {
+	return &changeTracker{
+		last:     time.Now(),
+		timeout:  time.Duration(cfg.SessionTimeout) * time.Minute,
+		enabled:  !db.IsSharedDatabase(cfg.Database),
+		included: cfg.HasIncludes(),
+	}
+}
+
+// Record a change to the session list
+func (c *changeTracker) touch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.last = time.Now()
+}
+
+// Get the time the session list last changed, or zero if it's not known.
+// Sessions also drop off the list when they time out, which isn't tracked,
+// so the list may have changed at any time until a full session timeout has
+// passed since the last tracked change.
+func (c *changeTracker) lastModified(now time.Time) time.Time {
+	if !c.enabled {
+		return time.Time{}
+	}
+
+	c.mutex.Lock()
+	last := c.last
+	c.mutex.Unlock()
+
+	if expiry := last.Add(c.timeout); expiry.Before(now) {
+		last = expiry
+	} else {
+		last = now
+	}
+
+	if c.included {
+		if included := inclsrv.LastChange(); included.After(last) {
+			last = included
+		}
+	}
+	return last
+}
+
+// Call after handling a request that changed the session list
+func (ctx apiContext) sessionsChanged() {
+	ctx.changes.touch()
+	ctx.events.changed()
+}
+
+// Call after a refresh that kept a session listed without changing it. The
+// session can now time out later than it could before, so the list may
+// change until then, but subscribers have nothing to be told about yet.
+func (ctx apiContext) sessionsRefreshed() {
+	ctx.changes.touch()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/drawpile/listserver/db"
+)
+
+const commandUsage = `
+Commands (the server is started if none is given):
+  migrate status    show which database migrations have been applied
+  migrate up        apply all pending database migrations
+  export [file]     write the database content as JSON to a file or stdout
+  import [-replace] [file]
+                    restore the database content from a file or stdin,
+                    -replace is needed to overwrite a non-empty database
+`
+
+// Run a maintenance command instead of starting the server
+func runCommand(cfg *config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(cfg, args[1:])
+	case "export":
+		return exportCommand(cfg, args[1:])
+	case "import":
+		return importCommand(cfg, args[1:])
+	default:
+		return fmt.Errorf("Unknown command '%s'", args[0])
+	}
+}
+
+func migrateCommand(cfg *config, args []string) error {
+	if len(cfg.Database) == 0 {
+		return fmt.Errorf("No database configured")
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: migrate status|up")
+	}
+
+	switch args[0] {
+	case "status":
+		infos, err := db.QueryMigrationStatus(cfg.Database)
+		if errors.Is(err, db.ErrNotInitialized) {
+			fmt.Println("Database is not initialized, all migrations are pending")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			status := "pending"
+			if info.Applied {
+				status = "applied"
+			}
+			fmt.Printf("%4d  %-8s %s\n", info.Version, status, info.Description)
+		}
+		return nil
+	case "up":
+		if err := db.ApplyMigrations(cfg.Database); err != nil {
+			return err
+		}
+		fmt.Println("Database is up to date")
+		return nil
+	default:
+		return fmt.Errorf("Unknown migrate command '%s'", args[0])
+	}
+}
+
+// Open the configured database for exporting or importing
+func openCommandDatabase(cfg *config) (db.Database, error) {
+	if len(cfg.Database) == 0 {
+		return nil, fmt.Errorf("No database configured")
+	} else if cfg.Database == "memory" {
+		return nil, fmt.Errorf("The in-memory database can't be exported or imported")
+	}
+
+	// No cleanup or backup settings, so no background tasks run while we're at it
+	return db.InitDatabase(cfg.Database, cfg.SessionTimeout, db.CleanupSettings{}, db.BackupSettings{}), nil
+}
+
+func exportCommand(cfg *config, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: export [file]")
+	}
+
+	database, err := openCommandDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	data, err := database.Export(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+func importCommand(cfg *config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	replace := flags.Bool("replace", false, "overwrite the existing database content")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("Usage: import [-replace] [file]")
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var data db.ExportData
+	if err := json.NewDecoder(in).Decode(&data); err != nil {
+		return fmt.Errorf("Error reading export file: %s", err.Error())
+	}
+
+	database, err := openCommandDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if err := database.Import(data, *replace, context.Background()); err != nil {
+		if err == db.ErrDatabaseNotEmpty {
+			return fmt.Errorf("%s, use -replace to overwrite its content", err.Error())
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d sessions, %d archived sessions, %d host bans, %d roles and %d users\n",
+		len(data.Sessions), len(data.Archive), len(data.HostBans), len(data.Roles), len(data.Users))
+	return nil
+}
@@ -1,16 +1,44 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/drawpile/listserver/inclsrv"
+	"github.com/drawpile/listserver/validation"
 	"github.com/kelseyhightower/envconfig"
 )
 
+// An [[includeserver]] table. Zero values fall back to the global settings.
+type includeServerConfig struct {
+	Type           string // drawpile (default), listserver or push
+	Name           string // of a push server, used in its push URL
+	Url            string
+	Username       string
+	Password       string
+	PasswordFile   string // read the password from this file
+	PasswordEnv    string // read the password from this environment variable
+	Secret         string // pushes are signed with this
+	SecretFile     string
+	SecretEnv      string
+	CacheTtl       int
+	StatusCacheTtl int
+	Timeout        int
+	Nsfm           bool
+	TitlePrefix    string
+	Host           string
+	Port           int
+	Protocols      []string
+}
+
 type config struct {
 	Listen                  string
 	IncludeServers          []string
+	IncludeServer           []includeServerConfig `ignored:"true"`
 	AllowOrigins            []string
 	Database                string
 	Name                    string
@@ -24,6 +52,9 @@ type config struct {
 	MaxSessionsPerNamedHost int
 	TrustedHosts            []string
 	BannedHosts             []string
+	Premoderation           bool     // new listings must be approved by an admin
+	PremoderationOwners     []string // owners whose sessions skip premoderation
+	PendingMessage          string
 	ProxyHeaders            bool
 	WarnIpv6                bool
 	Public                  bool
@@ -35,6 +66,28 @@ type config struct {
 	IncludeCacheTtl         int
 	IncludeStatusCacheTtl   int
 	IncludeTimeout          int
+	CleanupInterval         int
+	TimedOutRetention       int
+	KickedRetention         int
+	ArchiveRetention        int
+	HostBanRetention        int
+	BackupDir               string
+	BackupInterval          int
+	BackupKeep              int
+	AnnounceRateLimit       int // per minute and client IP, 0 means no limit
+	AnnounceRateBurst       int
+	AnnounceHostRateLimit   int // per minute and announced host
+	AnnounceHostRateBurst   int
+	RefreshRateLimit        int
+	RefreshRateBurst        int
+	ListRateLimit           int
+	ListRateBurst           int
+	ReportRateLimit         int
+	ReportRateBurst         int
+	PushRateLimit           int
+	PushRateBurst           int
+
+	includes []inclsrv.Server // resolved from the two settings above
 }
 
 func (c *config) IsTrustedHost(host string) bool {
@@ -46,14 +99,123 @@ func (c *config) IsTrustedHost(host string) bool {
 	return false
 }
 
-func (c *config) ContainsNsfmWords(str string) bool {
-	str = strings.ToUpper(str)
-	for _, s := range c.NsfmWords {
-		if strings.Contains(str, s) {
-			return true
+// Whether a session announced by this host and owner must wait for approval
+func (c *config) NeedsApproval(host, owner string) bool {
+	if !c.Premoderation || validation.IsHostInList(host, c.TrustedHosts) {
+		return false
+	}
+	for _, o := range c.PremoderationOwners {
+		if strings.EqualFold(owner, o) {
+			return false
 		}
 	}
-	return false
+	return true
+}
+
+func (c *config) HasIncludes() bool {
+	return len(c.includes) > 0
+}
+
+// Combine the flat includeservers list and the [[includeserver]] tables.
+// Must be called again after changing either of them.
+func (c *config) resolveIncludes() error {
+	c.includes = []inclsrv.Server{}
+	for _, url := range c.IncludeServers {
+		c.includes = append(c.includes, c.includeServer(includeServerConfig{Url: url}))
+	}
+
+	names := map[string]bool{}
+	for i, isc := range c.IncludeServer {
+		var err error
+		isc.Type = strings.ToLower(isc.Type)
+		switch isc.Type {
+		case "", inclsrv.TypeDrawpile, inclsrv.TypeListserver:
+			if isc.Url == "" {
+				return fmt.Errorf("includeserver #%d: url is missing", i+1)
+			}
+			isc.Password, err = readSecret(isc.Password, isc.PasswordFile, isc.PasswordEnv)
+			if err != nil {
+				return fmt.Errorf("includeserver %s: %w", isc.Url, err)
+			}
+
+		case inclsrv.TypePush:
+			if !pushNameRe.MatchString(isc.Name) {
+				return fmt.Errorf("includeserver #%d: push servers need a name made of letters, digits, - and _", i+1)
+			}
+			if names[isc.Name] {
+				return fmt.Errorf("includeserver %s: name is used more than once", isc.Name)
+			}
+			names[isc.Name] = true
+			isc.Secret, err = readSecret(isc.Secret, isc.SecretFile, isc.SecretEnv)
+			if err != nil {
+				return fmt.Errorf("includeserver %s: %w", isc.Name, err)
+			}
+			if isc.Secret == "" {
+				return fmt.Errorf("includeserver %s: secret is missing", isc.Name)
+			}
+
+		default:
+			return fmt.Errorf("includeserver #%d: unknown type %q", i+1, isc.Type)
+		}
+
+		c.includes = append(c.includes, c.includeServer(isc))
+	}
+	return nil
+}
+
+var pushNameRe = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Get a password or secret given directly, in a file or in an environment variable
+func readSecret(value string, file string, env string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	} else if env != "" {
+		content, found := os.LookupEnv(env)
+		if !found {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return content, nil
+	}
+	return value, nil
+}
+
+func (c *config) includeServer(isc includeServerConfig) inclsrv.Server {
+	cacheTtl := isc.CacheTtl
+	if cacheTtl == 0 {
+		cacheTtl = c.IncludeCacheTtl
+	}
+	statusCacheTtl := isc.StatusCacheTtl
+	if statusCacheTtl == 0 {
+		statusCacheTtl = c.IncludeStatusCacheTtl
+	}
+	if statusCacheTtl < cacheTtl {
+		statusCacheTtl = cacheTtl
+	}
+	timeout := isc.Timeout
+	if timeout == 0 {
+		timeout = c.IncludeTimeout
+	}
+
+	return inclsrv.Server{
+		Type:           isc.Type,
+		Name:           isc.Name,
+		Secret:         isc.Secret,
+		Url:            strings.TrimRight(isc.Url, "/"),
+		Username:       isc.Username,
+		Password:       isc.Password,
+		CacheTtl:       time.Duration(cacheTtl) * time.Second,
+		StatusCacheTtl: time.Duration(statusCacheTtl) * time.Second,
+		Timeout:        time.Duration(timeout) * time.Second,
+		ForceNsfm:      isc.Nsfm,
+		TitlePrefix:    isc.TitlePrefix,
+		Host:           strings.ToLower(isc.Host),
+		Port:           isc.Port,
+		Protocols:      isc.Protocols,
+	}
 }
 
 func defaultConfig() *config {
@@ -65,6 +227,7 @@ func defaultConfig() *config {
 	return &config{
 		Listen:                  "localhost:8080",
 		IncludeServers:          []string{},
+		IncludeServer:           []includeServerConfig{},
 		AllowOrigins:            []string{"*"},
 		Database:                "memory",
 		Name:                    hostname,
@@ -78,6 +241,9 @@ func defaultConfig() *config {
 		MaxSessionsPerNamedHost: 10,
 		TrustedHosts:            []string{},
 		BannedHosts:             []string{},
+		Premoderation:           false,
+		PremoderationOwners:     []string{},
+		PendingMessage:          "This session will be listed once a moderator has approved it.",
 		ProxyHeaders:            false,
 		WarnIpv6:                true,
 		Public:                  true,
@@ -88,7 +254,27 @@ func defaultConfig() *config {
 		EnableAdminApi:          false,
 		IncludeCacheTtl:         0,
 		IncludeStatusCacheTtl:   0,
-		IncludeTimeout:          0,
+		IncludeTimeout:          10,
+		CleanupInterval:         1440,
+		TimedOutRetention:       1440,
+		KickedRetention:         0,
+		ArchiveRetention:        30,
+		HostBanRetention:        0,
+		BackupDir:               "",
+		BackupInterval:          1440,
+		BackupKeep:              7,
+		AnnounceRateLimit:       0,
+		AnnounceRateBurst:       0,
+		AnnounceHostRateLimit:   0,
+		AnnounceHostRateBurst:   0,
+		RefreshRateLimit:        0,
+		RefreshRateBurst:        0,
+		ListRateLimit:           0,
+		ListRateBurst:           0,
+		ReportRateLimit:         2, // reports are stored, so this one is on by default
+		ReportRateBurst:         5,
+		PushRateLimit:           60, // pushes are only expected every few minutes
+		PushRateBurst:           0,
 	}
 }
 
@@ -117,10 +303,6 @@ func readEnv() (*config, error) {
 }
 
 func doNormalizations(cfg *config) {
-	for i, s := range cfg.NsfmWords {
-		cfg.NsfmWords[i] = strings.ToUpper(s)
-	}
-
 	if cfg.MaxSessionsPerNamedHost < cfg.MaxSessionsPerHost {
 		cfg.MaxSessionsPerNamedHost = cfg.MaxSessionsPerHost
 	}
@@ -132,7 +314,26 @@ func doNormalizations(cfg *config) {
 		cfg.TrustedHosts[i] = strings.ToLower(h)
 	}
 
+	// Sessions can't be archived while they're still listed
+	if cfg.TimedOutRetention < cfg.SessionTimeout {
+		cfg.TimedOutRetention = cfg.SessionTimeout
+	}
+
 	if cfg.IncludeStatusCacheTtl < cfg.IncludeCacheTtl {
 		cfg.IncludeStatusCacheTtl = cfg.IncludeCacheTtl
 	}
+
+	// Allow a minute's worth of requests at once unless configured otherwise
+	for _, limit := range []struct{ rate, burst *int }{
+		{&cfg.AnnounceRateLimit, &cfg.AnnounceRateBurst},
+		{&cfg.AnnounceHostRateLimit, &cfg.AnnounceHostRateBurst},
+		{&cfg.RefreshRateLimit, &cfg.RefreshRateBurst},
+		{&cfg.ListRateLimit, &cfg.ListRateBurst},
+		{&cfg.ReportRateLimit, &cfg.ReportRateBurst},
+		{&cfg.PushRateLimit, &cfg.PushRateBurst},
+	} {
+		if *limit.burst <= 0 {
+			*limit.burst = *limit.rate
+		}
+	}
 }
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Does the action match the filter, either exactly or by being in the group
+// of actions the filter names, like "bans.create" being in "bans"
+func auditActionMatches(action string, filter string) bool {
+	return action == filter || strings.HasPrefix(action, filter+".")
+}
+
+// Target ids are stored as a comma separated list where arrays aren't
+// available
+func formatAuditTargetIds(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseAuditTargetIds(s string) []int64 {
+	ids := []int64{}
+	for _, part := range strings.Split(s, ",") {
+		if id, err := strconv.ParseInt(part, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
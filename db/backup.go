@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings for the database backups
+type BackupSettings struct {
+	// Directory to write backups into, empty disables backups
+	Dir string
+	// Time between backups, zero disables scheduled backups
+	Interval time.Duration
+	// Number of backups to keep, zero keeps all of them
+	Keep int
+}
+
+type BackupInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Created string `json:"created"`
+}
+
+var ErrBackupNotSupported = errors.New("Backups are only supported for SQLite databases")
+var ErrBackupNotConfigured = errors.New("No backup directory configured")
+
+const (
+	backupPrefix     = "listserver-"
+	backupSuffix     = ".db"
+	backupNameFormat = "20060102-150405"
+)
+
+// Backup names sort in the order they were made
+func backupFileName(now time.Time) string {
+	return backupPrefix + now.UTC().Format(backupNameFormat) + backupSuffix
+}
+
+func isBackupFileName(name string) bool {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return false
+	}
+	_, err := time.Parse(backupNameFormat, name[len(backupPrefix):len(name)-len(backupSuffix)])
+	return err == nil
+}
+
+func backupFileInfo(dir, name string) (BackupInfo, error) {
+	fi, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	created, _ := time.Parse(backupNameFormat, name[len(backupPrefix):len(name)-len(backupSuffix)])
+	return BackupInfo{
+		Name:    name,
+		Size:    fi.Size(),
+		Created: created.Format("2006-01-02 15:04:05"),
+	}, nil
+}
+
+// List the backups in the directory, newest first
+func listBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && isBackupFileName(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	backups := make([]BackupInfo, 0, len(names))
+	for _, name := range names {
+		info, err := backupFileInfo(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, info)
+	}
+	return backups, nil
+}
+
+// Delete all but the newest backups
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(filepath.Join(dir, backups[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs a backup periodically, returns nil if it's disabled
+func startBackupTask(db Database, settings BackupSettings) *periodicTask {
+	if settings.Dir == "" {
+		return nil
+	}
+
+	return startPeriodicTask(settings.Interval, func(ctx context.Context) {
+		info, err := db.Backup(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Database backup error:", err)
+			}
+		} else {
+			log.Printf("Database backed up to %s (%d bytes)\n", info.Name, info.Size)
+		}
+	})
+}
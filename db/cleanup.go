@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Settings for the periodic database cleanup
+type CleanupSettings struct {
+	// Time between cleanups, zero disables the periodic cleanup
+	Interval time.Duration
+	// How long timed out sessions are kept in the session list before
+	// they're archived. Sessions unlisted by their owner are archived
+	// right away.
+	TimedOutRetention time.Duration
+	// How long sessions unlisted by an admin are kept in the session list
+	// before they're archived. Until then, the host gets the unlist reason
+	// when trying to refresh the session.
+	KickedRetention time.Duration
+	// How long to keep archived sessions, zero keeps them forever
+	ArchiveRetention time.Duration
+	// How long to keep host bans after they expired, zero keeps them forever
+	HostBanRetention time.Duration
+}
+
+// Number of rows removed by a cleanup
+type CleanupResult struct {
+	ArchivedSessions int64 `json:"archivedsessions"`
+	PurgedArchive    int64 `json:"purgedarchive"`
+	PurgedHostBans   int64 `json:"purgedhostbans"`
+}
+
+// Cutoff timestamps for a cleanup, all calculated from the same moment
+type cleanupCutoffs struct {
+	timedOut time.Time
+	kicked   time.Time
+	archive  time.Time // zero if archived sessions are kept forever
+	hostBan  time.Time // zero if expired host bans are kept forever
+}
+
+func (s *CleanupSettings) cutoffs(now time.Time) cleanupCutoffs {
+	c := cleanupCutoffs{
+		timedOut: now.Add(-s.TimedOutRetention),
+		kicked:   now.Add(-s.KickedRetention),
+	}
+	if s.ArchiveRetention > 0 {
+		c.archive = now.Add(-s.ArchiveRetention)
+	}
+	if s.HostBanRetention > 0 {
+		c.hostBan = now.Add(-s.HostBanRetention)
+	}
+	return c
+}
+
+// Runs a database cleanup periodically, returns nil if it's disabled
+func startCleanupTask(db Database, interval time.Duration) *periodicTask {
+	return startPeriodicTask(interval, func(ctx context.Context) {
+		result, err := db.Cleanup(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Database cleanup error:", err)
+			}
+		} else {
+			result.log()
+		}
+	})
+}
+
+func (r CleanupResult) log() {
+	if r.ArchivedSessions > 0 || r.PurgedArchive > 0 || r.PurgedHostBans > 0 {
+		log.Printf("Database cleanup: archived %d sessions, purged %d archived sessions and %d expired host bans\n",
+			r.ArchivedSessions, r.PurgedArchive, r.PurgedHostBans)
+	}
+}
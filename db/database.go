@@ -3,6 +3,8 @@ package db
 import (
 	"context"
 	"log"
+	"net"
+	"net/url"
 )
 
 type Database interface {
@@ -10,20 +12,41 @@ type Database interface {
 	QuerySessionList(opts QueryOptions, ctx context.Context) ([]SessionInfo, error)
 	IsActiveSession(host, id string, port int, ctx context.Context) (bool, error)
 	GetHostSessionCount(host string, ctx context.Context) (int, error)
-	IsBannedHost(host string, ctx context.Context) (bool, error)
-	InsertSession(session SessionInfo, clientIp string, ctx context.Context) (NewSessionInfo, error)
-	RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) error
+	IsBannedHost(host string, addrs []net.IP, ctx context.Context) (bool, error)
+	IsBannedSession(session SessionInfo, ctx context.Context) (bool, error)
+	InsertSession(session SessionInfo, clientIp string, pending bool, ctx context.Context) (NewSessionInfo, error)
+	RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) (bool, error)
 	DeleteSession(listingId int64, updateKey string, ctx context.Context) (bool, error)
 	AdminUpdateSessions(ids []int64, unlisted bool, unlistReason string, ctx context.Context) ([]int64, error)
+	AdminReviewSessions(ids []int64, approved bool, rejectReason string, ctx context.Context) ([]int64, error)
 	AdminQuerySessions(ctx context.Context) ([]AdminSession, error)
-	AdminCreateHostBan(host string, expires string, notes string, ctx context.Context) (int64, error)
-	AdminUpdateHostBan(id int64, host string, expires string, notes string, ctx context.Context) (bool, error)
+	Cleanup(ctx context.Context) (CleanupResult, error)
+	Export(ctx context.Context) (ExportData, error)
+	Import(data ExportData, replace bool, ctx context.Context) error
+	Backup(ctx context.Context) (BackupInfo, error)
+	QueryBackups(ctx context.Context) ([]BackupInfo, error)
+	AdminQueryArchive(opts ArchiveQueryOptions, ctx context.Context) ([]ArchivedSession, error)
+	AdminCreateHostBan(banType string, host string, pattern string, expires string, notes string, ctx context.Context) (int64, error)
+	AdminUpdateHostBan(id int64, banType string, host string, pattern string, expires string, notes string, ctx context.Context) (bool, error)
 	AdminDeleteHostBan(id int64, ctx context.Context) (bool, error)
 	AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, error)
+	QuerySessionOverlays(ctx context.Context) ([]SessionOverlay, error)
+	AdminPutSessionOverlay(overlay SessionOverlay, ctx context.Context) (int64, error)
+	AdminDeleteSessionOverlay(id int64, ctx context.Context) (bool, error)
+	FlagSession(listingId int64, reason string, ctx context.Context) error
+	QueryTitleFilters(ctx context.Context) ([]TitleFilter, error)
+	AdminCreateTitleFilter(filter TitleFilter, ctx context.Context) (int64, error)
+	AdminUpdateTitleFilter(filter TitleFilter, ctx context.Context) (bool, error)
+	AdminDeleteTitleFilter(id int64, ctx context.Context) (bool, error)
+	InsertSessionReport(report SessionReport, ctx context.Context) (int64, error)
+	AdminQuerySessionReports(includeResolved bool, ctx context.Context) ([]SessionReport, error)
+	AdminResolveSessionReports(ids []int64, resolvedBy string, resolution string, ctx context.Context) ([]int64, error)
+	InsertAuditEntry(entry AuditEntry, ctx context.Context) (int64, error)
+	AdminQueryAuditLog(opts AuditQueryOptions, ctx context.Context) ([]AuditEntry, error)
 	AdminCreateRole(name string, admin bool, accessSessions int64, accessHostbans int64,
-		accessRoles int64, accessUsers int64, ctx context.Context) (int64, error)
+		accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (int64, error)
 	AdminUpdateRole(id int64, name string, admin bool, accessSessions int64, accessHostbans int64,
-		accessRoles int64, accessUsers int64, ctx context.Context) (bool, error)
+		accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (bool, error)
 	AdminDeleteRole(id int64, ctx context.Context) (bool, error)
 	AdminQueryRoles(ctx context.Context) ([]AdminRole, error)
 	AdminQueryRoleByName(name string, ctx context.Context) (AdminRole, error)
@@ -36,7 +59,7 @@ type Database interface {
 	Close() error
 }
 
-func InitDatabase(dbname string, sessionTimeout int) Database {
+func InitDatabase(dbname string, sessionTimeout int, cleanup CleanupSettings, backup BackupSettings) Database {
 	if len(dbname) == 0 {
 		log.Println("No database given, running in read-only mode")
 		return nil
@@ -47,8 +70,23 @@ func InitDatabase(dbname string, sessionTimeout int) Database {
 		return nil
 	}
 
-	log.Println("Using database:", dbname)
-	db, err := newSqliteDb(dbname, sessionTimeout)
+	if backup.Dir != "" && (dbname == "memory" || isPostgresUrl(dbname)) {
+		log.Println("Warning:", ErrBackupNotSupported)
+	}
+
+	var db Database
+	var err error
+	if dbname == "memory" {
+		log.Println("Using in-memory database")
+		db = newMemoryDb(sessionTimeout, cleanup)
+	} else if isPostgresUrl(dbname) {
+		log.Println("Using PostgreSQL database:", redactDatabaseUrl(dbname))
+		db, err = newPostgresDb(dbname, sessionTimeout, cleanup)
+	} else {
+		log.Println("Using database:", dbname)
+		db, err = newSqliteDb(dbname, sessionTimeout, cleanup, backup)
+	}
+
 	if err != nil {
 		log.Fatal(err)
 		return nil
@@ -56,3 +94,18 @@ func InitDatabase(dbname string, sessionTimeout int) Database {
 
 	return db
 }
+
+// Can several listserver instances share the database, so that changes may
+// be made by another process
+func IsSharedDatabase(dbname string) bool {
+	return isPostgresUrl(dbname)
+}
+
+// Strip the password from a database URL so that it can be logged
+func redactDatabaseUrl(dbname string) string {
+	u, err := url.Parse(dbname)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,1431 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A database that keeps everything in memory. Nothing is persisted, all
+// content is lost when the server is restarted.
+type memoryDb struct {
+	mutex           sync.RWMutex
+	timeout         time.Duration
+	timeoutMinutes  int
+	cleanupSettings CleanupSettings
+	cleanupTask     *periodicTask
+	sessions        map[int64]*memorySession
+	archive         map[int64]*memoryArchivedSession
+	hostBans        map[int64]*memoryHostBan
+	roles           map[int64]*memoryRole
+	users           map[int64]*memoryUser
+	overlays        map[int64]*SessionOverlay
+	filters         map[int64]*TitleFilter
+	reports         map[int64]*SessionReport
+	audit           map[int64]*AuditEntry
+	lastId          int64
+}
+
+type memorySession struct {
+	info         SessionInfo
+	started      time.Time
+	lastActive   time.Time
+	unlisted     bool
+	unlistReason *string // nil unless unlisted by an admin
+	updateKey    string
+	clientIp     string
+	flagged      string
+	pending      bool // waiting for approval, not listed until then
+}
+
+type memoryArchivedSession struct {
+	info       ArchivedSession
+	started    time.Time
+	lastActive time.Time
+	archived   time.Time
+}
+
+type memoryHostBan struct {
+	kind    string
+	host    string
+	pattern string
+	expires *time.Time
+	notes   string
+}
+
+type memoryRole struct {
+	name           string
+	admin          bool
+	accessSessions int
+	accessHostBans int
+	accessRoles    int
+	accessUsers    int
+	accessBackups  int
+	accessAudit    int
+}
+
+type memoryUser struct {
+	name         string
+	passwordHash string
+	role         int64
+}
+
+const (
+	memoryStartedFormat   = "2006-01-02T15:04:05Z"
+	memoryTimestampFormat = "2006-01-02 15:04:05"
+)
+
+func newMemoryDb(sessionTimeout int, cleanup CleanupSettings) *memoryDb {
+	db := &memoryDb{
+		timeout:         time.Duration(sessionTimeout) * time.Minute,
+		timeoutMinutes:  sessionTimeout,
+		cleanupSettings: cleanup,
+		sessions:        map[int64]*memorySession{},
+		archive:         map[int64]*memoryArchivedSession{},
+		hostBans:        map[int64]*memoryHostBan{},
+		roles:           map[int64]*memoryRole{},
+		users:           map[int64]*memoryUser{},
+		overlays:        map[int64]*SessionOverlay{},
+		filters:         map[int64]*TitleFilter{},
+		reports:         map[int64]*SessionReport{},
+		audit:           map[int64]*AuditEntry{},
+	}
+
+	db.cleanupTask = startCleanupTask(db, cleanup.Interval)
+
+	return db
+}
+
+// All tables share the same id sequence, that's good enough for us.
+// Must be called with the write lock held.
+func (db *memoryDb) nextId() int64 {
+	db.lastId++
+	return db.lastId
+}
+
+func (db *memoryDb) isTimedOut(s *memorySession, now time.Time) bool {
+	return s.lastActive.Before(now.Add(-db.timeout))
+}
+
+func (db *memoryDb) isListed(s *memorySession, now time.Time) bool {
+	return !s.unlisted && !db.isTimedOut(s, now)
+}
+
+// Move unlisted and long inactive sessions to the archive and purge
+// archived sessions and expired host bans past their retention period
+func (db *memoryDb) Cleanup(ctx context.Context) (CleanupResult, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var result CleanupResult
+	now := time.Now()
+	cutoffs := db.cleanupSettings.cutoffs(now)
+	for id, s := range db.sessions {
+		var expired bool
+		if !s.unlisted {
+			expired = s.lastActive.Before(cutoffs.timedOut)
+		} else {
+			expired = s.unlistReason == nil || s.lastActive.Before(cutoffs.kicked)
+		}
+		if expired {
+			db.archiveSession(id, s, now)
+			delete(db.sessions, id)
+			result.ArchivedSessions++
+		}
+	}
+
+	if !cutoffs.archive.IsZero() {
+		for id, a := range db.archive {
+			if a.archived.Before(cutoffs.archive) {
+				delete(db.archive, id)
+				result.PurgedArchive++
+			}
+		}
+	}
+
+	if !cutoffs.hostBan.IsZero() {
+		for id, b := range db.hostBans {
+			if b.expires != nil && b.expires.Before(cutoffs.hostBan) {
+				delete(db.hostBans, id)
+				result.PurgedHostBans++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Must be called with the write lock held
+func (db *memoryDb) archiveSession(listingId int64, s *memorySession, now time.Time) {
+	var unlistReason string
+	if !s.unlisted {
+		unlistReason = "timed out"
+	} else if s.unlistReason == nil {
+		unlistReason = "unlisted by owner"
+	} else {
+		unlistReason = *s.unlistReason
+	}
+
+	id := db.nextId()
+	db.archive[id] = &memoryArchivedSession{
+		info: ArchivedSession{
+			Id:           id,
+			ListingId:    listingId,
+			Host:         s.info.Host,
+			Port:         s.info.Port,
+			SessionId:    s.info.Id,
+			Protocol:     s.info.Protocol,
+			Title:        s.info.Title,
+			Users:        s.info.Users,
+			MaxUsers:     s.info.MaxUsers,
+			Password:     s.info.Password,
+			Nsfm:         s.info.Nsfm,
+			Owner:        s.info.Owner,
+			Started:      s.info.Started,
+			LastActive:   s.lastActive.UTC().Format(memoryTimestampFormat),
+			Archived:     now.UTC().Format(memoryTimestampFormat),
+			ClientIp:     s.clientIp,
+			UnlistReason: unlistReason,
+			Kicked:       s.unlisted && s.unlistReason != nil,
+		},
+		started:    s.started,
+		lastActive: s.lastActive,
+		archived:   now,
+	}
+}
+
+func (db *memoryDb) SessionTimeoutMinutes() int {
+	return db.timeoutMinutes
+}
+
+// Get a list of sessions that match the given query parameters
+func (db *memoryDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]SessionInfo, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	sessions := []SessionInfo{}
+	for _, s := range db.sessions {
+		if !s.pending && db.isListed(s, now) && opts.Matches(&s.info) {
+			info := s.info
+			info.Usernames = []string{}
+			sessions = append(sessions, info)
+		}
+	}
+
+	SortSessionList(sessions, opts)
+	return sessions, nil
+}
+
+// Is there an active announcement for this session
+func (db *memoryDb) IsActiveSession(host, id string, port int, ctx context.Context) (bool, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	for _, s := range db.sessions {
+		if s.info.Host == host && s.info.Port == port && s.info.Id == id && db.isListed(s, now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get the number of active announcements on this server (all ports)
+func (db *memoryDb) GetHostSessionCount(host string, ctx context.Context) (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	count := 0
+	for _, s := range db.sessions {
+		if s.info.Host == host && db.isListed(s, now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (b *memoryHostBan) isActive(now time.Time) bool {
+	return b.expires == nil || b.expires.After(now)
+}
+
+// Check if the given host or any of the addresses is on the ban list
+func (db *memoryDb) IsBannedHost(host string, addrs []net.IP, ctx context.Context) (bool, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	for _, b := range db.hostBans {
+		if b.kind == BanTypeHost && b.isActive(now) && HostBanMatches(b.host, host, addrs) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check if the session matches any of the bans that aren't host bans
+func (db *memoryDb) IsBannedSession(session SessionInfo, ctx context.Context) (bool, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.isBannedSession(&session, time.Now()), nil
+}
+
+// Must be called with at least the read lock held.
+func (db *memoryDb) isBannedSession(session *SessionInfo, now time.Time) bool {
+	for _, b := range db.hostBans {
+		if b.kind != BanTypeHost && b.isActive(now) && SessionBanMatches(b.kind, b.host, b.pattern, session) {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert a new session to the database
+// Note: this function does not validate the data;
+// that must be done before calling this
+func (db *memoryDb) InsertSession(session SessionInfo, clientIp string, pending bool, ctx context.Context) (NewSessionInfo, error) {
+	updateKey, err := generateUpdateKey()
+	if err != nil {
+		return NewSessionInfo{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	session.Usernames = []string{}
+	session.Started = now.Format(memoryStartedFormat)
+	session.Private = false
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id := db.nextId()
+	db.sessions[id] = &memorySession{
+		info:       session,
+		started:    now,
+		lastActive: now,
+		updateKey:  updateKey,
+		clientIp:   clientIp,
+		pending:    pending,
+	}
+
+	return NewSessionInfo{
+		id,
+		updateKey,
+	}, nil
+}
+
+// Refresh an announcement. Returns whether any of the listed fields changed.
+func (db *memoryDb) RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now()
+	s, found := db.sessions[listingId]
+	if !found {
+		return false, RefreshError{"no such session"}
+	} else if s.updateKey != updateKey {
+		return false, RefreshError{"invalid session key"}
+	} else if (s.unlistReason != nil && *s.unlistReason != "") || db.isTimedOut(s, now) {
+		if !s.unlisted {
+			return false, RefreshError{"timed out"} // (Probably.)
+		} else if s.unlistReason == nil || *s.unlistReason == "" {
+			return false, RefreshError{"already unlisted"}
+		} else {
+			return false, RefreshError{*s.unlistReason}
+		}
+	}
+
+	// A banned title is only checked, the session keeps its old one
+	if val, ok := optString(refreshFields, "title"); ok {
+		info := s.info
+		info.Title = val
+		if db.isBannedSession(&info, now) {
+			reason := BannedSessionReason
+			s.unlisted = true
+			s.unlistReason = &reason
+			return false, ErrBannedSession
+		}
+	}
+
+	s.lastActive = now.UTC().Truncate(time.Second)
+	before := s.info
+
+	if val, ok := optString(refreshFields, "title"); ok {
+		s.info.Title = val
+	}
+
+	if val, ok := optInt(refreshFields, "users"); ok {
+		s.info.Users = val
+	}
+
+	if val, ok := optBool(refreshFields, "password"); ok {
+		s.info.Password = val
+	}
+
+	if val, ok := optBool(refreshFields, "nsfm"); ok {
+		s.info.Nsfm = val
+	}
+
+	if val, ok := optInt(refreshFields, "maxusers"); ok {
+		s.info.MaxUsers = val
+	}
+
+	if val, ok := optBool(refreshFields, "closed"); ok {
+		s.info.Closed = val
+	}
+
+	if val, ok := optInt(refreshFields, "activedrawingusers"); ok {
+		s.info.ActiveDrawingUsers = val
+	} else {
+		s.info.ActiveDrawingUsers = -1
+	}
+
+	if val, ok := optBool(refreshFields, "allowweb"); ok {
+		s.info.AllowWeb = val
+	}
+
+	return !reflect.DeepEqual(before, s.info), nil
+}
+
+// Delete an announcement
+func (db *memoryDb) DeleteSession(listingId int64, updateKey string, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	s, found := db.sessions[listingId]
+	if !found || s.updateKey != updateKey || s.unlisted {
+		return false, nil
+	}
+
+	s.unlisted = true
+	return true, nil
+}
+
+func (db *memoryDb) AdminUpdateSessions(ids []int64, unlisted bool, unlistReason string, ctx context.Context) ([]int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	changedIds := []int64{}
+	handledIds := map[int64]bool{}
+	for _, id := range ids {
+		if !handledIds[id] {
+			if s, found := db.sessions[id]; found {
+				reason := unlistReason
+				s.unlisted = unlisted
+				s.unlistReason = &reason
+				s.flagged = ""
+				changedIds = append(changedIds, id)
+			}
+			handledIds[id] = true
+		}
+	}
+	return changedIds, nil
+}
+
+// Approve or reject sessions waiting for approval. Rejected sessions are
+// unlisted with the given reason.
+func (db *memoryDb) AdminReviewSessions(ids []int64, approved bool, rejectReason string, ctx context.Context) ([]int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	changedIds := []int64{}
+	handledIds := map[int64]bool{}
+	for _, id := range ids {
+		if !handledIds[id] {
+			if s, found := db.sessions[id]; found && s.pending && !s.unlisted {
+				s.pending = false
+				if !approved {
+					reason := rejectReason
+					s.unlisted = true
+					s.unlistReason = &reason
+				}
+				changedIds = append(changedIds, id)
+			}
+			handledIds[id] = true
+		}
+	}
+	return changedIds, nil
+}
+
+func (db *memoryDb) AdminQuerySessions(ctx context.Context) ([]AdminSession, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	sessions := make([]AdminSession, 0, len(db.sessions))
+	for id, s := range db.sessions {
+		timedOut := db.isTimedOut(s, now)
+		kicked := s.unlistReason != nil
+		var unlistReason string
+		if s.unlisted {
+			if kicked {
+				unlistReason = *s.unlistReason
+			} else {
+				unlistReason = "unlisted by owner"
+			}
+		} else if timedOut {
+			unlistReason = "timed out"
+		}
+
+		sessions = append(sessions, AdminSession{
+			Id:                 id,
+			Host:               s.info.Host,
+			Port:               s.info.Port,
+			SessionId:          s.info.Id,
+			Protocol:           s.info.Protocol,
+			Title:              s.info.Title,
+			Users:              s.info.Users,
+			Usernames:          []string{},
+			Password:           s.info.Password,
+			Nsfm:               s.info.Nsfm,
+			Owner:              s.info.Owner,
+			Started:            s.info.Started,
+			LastActive:         s.lastActive.UTC().Format(memoryTimestampFormat),
+			Unlisted:           s.unlisted || timedOut,
+			UpdateKey:          s.updateKey,
+			ClientIp:           s.clientIp,
+			UnlistReason:       unlistReason,
+			MaxUsers:           s.info.MaxUsers,
+			Closed:             s.info.Closed,
+			Kicked:             kicked,
+			TimedOut:           timedOut,
+			ActiveDrawingUsers: s.info.ActiveDrawingUsers,
+			AllowWeb:           s.info.AllowWeb,
+			Flagged:            s.flagged,
+			Pending:            s.pending,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Host != sessions[j].Host {
+			return sessions[i].Host < sessions[j].Host
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+
+	return sessions, nil
+}
+
+func (db *memoryDb) AdminQueryArchive(opts ArchiveQueryOptions, ctx context.Context) ([]ArchivedSession, error) {
+	var from, before time.Time
+	if len(opts.From) > 0 {
+		var err error
+		if from, err = time.Parse("2006-01-02", opts.From); err != nil {
+			return []ArchivedSession{}, err
+		}
+	}
+	if len(opts.To) > 0 {
+		to, err := time.Parse("2006-01-02", opts.To)
+		if err != nil {
+			return []ArchivedSession{}, err
+		}
+		before = to.AddDate(0, 0, 1)
+	}
+
+	db.mutex.RLock()
+	matches := []*memoryArchivedSession{}
+	for _, a := range db.archive {
+		if len(opts.Host) > 0 && !strings.EqualFold(a.info.Host, opts.Host) {
+			continue
+		}
+		if len(opts.Owner) > 0 && !strings.EqualFold(a.info.Owner, opts.Owner) {
+			continue
+		}
+		if len(opts.Title) > 0 && !strings.Contains(strings.ToLower(a.info.Title), strings.ToLower(opts.Title)) {
+			continue
+		}
+		if !from.IsZero() && a.lastActive.Before(from) {
+			continue
+		}
+		if !before.IsZero() && !a.started.Before(before) {
+			continue
+		}
+		matches = append(matches, a)
+	}
+	db.mutex.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].lastActive.Equal(matches[j].lastActive) {
+			return matches[i].lastActive.After(matches[j].lastActive)
+		}
+		return matches[i].info.Id > matches[j].info.Id
+	})
+
+	sessions := []ArchivedSession{}
+	for i := opts.Offset; i < len(matches) && len(sessions) < opts.Limit; i++ {
+		sessions = append(sessions, matches[i].info)
+	}
+
+	return sessions, nil
+}
+
+func parseMemoryBanExpiry(expires string) (*time.Time, error) {
+	if expires == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", expires)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (db *memoryDb) AdminCreateHostBan(banType string, host string, pattern string, expires string, notes string, ctx context.Context) (int64, error) {
+	expiresTime, err := parseMemoryBanExpiry(expires)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id := db.nextId()
+	db.hostBans[id] = &memoryHostBan{
+		kind:    banType,
+		host:    host,
+		pattern: pattern,
+		expires: expiresTime,
+		notes:   notes,
+	}
+	return id, nil
+}
+
+func (db *memoryDb) AdminUpdateHostBan(id int64, banType string, host string, pattern string, expires string, notes string, ctx context.Context) (bool, error) {
+	expiresTime, err := parseMemoryBanExpiry(expires)
+	if err != nil {
+		return false, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	b, found := db.hostBans[id]
+	if !found {
+		return false, nil
+	}
+
+	b.kind = banType
+	b.host = host
+	b.pattern = pattern
+	b.expires = expiresTime
+	b.notes = notes
+	return true, nil
+}
+
+func (db *memoryDb) AdminDeleteHostBan(id int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.hostBans[id]; !found {
+		return false, nil
+	}
+
+	delete(db.hostBans, id)
+	return true, nil
+}
+
+func (db *memoryDb) AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	hostBans := make([]AdminHostBan, 0, len(db.hostBans))
+	for id, b := range db.hostBans {
+		var expires string
+		if b.expires != nil {
+			expires = b.expires.Format(memoryTimestampFormat)
+		}
+		hostBans = append(hostBans, AdminHostBan{
+			Id:      id,
+			Type:    b.kind,
+			Host:    b.host,
+			Pattern: b.pattern,
+			Expires: expires,
+			Active:  b.isActive(now),
+			Notes:   b.notes,
+		})
+	}
+
+	sort.Slice(hostBans, func(i, j int) bool {
+		return hostBans[i].Id > hostBans[j].Id
+	})
+
+	return hostBans, nil
+}
+
+func (db *memoryDb) QuerySessionOverlays(ctx context.Context) ([]SessionOverlay, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	overlays := make([]SessionOverlay, 0, len(db.overlays))
+	for _, o := range db.overlays {
+		overlays = append(overlays, *o)
+	}
+
+	sort.Slice(overlays, func(i, j int) bool {
+		return overlays[i].Id > overlays[j].Id
+	})
+
+	return overlays, nil
+}
+
+// Create an overlay or replace the one for the same session
+func (db *memoryDb) AdminPutSessionOverlay(overlay SessionOverlay, ctx context.Context) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	overlay.Host = strings.ToLower(overlay.Host)
+	overlay.Updated = time.Now().UTC().Format(memoryTimestampFormat)
+	overlay.Id = 0
+	for id, o := range db.overlays {
+		if o.Host == overlay.Host && o.Port == overlay.Port && o.SessionId == overlay.SessionId {
+			overlay.Id = id
+			break
+		}
+	}
+	if overlay.Id == 0 {
+		overlay.Id = db.nextId()
+	}
+
+	db.overlays[overlay.Id] = &overlay
+	return overlay.Id, nil
+}
+
+func (db *memoryDb) AdminDeleteSessionOverlay(id int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.overlays[id]; !found {
+		return false, nil
+	}
+
+	delete(db.overlays, id)
+	return true, nil
+}
+
+func (db *memoryDb) FlagSession(listingId int64, reason string, ctx context.Context) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if s, found := db.sessions[listingId]; found {
+		s.flagged = reason
+	}
+	return nil
+}
+
+func (db *memoryDb) QueryTitleFilters(ctx context.Context) ([]TitleFilter, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	filters := make([]TitleFilter, 0, len(db.filters))
+	for _, f := range db.filters {
+		filters = append(filters, *f)
+	}
+
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].Id < filters[j].Id
+	})
+
+	return filters, nil
+}
+
+func (db *memoryDb) AdminCreateTitleFilter(filter TitleFilter, ctx context.Context) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	filter.Id = db.nextId()
+	db.filters[filter.Id] = &filter
+	return filter.Id, nil
+}
+
+func (db *memoryDb) AdminUpdateTitleFilter(filter TitleFilter, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.filters[filter.Id]; !found {
+		return false, nil
+	}
+
+	db.filters[filter.Id] = &filter
+	return true, nil
+}
+
+func (db *memoryDb) AdminDeleteTitleFilter(id int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.filters[id]; !found {
+		return false, nil
+	}
+
+	delete(db.filters, id)
+	return true, nil
+}
+
+func (db *memoryDb) InsertSessionReport(report SessionReport, ctx context.Context) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	report.Id = db.nextId()
+	report.Reported = time.Now().UTC().Format(memoryTimestampFormat)
+	report.Resolved = ""
+	report.ResolvedBy = ""
+	report.Resolution = ""
+	db.reports[report.Id] = &report
+	return report.Id, nil
+}
+
+func (db *memoryDb) AdminQuerySessionReports(includeResolved bool, ctx context.Context) ([]SessionReport, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	reports := []SessionReport{}
+	for _, r := range db.reports {
+		if includeResolved || r.Resolved == "" {
+			reports = append(reports, *r)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id > reports[j].Id
+	})
+
+	return reports, nil
+}
+
+// Mark open reports as resolved. Returns the ids of the ones that were open.
+func (db *memoryDb) AdminResolveSessionReports(ids []int64, resolvedBy string, resolution string, ctx context.Context) ([]int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now().UTC().Format(memoryTimestampFormat)
+	resolvedIds := []int64{}
+	for _, id := range ids {
+		if r, found := db.reports[id]; found && r.Resolved == "" {
+			r.Resolved = now
+			r.ResolvedBy = resolvedBy
+			r.Resolution = resolution
+			resolvedIds = append(resolvedIds, id)
+		}
+	}
+	return resolvedIds, nil
+}
+
+func (db *memoryDb) InsertAuditEntry(entry AuditEntry, ctx context.Context) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entry.Id = db.nextId()
+	entry.Logged = time.Now().UTC().Format(memoryTimestampFormat)
+	if entry.TargetIds == nil {
+		entry.TargetIds = []int64{}
+	}
+	db.audit[entry.Id] = &entry
+	return entry.Id, nil
+}
+
+func (db *memoryDb) AdminQueryAuditLog(opts AuditQueryOptions, ctx context.Context) ([]AuditEntry, error) {
+	var before string
+	if len(opts.To) > 0 {
+		var err error
+		if before, err = nextDate(opts.To); err != nil {
+			return []AuditEntry{}, err
+		}
+	}
+
+	db.mutex.RLock()
+	matches := []*AuditEntry{}
+	for _, a := range db.audit {
+		if len(opts.User) > 0 && !strings.EqualFold(a.UserName, opts.User) {
+			continue
+		}
+		if len(opts.Action) > 0 && !auditActionMatches(a.Action, opts.Action) {
+			continue
+		}
+		if opts.TargetId != 0 && !containsId(a.TargetIds, opts.TargetId) {
+			continue
+		}
+		if len(opts.From) > 0 && a.Logged < opts.From {
+			continue
+		}
+		if len(before) > 0 && a.Logged >= before {
+			continue
+		}
+		matches = append(matches, a)
+	}
+	db.mutex.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Id > matches[j].Id
+	})
+
+	entries := []AuditEntry{}
+	for i := opts.Offset; i < len(matches) && len(entries) < opts.Limit; i++ {
+		entries = append(entries, *matches[i])
+	}
+
+	return entries, nil
+}
+
+// Must be called with at least the read lock held.
+func (db *memoryDb) findRoleByName(name string) (int64, *memoryRole) {
+	for id, r := range db.roles {
+		if r.name == name {
+			return id, r
+		}
+	}
+	return 0, nil
+}
+
+// Must be called with at least the read lock held.
+func (db *memoryDb) isRoleUsed(id int64) bool {
+	for _, u := range db.users {
+		if u.role == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with at least the read lock held.
+func (db *memoryDb) adminRole(id int64, r *memoryRole) AdminRole {
+	return AdminRole{
+		Id:             id,
+		Name:           r.name,
+		Admin:          r.admin,
+		AccessSessions: r.accessSessions,
+		AccessHostBans: r.accessHostBans,
+		AccessRoles:    r.accessRoles,
+		AccessUsers:    r.accessUsers,
+		AccessBackups:  r.accessBackups,
+		AccessAudit:    r.accessAudit,
+		Used:           db.isRoleUsed(id),
+	}
+}
+
+func (db *memoryDb) AdminCreateRole(
+	name string, admin bool, accessSessions int64, accessHostbans int64,
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (int64, error) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if existingId, _ := db.findRoleByName(name); existingId != 0 {
+		return 0, fmt.Errorf("Role %s already exists", name)
+	}
+
+	id := db.nextId()
+	db.roles[id] = &memoryRole{
+		name:           name,
+		admin:          admin,
+		accessSessions: int(accessSessions),
+		accessHostBans: int(accessHostbans),
+		accessRoles:    int(accessRoles),
+		accessUsers:    int(accessUsers),
+		accessBackups:  int(accessBackups),
+		accessAudit:    int(accessAudit),
+	}
+	return id, nil
+}
+
+func (db *memoryDb) AdminUpdateRole(
+	id int64, name string, admin bool, accessSessions int64, accessHostbans int64,
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (bool, error) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	r, found := db.roles[id]
+	if !found {
+		return false, nil
+	}
+
+	if existingId, _ := db.findRoleByName(name); existingId != 0 && existingId != id {
+		return false, fmt.Errorf("Role %s already exists", name)
+	}
+
+	r.name = name
+	r.admin = admin
+	r.accessSessions = int(accessSessions)
+	r.accessHostBans = int(accessHostbans)
+	r.accessRoles = int(accessRoles)
+	r.accessUsers = int(accessUsers)
+	r.accessBackups = int(accessBackups)
+	r.accessAudit = int(accessAudit)
+	return true, nil
+}
+
+func (db *memoryDb) AdminDeleteRole(id int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.roles[id]; !found {
+		return false, nil
+	} else if db.isRoleUsed(id) {
+		return false, fmt.Errorf("Role %d is still in use", id)
+	}
+
+	delete(db.roles, id)
+	return true, nil
+}
+
+func (db *memoryDb) AdminQueryRoles(ctx context.Context) ([]AdminRole, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	roles := make([]AdminRole, 0, len(db.roles))
+	for id, r := range db.roles {
+		roles = append(roles, db.adminRole(id, r))
+	}
+
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+
+	return roles, nil
+}
+
+func (db *memoryDb) AdminQueryRoleByName(name string, ctx context.Context) (AdminRole, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if id, r := db.findRoleByName(name); r != nil {
+		return db.adminRole(id, r), nil
+	}
+	return AdminRole{}, nil
+}
+
+// Must be called with at least the read lock held.
+func (db *memoryDb) findUserByName(name string) (int64, *memoryUser) {
+	for id, u := range db.users {
+		if u.name == name {
+			return id, u
+		}
+	}
+	return 0, nil
+}
+
+func (db *memoryDb) AdminCreateUser(name string, passwordHash string, role int64, ctx context.Context) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if existingId, _ := db.findUserByName(name); existingId != 0 {
+		return 0, fmt.Errorf("User %s already exists", name)
+	} else if _, found := db.roles[role]; !found {
+		return 0, fmt.Errorf("Role %d does not exist", role)
+	}
+
+	id := db.nextId()
+	db.users[id] = &memoryUser{
+		name:         name,
+		passwordHash: passwordHash,
+		role:         role,
+	}
+	return id, nil
+}
+
+func (db *memoryDb) AdminUpdateUser(id int64, name string, passwordHash string, role int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	u, found := db.users[id]
+	if !found {
+		return false, nil
+	}
+
+	if existingId, _ := db.findUserByName(name); existingId != 0 && existingId != id {
+		return false, fmt.Errorf("User %s already exists", name)
+	} else if _, found := db.roles[role]; !found {
+		return false, fmt.Errorf("Role %d does not exist", role)
+	}
+
+	u.name = name
+	u.role = role
+	if passwordHash != "" {
+		u.passwordHash = passwordHash
+	}
+	return true, nil
+}
+
+func (db *memoryDb) AdminUpdateUserPassword(id int64, passwordHash string, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	u, found := db.users[id]
+	if !found {
+		return false, nil
+	}
+
+	u.passwordHash = passwordHash
+	return true, nil
+}
+
+func (db *memoryDb) AdminDeleteUser(id int64, ctx context.Context) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.users[id]; !found {
+		return false, nil
+	}
+
+	delete(db.users, id)
+	return true, nil
+}
+
+func (db *memoryDb) AdminQueryUserByName(name string, ctx context.Context) (AdminUserDetail, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	id, u := db.findUserByName(name)
+	if u == nil {
+		return AdminUserDetail{Id: 0}, nil
+	}
+
+	r := db.roles[u.role]
+	return AdminUserDetail{
+		Id:   id,
+		Name: u.name,
+		Role: AdminRole{
+			Id:             u.role,
+			Name:           r.name,
+			Admin:          r.admin,
+			AccessSessions: r.accessSessions,
+			AccessHostBans: r.accessHostBans,
+			AccessRoles:    r.accessRoles,
+			AccessUsers:    r.accessUsers,
+			AccessBackups:  r.accessBackups,
+			AccessAudit:    r.accessAudit,
+		},
+		PasswordHash: u.passwordHash,
+	}, nil
+}
+
+func (db *memoryDb) AdminQueryUsers(ctx context.Context) ([]AdminUser, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	users := make([]AdminUser, 0, len(db.users))
+	for id, u := range db.users {
+		users = append(users, AdminUser{
+			Id:   id,
+			Name: u.name,
+			Role: db.roles[u.role].name,
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	return users, nil
+}
+
+func (db *memoryDb) Export(ctx context.Context) (ExportData, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	data := newExportData()
+	for id, s := range db.sessions {
+		var unlistReason *string
+		if s.unlistReason != nil {
+			reason := *s.unlistReason
+			unlistReason = &reason
+		}
+		data.Sessions = append(data.Sessions, ExportSession{
+			Id:                 id,
+			Host:               s.info.Host,
+			Port:               s.info.Port,
+			SessionId:          s.info.Id,
+			Protocol:           s.info.Protocol,
+			Title:              s.info.Title,
+			Users:              s.info.Users,
+			MaxUsers:           s.info.MaxUsers,
+			Password:           s.info.Password,
+			Nsfm:               s.info.Nsfm,
+			Owner:              s.info.Owner,
+			Started:            s.info.Started,
+			LastActive:         s.lastActive.UTC().Format(memoryTimestampFormat),
+			Unlisted:           s.unlisted,
+			UnlistReason:       unlistReason,
+			UpdateKey:          s.updateKey,
+			ClientIp:           s.clientIp,
+			Closed:             s.info.Closed,
+			ActiveDrawingUsers: s.info.ActiveDrawingUsers,
+			AllowWeb:           s.info.AllowWeb,
+			Flagged:            s.flagged,
+			Pending:            s.pending,
+		})
+	}
+	sort.Slice(data.Sessions, func(i, j int) bool {
+		return data.Sessions[i].Id < data.Sessions[j].Id
+	})
+
+	for _, a := range db.archive {
+		data.Archive = append(data.Archive, a.info)
+	}
+	sort.Slice(data.Archive, func(i, j int) bool {
+		return data.Archive[i].Id < data.Archive[j].Id
+	})
+
+	for id, b := range db.hostBans {
+		var expires string
+		if b.expires != nil {
+			expires = b.expires.UTC().Format(memoryTimestampFormat)
+		}
+		data.HostBans = append(data.HostBans, ExportHostBan{
+			Id:      id,
+			Type:    b.kind,
+			Host:    b.host,
+			Pattern: b.pattern,
+			Expires: expires,
+			Notes:   b.notes,
+		})
+	}
+	sort.Slice(data.HostBans, func(i, j int) bool {
+		return data.HostBans[i].Id < data.HostBans[j].Id
+	})
+
+	for id, r := range db.roles {
+		data.Roles = append(data.Roles, ExportRole{
+			Id:             id,
+			Name:           r.name,
+			Admin:          r.admin,
+			AccessSessions: r.accessSessions,
+			AccessHostBans: r.accessHostBans,
+			AccessRoles:    r.accessRoles,
+			AccessUsers:    r.accessUsers,
+			AccessBackups:  r.accessBackups,
+			AccessAudit:    r.accessAudit,
+		})
+	}
+	sort.Slice(data.Roles, func(i, j int) bool {
+		return data.Roles[i].Id < data.Roles[j].Id
+	})
+
+	for id, u := range db.users {
+		data.Users = append(data.Users, ExportUser{
+			Id:           id,
+			Name:         u.name,
+			PasswordHash: u.passwordHash,
+			Role:         u.role,
+		})
+	}
+	sort.Slice(data.Users, func(i, j int) bool {
+		return data.Users[i].Id < data.Users[j].Id
+	})
+
+	for _, o := range db.overlays {
+		data.Overlays = append(data.Overlays, *o)
+	}
+	sort.Slice(data.Overlays, func(i, j int) bool {
+		return data.Overlays[i].Id < data.Overlays[j].Id
+	})
+
+	for _, f := range db.filters {
+		data.Filters = append(data.Filters, *f)
+	}
+	sort.Slice(data.Filters, func(i, j int) bool {
+		return data.Filters[i].Id < data.Filters[j].Id
+	})
+
+	for _, r := range db.reports {
+		data.Reports = append(data.Reports, *r)
+	}
+	sort.Slice(data.Reports, func(i, j int) bool {
+		return data.Reports[i].Id < data.Reports[j].Id
+	})
+
+	for _, a := range db.audit {
+		data.Audit = append(data.Audit, *a)
+	}
+	sort.Slice(data.Audit, func(i, j int) bool {
+		return data.Audit[i].Id < data.Audit[j].Id
+	})
+
+	return data, nil
+}
+
+func (db *memoryDb) Import(data ExportData, replace bool, ctx context.Context) error {
+	if err := data.normalize(); err != nil {
+		return err
+	}
+
+	sessions := map[int64]*memorySession{}
+	archive := map[int64]*memoryArchivedSession{}
+	hostBans := map[int64]*memoryHostBan{}
+	roles := map[int64]*memoryRole{}
+	users := map[int64]*memoryUser{}
+	overlays := map[int64]*SessionOverlay{}
+	filters := map[int64]*TitleFilter{}
+	reports := map[int64]*SessionReport{}
+	audit := map[int64]*AuditEntry{}
+	var lastId int64
+	updateLastId := func(id int64) {
+		if id > lastId {
+			lastId = id
+		}
+	}
+
+	// The formats have been checked by normalize already
+	for _, s := range data.Sessions {
+		started, _ := time.Parse(memoryStartedFormat, s.Started)
+		lastActive, _ := time.Parse(memoryTimestampFormat, s.LastActive)
+		var unlistReason *string
+		if s.UnlistReason != nil {
+			reason := *s.UnlistReason
+			unlistReason = &reason
+		}
+		sessions[s.Id] = &memorySession{
+			info: SessionInfo{
+				Host:               s.Host,
+				Port:               s.Port,
+				Id:                 s.SessionId,
+				Protocol:           s.Protocol,
+				Title:              s.Title,
+				Users:              s.Users,
+				MaxUsers:           s.MaxUsers,
+				Usernames:          []string{},
+				Password:           s.Password,
+				Nsfm:               s.Nsfm,
+				Owner:              s.Owner,
+				Started:            s.Started,
+				Closed:             s.Closed,
+				ActiveDrawingUsers: s.ActiveDrawingUsers,
+				AllowWeb:           s.AllowWeb,
+			},
+			started:      started,
+			lastActive:   lastActive,
+			unlisted:     s.Unlisted,
+			unlistReason: unlistReason,
+			updateKey:    s.UpdateKey,
+			clientIp:     s.ClientIp,
+			flagged:      s.Flagged,
+			pending:      s.Pending,
+		}
+		updateLastId(s.Id)
+	}
+
+	for _, a := range data.Archive {
+		started, _ := time.Parse(memoryStartedFormat, a.Started)
+		lastActive, _ := time.Parse(memoryTimestampFormat, a.LastActive)
+		archived, _ := time.Parse(memoryTimestampFormat, a.Archived)
+		archive[a.Id] = &memoryArchivedSession{
+			info:       a,
+			started:    started,
+			lastActive: lastActive,
+			archived:   archived,
+		}
+		updateLastId(a.Id)
+	}
+
+	for _, b := range data.HostBans {
+		var expires *time.Time
+		if b.Expires != "" {
+			t, _ := time.Parse(memoryTimestampFormat, b.Expires)
+			expires = &t
+		}
+		hostBans[b.Id] = &memoryHostBan{
+			kind:    b.Type,
+			host:    b.Host,
+			pattern: b.Pattern,
+			expires: expires,
+			notes:   b.Notes,
+		}
+		updateLastId(b.Id)
+	}
+
+	for _, r := range data.Roles {
+		roles[r.Id] = &memoryRole{
+			name:           r.Name,
+			admin:          r.Admin,
+			accessSessions: r.AccessSessions,
+			accessHostBans: r.AccessHostBans,
+			accessRoles:    r.AccessRoles,
+			accessUsers:    r.AccessUsers,
+			accessBackups:  r.AccessBackups,
+			accessAudit:    r.AccessAudit,
+		}
+		updateLastId(r.Id)
+	}
+
+	for _, u := range data.Users {
+		if _, found := roles[u.Role]; !found {
+			return fmt.Errorf("User %d: role %d not found", u.Id, u.Role)
+		}
+		users[u.Id] = &memoryUser{
+			name:         u.Name,
+			passwordHash: u.PasswordHash,
+			role:         u.Role,
+		}
+		updateLastId(u.Id)
+	}
+
+	for i := range data.Overlays {
+		o := data.Overlays[i]
+		o.Host = strings.ToLower(o.Host)
+		overlays[o.Id] = &o
+		updateLastId(o.Id)
+	}
+
+	for i := range data.Filters {
+		f := data.Filters[i]
+		filters[f.Id] = &f
+		updateLastId(f.Id)
+	}
+
+	for i := range data.Reports {
+		r := data.Reports[i]
+		reports[r.Id] = &r
+		updateLastId(r.Id)
+	}
+
+	for i := range data.Audit {
+		a := data.Audit[i]
+		audit[a.Id] = &a
+		updateLastId(a.Id)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !replace && (len(db.sessions) > 0 || len(db.archive) > 0 ||
+		len(db.hostBans) > 0 || len(db.roles) > 0 || len(db.users) > 0 ||
+		len(db.overlays) > 0 || len(db.filters) > 0 || len(db.reports) > 0 ||
+		len(db.audit) > 0) {
+		return ErrDatabaseNotEmpty
+	}
+
+	db.sessions = sessions
+	db.archive = archive
+	db.hostBans = hostBans
+	db.roles = roles
+	db.users = users
+	db.overlays = overlays
+	db.filters = filters
+	db.reports = reports
+	db.audit = audit
+	if lastId > db.lastId {
+		db.lastId = lastId
+	}
+
+	return nil
+}
+
+func (db *memoryDb) Backup(ctx context.Context) (BackupInfo, error) {
+	return BackupInfo{}, ErrBackupNotSupported
+}
+
+func (db *memoryDb) QueryBackups(ctx context.Context) ([]BackupInfo, error) {
+	return nil, ErrBackupNotSupported
+}
+
+func (db *memoryDb) Close() error {
+	db.cleanupTask.stop()
+	return nil
+}
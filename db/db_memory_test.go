@@ -0,0 +1,818 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func insertMemoryTest(db *memoryDb, title string, id string) NewSessionInfo {
+	ses, err := db.InsertSession(
+		SessionInfo{
+			Host:      "example.com",
+			Port:      27750,
+			Id:        id,
+			Protocol:  "dp:4.21.2",
+			Title:     title,
+			Users:     2,
+			Usernames: []string{"User1", "Other one"},
+			Password:  false,
+			Nsfm:      false,
+			Owner:     "User1",
+			Started:   "",
+		},
+		"192.168.1.1",
+		false,
+		context.TODO(),
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return ses
+}
+
+func TestMemoryQueryList(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+	sessions, err := db.QuerySessionList(QueryOptions{}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatalf("Did not receive zero listings (got %d)", len(sessions))
+	}
+
+	insertMemoryTest(db, "Test", "demo1")
+	insertMemoryTest(db, "Example", "demo2")
+
+	sessions, err = db.QuerySessionList(QueryOptions{}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("Did not receive 2 listings (got %d)", len(sessions))
+	}
+
+	// Sessions are sorted by title
+	if sessions[0].Title != "Example" || sessions[0].Id != "demo2" {
+		t.Fatal("First item was not Example")
+	}
+
+	if sessions[1].Title != "Test" {
+		t.Fatal("Second item was not Test")
+	}
+
+	if len(sessions[0].Usernames) != 0 {
+		t.Fatal("First item usernames not empty")
+	}
+
+	// Filter by title, case-insensitively like SQL's LIKE
+	sessions, err = db.QuerySessionList(QueryOptions{Title: "ex"}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Title != "Example" {
+		t.Fatalf("Expected only Example, got %v", sessions)
+	}
+
+	// Filter by protocol
+	sessions, err = db.QuerySessionList(QueryOptions{Protocol: "dp:4.20.1"}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatalf("Did not receive 0 listings (got %d)", len(sessions))
+	}
+}
+
+// Shared by the tests of all backends, since the filters must work the same
+func testQueryFilters(t *testing.T, db Database) {
+	ctx := context.TODO()
+	sessions := []SessionInfo{
+		{Host: "a.com", Id: "open", Title: "Open", Users: 2, MaxUsers: 10, Owner: "Alice", AllowWeb: true},
+		{Host: "a.com", Id: "password", Title: "Password", Users: 3, MaxUsers: 10, Owner: "Bob", Password: true},
+		{Host: "B.com", Id: "closed", Title: "Closed", Users: 4, MaxUsers: 10, Owner: "alice", Closed: true},
+		{Host: "b.com", Id: "full", Title: "Full", Users: 5, MaxUsers: 5, Owner: "Carol", AllowWeb: true},
+	}
+	for _, s := range sessions {
+		s.Port = 27750
+		s.Protocol = "dp:4.24.0"
+		s.Usernames = []string{}
+		if _, err := db.InsertSession(s, "192.168.1.1", false, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		opts     QueryOptions
+		expected []string
+	}{
+		{QueryOptions{}, []string{"Closed", "Full", "Open", "Password"}},
+		{QueryOptions{NoPassword: true}, []string{"Closed", "Full", "Open"}},
+		{QueryOptions{NoClosed: true}, []string{"Full", "Open", "Password"}},
+		{QueryOptions{NoFull: true}, []string{"Closed", "Open", "Password"}},
+		{QueryOptions{WebOnly: true}, []string{"Full", "Open"}},
+		{QueryOptions{MinUsers: 4}, []string{"Closed", "Full"}},
+		{QueryOptions{MaxUsers: 3}, []string{"Open", "Password"}},
+		{QueryOptions{MinUsers: 3, MaxUsers: 4}, []string{"Closed", "Password"}},
+		{QueryOptions{Owner: "ALICE"}, []string{"Closed", "Open"}},
+		{QueryOptions{Host: "b.com"}, []string{"Closed", "Full"}},
+		{QueryOptions{Host: "a.com", NoPassword: true}, []string{"Open"}},
+	}
+
+	for _, test := range tests {
+		list, err := db.QuerySessionList(test.opts, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles := []string{}
+		for _, s := range list {
+			titles = append(titles, s.Title)
+		}
+		if strings.Join(titles, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Filter %+v: expected %v, got %v", test.opts, test.expected, titles)
+		}
+	}
+}
+
+func TestMemoryQueryFilters(t *testing.T) {
+	testQueryFilters(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func testSessionOverlays(t *testing.T, db Database) {
+	ctx := context.TODO()
+
+	id, err := db.AdminPutSessionOverlay(SessionOverlay{
+		Host: "Example.com", Port: 27750, SessionId: "hidden", Unlisted: true, UnlistReason: "spam"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AdminPutSessionOverlay(SessionOverlay{
+		Host: "example.com", Port: 27750, SessionId: "tagged", Nsfm: true}, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Putting an overlay for the same session replaces it
+	if replaced, err := db.AdminPutSessionOverlay(SessionOverlay{
+		Host: "example.com", Port: 27750, SessionId: "hidden", Unlisted: true, UnlistReason: "still spam"}, ctx); err != nil {
+		t.Fatal(err)
+	} else if replaced != id {
+		t.Errorf("Expected overlay %d to be replaced, got new id %d", id, replaced)
+	}
+
+	overlays, err := db.QuerySessionOverlays(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlays) != 2 {
+		t.Fatalf("Expected 2 overlays, got %+v", overlays)
+	}
+
+	sessions := []SessionInfo{
+		{Host: "EXAMPLE.COM", Port: 27750, Id: "hidden", Title: "Hidden"},
+		{Host: "example.com", Port: 27750, Id: "tagged", Title: "Tagged"},
+		{Host: "example.com", Port: 27751, Id: "tagged", Title: "Other port"},
+	}
+	applied := NewSessionOverlayIndex(overlays).Apply(sessions)
+	if len(applied) != 2 || applied[0].Title != "Tagged" || !applied[0].Nsfm || applied[1].Nsfm {
+		t.Errorf("Unexpected sessions after applying overlays: %+v", applied)
+	}
+
+	if deleted, err := db.AdminDeleteSessionOverlay(id, ctx); err != nil || !deleted {
+		t.Errorf("Overlay %d not deleted (%v)", id, err)
+	}
+	if deleted, _ := db.AdminDeleteSessionOverlay(id, ctx); deleted {
+		t.Errorf("Overlay %d deleted twice", id)
+	}
+
+	if overlays, _ := db.QuerySessionOverlays(ctx); len(overlays) != 1 || overlays[0].SessionId != "tagged" {
+		t.Errorf("Expected only the tagged overlay to remain, got %+v", overlays)
+	}
+}
+
+func TestMemorySessionOverlays(t *testing.T) {
+	testSessionOverlays(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func TestMemorySessionRefreshing(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+	ses := insertMemoryTest(db, "test", "demo1")
+
+	fields := map[string]interface{}{
+		"title":     "Hello",
+		"users":     10,
+		"usernames": []string{"a", "b"},
+		"password":  true,
+		"nsfm":      true,
+		"private":   false,
+	}
+	changed, err := db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err != nil {
+		panic(err)
+	} else if !changed {
+		t.Error("Refresh with new values reported no change")
+	}
+
+	// Refreshing again with the same values only keeps the session alive
+	changed, err = db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err != nil {
+		panic(err)
+	} else if changed {
+		t.Error("Refresh with the same values reported a change")
+	}
+
+	sessions, err := db.QuerySessionList(QueryOptions{}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatal("NSFM session listed without Nsfm option")
+	}
+
+	sessions, err = db.QuerySessionList(QueryOptions{Nsfm: true}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatalf("Did not receive 1 listing (got %d)", len(sessions))
+	}
+
+	s := sessions[0]
+	if s.Title != "Hello" || s.Users != 10 || !s.Password || !s.Nsfm {
+		t.Fatalf("Refresh did not apply: %v", s)
+	}
+
+	if len(s.Usernames) != 0 {
+		t.Fatal("Username list is not empty!")
+	}
+
+	_, err = db.RefreshSession(map[string]interface{}{}, ses.ListingId, "wrong", context.TODO())
+	if err == nil || err.Error() != "invalid session key" {
+		t.Fatalf("Expected invalid session key error, got %v", err)
+	}
+}
+
+func TestMemoryExpiredSession(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+	ses := insertMemoryTest(db, "test", "demo1")
+
+	db.sessions[ses.ListingId].lastActive = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sessions, err := db.QuerySessionList(QueryOptions{Nsfm: true}, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatalf("Did not receive 0 listing (got %d)", len(sessions))
+	}
+
+	if active, _ := db.IsActiveSession("example.com", "demo1", 27750, context.TODO()); active {
+		t.Fatal("Expired session is still active")
+	}
+
+	// Can't refresh either
+	_, err = db.RefreshSession(map[string]interface{}{}, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err == nil || err.Error() != "timed out" {
+		t.Fatalf("Expected timed out error, got %v", err)
+	}
+}
+
+func TestMemoryUnlisting(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+	ses1 := insertMemoryTest(db, "test1", "demo1")
+	ses2 := insertMemoryTest(db, "test2", "demo2")
+
+	if count, _ := db.GetHostSessionCount("example.com", context.TODO()); count != 2 {
+		t.Fatalf("Expected 2 sessions for host, got %d", count)
+	}
+
+	if ok, _ := db.DeleteSession(ses1.ListingId, ses1.UpdateKey, context.TODO()); !ok {
+		t.Fatal("Session not unlisted")
+	}
+
+	if ok, _ := db.DeleteSession(ses1.ListingId, ses1.UpdateKey, context.TODO()); ok {
+		t.Fatal("Session unlisted twice")
+	}
+
+	db.AdminUpdateSessions([]int64{ses2.ListingId}, true, "naughty", context.TODO())
+
+	_, err := db.RefreshSession(map[string]interface{}{}, ses2.ListingId, ses2.UpdateKey, context.TODO())
+	if err == nil || err.Error() != "naughty" {
+		t.Fatalf("Expected unlist reason as error, got %v", err)
+	}
+
+	if count, _ := db.GetHostSessionCount("example.com", context.TODO()); count != 0 {
+		t.Fatalf("Expected 0 sessions for host, got %d", count)
+	}
+}
+
+func tryMemoryIsBanned(t *testing.T, db *memoryDb, host string, expected bool) {
+	banned, err := db.IsBannedHost(host, nil, context.TODO())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if banned != expected {
+		t.Errorf("%s banned=%t, expected=%t", host, banned, expected)
+	}
+}
+
+func TestMemoryBanList(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+
+	db.AdminCreateHostBan(BanTypeHost, "banned1.com", "", "3000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "banned2.com", "", "", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "BaNnEd3.cOm", "", "", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "expired.com", "", "2000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "rebanned.com", "", "2000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "rebanned.com", "", "3000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "2001:db8::/32", "", "", "", context.TODO())
+
+	tryMemoryIsBanned(t, db, "banned1.com", true)
+	tryMemoryIsBanned(t, db, "banned2.com", true)
+	tryMemoryIsBanned(t, db, "BANNED2.com", true)
+	tryMemoryIsBanned(t, db, "banned3.com", true)
+	tryMemoryIsBanned(t, db, "rebanned.com", true)
+	tryMemoryIsBanned(t, db, "expired.com", false)
+	tryMemoryIsBanned(t, db, "not-banned.com", false)
+	tryMemoryIsBanned(t, db, "2001:db8::1", true)
+
+	if banned, _ := db.IsBannedHost("resolves.com", []net.IP{net.ParseIP("2001:db8:5::1")}, context.TODO()); !banned {
+		t.Error("Host resolving to a banned range is not banned")
+	}
+}
+
+func testSessionBans(t *testing.T, db Database) {
+	ctx := context.TODO()
+	db.AdminCreateHostBan(BanTypeOwner, "", "Troll", "", "", ctx)
+	db.AdminCreateHostBan(BanTypeOwnerRegex, "", `^spam\d+$`, "", "", ctx)
+	db.AdminCreateHostBan(BanTypeTitle, "", `free\s+robux`, "", "", ctx)
+	db.AdminCreateHostBan(BanTypeTitle, "", "expired", "2000-01-01", "", ctx)
+	db.AdminCreateHostBan(BanTypeSession, "example.com", "evil", "", "", ctx)
+
+	tests := []struct {
+		session SessionInfo
+		banned  bool
+	}{
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "tROLL", Title: "Hi"}, true},
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "Trolley", Title: "Hi"}, false},
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "spam42", Title: "Hi"}, true},
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "nospam42", Title: "Hi"}, false},
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "Alice", Title: "Get FREE  Robux"}, true},
+		{SessionInfo{Host: "example.com", Id: "a", Owner: "Alice", Title: "Expired"}, false},
+		{SessionInfo{Host: "EXAMPLE.com", Id: "evil", Owner: "Alice", Title: "Hi"}, true},
+		{SessionInfo{Host: "example.org", Id: "evil", Owner: "Alice", Title: "Hi"}, false},
+	}
+
+	for _, test := range tests {
+		if banned, err := db.IsBannedSession(test.session, ctx); err != nil {
+			t.Fatal(err)
+		} else if banned != test.banned {
+			t.Errorf("%+v: banned=%t, expected=%t", test.session, banned, test.banned)
+		}
+	}
+
+	// Owner and title bans aren't host bans
+	if banned, _ := db.IsBannedHost("example.com", nil, ctx); banned {
+		t.Error("Host banned by a session ban")
+	}
+
+	// Changing the title to a banned one unlists the session
+	ses, err := db.InsertSession(SessionInfo{
+		Host: "example.com", Port: 27750, Id: "fine", Protocol: "dp:4.24.0",
+		Title: "Fine", Usernames: []string{}, Owner: "Alice"}, "192.168.1.1", false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RefreshSession(map[string]interface{}{"title": "Still fine"}, ses.ListingId, ses.UpdateKey, ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := db.RefreshSession(map[string]interface{}{"title": "free robux"}, ses.ListingId, ses.UpdateKey, ctx)
+		if err == nil || err.Error() != BannedSessionReason {
+			t.Errorf("Expected ban as refresh error, got %v", err)
+		}
+	}
+	if sessions, _ := db.QuerySessionList(QueryOptions{Nsfm: true}, ctx); len(sessions) != 0 {
+		t.Errorf("Banned session is still listed: %+v", sessions)
+	}
+
+	// The banned title isn't stored
+	sessions, err := db.AdminQuerySessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sessions {
+		if s.Id == ses.ListingId && s.Title != "Still fine" {
+			t.Errorf("Banned session has title %q, expected the old one", s.Title)
+		}
+	}
+}
+
+func TestMemorySessionBans(t *testing.T) {
+	testSessionBans(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func testTitleFilters(t *testing.T, db Database) {
+	ctx := context.TODO()
+
+	id, err := db.AdminCreateTitleFilter(TitleFilter{Type: "word", Pattern: "darn", Action: "mask"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AdminCreateTitleFilter(TitleFilter{Type: "regex", Pattern: `^free`, Action: "flag"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated, err := db.AdminUpdateTitleFilter(TitleFilter{Id: id, Type: "word", Pattern: "heck", Action: "reject", Notes: "x"}, ctx); err != nil || !updated {
+		t.Errorf("Filter %d not updated (%v)", id, err)
+	}
+	if updated, _ := db.AdminUpdateTitleFilter(TitleFilter{Id: id + 100, Type: "word", Pattern: "heck", Action: "reject"}, ctx); updated {
+		t.Error("Nonexistent filter updated")
+	}
+
+	filters, err := db.QueryTitleFilters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TitleFilter{Id: id, Type: "word", Pattern: "heck", Action: "reject", Notes: "x"}
+	if len(filters) != 2 || filters[0] != expected {
+		t.Errorf("Unexpected filters %+v", filters)
+	}
+
+	if deleted, err := db.AdminDeleteTitleFilter(id, ctx); err != nil || !deleted {
+		t.Errorf("Filter %d not deleted (%v)", id, err)
+	}
+	if filters, _ := db.QueryTitleFilters(ctx); len(filters) != 1 || filters[0].Pattern != "^free" {
+		t.Errorf("Expected only the flag filter to remain, got %+v", filters)
+	}
+
+	// Flagging a session marks it for review until an admin acts on it
+	ses, err := db.InsertSession(SessionInfo{
+		Host: "example.com", Port: 27750, Id: "flagged", Protocol: "dp:4.24.0",
+		Title: "Free stuff", Usernames: []string{}}, "127.0.0.1", false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlagSession(ses.ListingId, "^free", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := db.AdminQuerySessions(ctx); len(sessions) != 1 || sessions[0].Flagged != "^free" {
+		t.Errorf("Expected a flagged session, got %+v", sessions)
+	}
+
+	db.AdminUpdateSessions([]int64{ses.ListingId}, false, "", ctx)
+	if sessions, _ := db.AdminQuerySessions(ctx); len(sessions) != 1 || sessions[0].Flagged != "" {
+		t.Errorf("Expected the flag to be cleared, got %+v", sessions)
+	}
+}
+
+func TestMemoryTitleFilters(t *testing.T) {
+	testTitleFilters(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func testPendingSessions(t *testing.T, db Database) {
+	ctx := context.TODO()
+
+	var ids []int64
+	for _, id := range []string{"a", "b", "c"} {
+		ses, err := db.InsertSession(SessionInfo{
+			Host: "example.com", Port: 27750, Id: id, Protocol: "dp:4.24.0",
+			Title: "Pending " + id, Usernames: []string{}}, "127.0.0.1", id != "c", ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ses.ListingId)
+	}
+
+	// Pending sessions aren't listed, but still count as active
+	if sessions, _ := db.QuerySessionList(QueryOptions{Nsfm: true}, ctx); len(sessions) != 1 || sessions[0].Id != "c" {
+		t.Errorf("Expected only session c to be listed, got %+v", sessions)
+	}
+	if active, _ := db.IsActiveSession("example.com", "a", 27750, ctx); !active {
+		t.Error("Pending session is not active")
+	}
+
+	if changed, err := db.AdminReviewSessions([]int64{ids[0], ids[2]}, true, "", ctx); err != nil || !reflect.DeepEqual(changed, []int64{ids[0]}) {
+		t.Errorf("Expected only session a to be approved, got %v (%v)", changed, err)
+	}
+	if changed, err := db.AdminReviewSessions([]int64{ids[0], ids[1]}, false, "No", ctx); err != nil || !reflect.DeepEqual(changed, []int64{ids[1]}) {
+		t.Errorf("Expected only session b to be rejected, got %v (%v)", changed, err)
+	}
+
+	if sessions, _ := db.QuerySessionList(QueryOptions{Nsfm: true}, ctx); len(sessions) != 2 {
+		t.Errorf("Expected sessions a and c to be listed, got %+v", sessions)
+	}
+	sessions, _ := db.AdminQuerySessions(ctx)
+	for _, s := range sessions {
+		if s.Pending {
+			t.Errorf("Session %s is still pending", s.SessionId)
+		}
+		if s.SessionId == "b" && (!s.Unlisted || s.UnlistReason != "No") {
+			t.Errorf("Rejected session not unlisted: %+v", s)
+		}
+	}
+}
+
+func TestMemoryPendingSessions(t *testing.T) {
+	testPendingSessions(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func testSessionReports(t *testing.T, db Database) {
+	ctx := context.TODO()
+
+	var ids []int64
+	for _, category := range []string{"title", "nsfm", "spam"} {
+		id, err := db.InsertSessionReport(SessionReport{
+			Host: "example.com", Port: 27750, SessionId: "abc", Title: "Title",
+			Owner: "Owner", Category: category, Message: "Look at this", ClientIp: "192.168.1.1"}, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	reports, err := db.AdminQuerySessionReports(false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 || reports[0].Id != ids[2] || reports[0].Category != "spam" ||
+		reports[0].Message != "Look at this" || reports[0].Reported == "" || reports[0].Resolved != "" {
+		t.Errorf("Unexpected open reports: %+v", reports)
+	}
+
+	if resolved, err := db.AdminResolveSessionReports([]int64{ids[0], ids[1], ids[2] + 100}, "admin", "Unlisted", ctx); err != nil || !reflect.DeepEqual(resolved, ids[:2]) {
+		t.Errorf("Expected reports %v to be resolved, got %v (%v)", ids[:2], resolved, err)
+	}
+	if resolved, _ := db.AdminResolveSessionReports([]int64{ids[0]}, "admin", "Again", ctx); len(resolved) != 0 {
+		t.Errorf("Resolved report resolved again: %v", resolved)
+	}
+
+	if reports, _ := db.AdminQuerySessionReports(false, ctx); len(reports) != 1 || reports[0].Id != ids[2] {
+		t.Errorf("Expected only report %d to be open, got %+v", ids[2], reports)
+	}
+	reports, _ = db.AdminQuerySessionReports(true, ctx)
+	if len(reports) != 3 {
+		t.Fatalf("Expected 3 reports, got %+v", reports)
+	}
+	if r := reports[2]; r.Resolved == "" || r.ResolvedBy != "admin" || r.Resolution != "Unlisted" {
+		t.Errorf("Report not resolved: %+v", r)
+	}
+}
+
+func TestMemorySessionReports(t *testing.T) {
+	testSessionReports(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func testAuditLog(t *testing.T, db Database) {
+	ctx := context.TODO()
+
+	entries := []AuditEntry{
+		{UserId: 1, UserName: "mod", Action: "bans.create", TargetIds: []int64{5},
+			After: json.RawMessage(`{"host":"example.com"}`), ClientIp: "192.168.1.1"},
+		{UserId: 0, UserName: "admin", Action: "sessions.update", TargetIds: []int64{15, 25},
+			Before: json.RawMessage(`[{"id":15}]`), ClientIp: "192.168.1.2"},
+		{UserId: 1, UserName: "mod", Action: "banstuff.delete", TargetIds: []int64{15}},
+		{UserId: 1, UserName: "mod", Action: "cleanup"},
+	}
+	var ids []int64
+	for _, e := range entries {
+		id, err := db.InsertAuditEntry(e, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	all, err := db.AdminQueryAuditLog(AuditQueryOptions{Limit: 100}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 || all[0].Id != ids[3] || all[3].Id != ids[0] {
+		t.Fatalf("Unexpected audit log %+v", all)
+	}
+	if e := all[3]; e.UserName != "mod" || e.Action != "bans.create" || e.Logged == "" ||
+		!reflect.DeepEqual(e.TargetIds, []int64{5}) || e.Before != nil ||
+		string(e.After) != `{"host":"example.com"}` || e.ClientIp != "192.168.1.1" {
+		t.Errorf("Unexpected audit log entry %+v", e)
+	}
+	if e := all[0]; e.TargetIds == nil || len(e.TargetIds) != 0 {
+		t.Errorf("Expected no target ids, got %+v", e)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	tests := []struct {
+		opts     AuditQueryOptions
+		expected []int64
+	}{
+		{AuditQueryOptions{User: "ADMIN"}, []int64{ids[1]}},
+		{AuditQueryOptions{Action: "bans"}, []int64{ids[0]}},
+		{AuditQueryOptions{Action: "bans.create"}, []int64{ids[0]}},
+		{AuditQueryOptions{Action: "ban"}, []int64{}},
+		{AuditQueryOptions{TargetId: 15}, []int64{ids[2], ids[1]}},
+		{AuditQueryOptions{TargetId: 5}, []int64{ids[0]}},
+		{AuditQueryOptions{User: "mod", TargetId: 15}, []int64{ids[2]}},
+		{AuditQueryOptions{From: today, To: today}, []int64{ids[3], ids[2], ids[1], ids[0]}},
+		{AuditQueryOptions{To: yesterday}, []int64{}},
+		{AuditQueryOptions{Offset: 1, Limit: 2}, []int64{ids[2], ids[1]}},
+	}
+	for _, test := range tests {
+		if test.opts.Limit == 0 {
+			test.opts.Limit = 100
+		}
+		result, err := db.AdminQueryAuditLog(test.opts, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultIds := []int64{}
+		for _, e := range result {
+			resultIds = append(resultIds, e.Id)
+		}
+		if !reflect.DeepEqual(resultIds, test.expected) {
+			t.Errorf("Query %+v: expected %v, got %v", test.opts, test.expected, resultIds)
+		}
+	}
+}
+
+func TestMemoryAuditLog(t *testing.T) {
+	testAuditLog(t, newMemoryDb(5, CleanupSettings{}))
+}
+
+func TestMemoryRolesAndUsers(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{})
+	ctx := context.TODO()
+
+	roleId, err := db.AdminCreateRole("mod", false, 2, 1, 0, 0, 1, 1, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.AdminCreateRole("mod", false, 0, 0, 0, 0, 0, 0, ctx); err == nil {
+		t.Fatal("Duplicate role name accepted")
+	}
+
+	userId, err := db.AdminCreateUser("someone", "hash", roleId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.AdminQueryUserByName("someone", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Id != userId || user.Role.Name != "mod" || user.Role.AccessSessions != 2 || user.PasswordHash != "hash" {
+		t.Fatalf("Unexpected user %v", user)
+	}
+
+	if _, err := db.AdminDeleteRole(roleId, ctx); err == nil {
+		t.Fatal("Role in use was deleted")
+	}
+
+	if deleted, _ := db.AdminDeleteUser(userId, ctx); !deleted {
+		t.Fatal("User not deleted")
+	}
+
+	if deleted, _ := db.AdminDeleteRole(roleId, ctx); !deleted {
+		t.Fatal("Role not deleted")
+	}
+}
+
+// Same as the default configuration
+var testCleanupSettings = CleanupSettings{
+	TimedOutRetention: 24 * time.Hour,
+	ArchiveRetention:  30 * 24 * time.Hour,
+}
+
+func TestMemoryCleanup(t *testing.T) {
+	db := newMemoryDb(5, testCleanupSettings)
+	ses1 := insertMemoryTest(db, "test1", "demo1")
+	ses2 := insertMemoryTest(db, "test2", "demo2")
+	insertMemoryTest(db, "test3", "demo3")
+
+	db.DeleteSession(ses1.ListingId, ses1.UpdateKey, context.TODO())
+	db.sessions[ses2.ListingId].lastActive = time.Now().Add(-10 * 24 * time.Hour)
+
+	result, err := db.Cleanup(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ArchivedSessions != 2 {
+		t.Errorf("Expected 2 archived sessions, got %d", result.ArchivedSessions)
+	}
+
+	if len(db.sessions) != 1 {
+		t.Errorf("Expected only one session after cleanup, got %d", len(db.sessions))
+	}
+
+	archived, err := db.AdminQueryArchive(ArchiveQueryOptions{Limit: 10}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived) != 2 {
+		t.Fatalf("Expected two archived sessions, got %d", len(archived))
+	}
+
+	if archived[0].ListingId != ses1.ListingId || archived[0].UnlistReason != "unlisted by owner" {
+		t.Errorf("Unexpected first archived session %v", archived[0])
+	}
+
+	if archived[1].ListingId != ses2.ListingId || archived[1].UnlistReason != "timed out" {
+		t.Errorf("Unexpected second archived session %v", archived[1])
+	}
+
+	archived, _ = db.AdminQueryArchive(ArchiveQueryOptions{Title: "TEST2", Limit: 10}, context.TODO())
+	if len(archived) != 1 || archived[0].ListingId != ses2.ListingId {
+		t.Errorf("Expected only test2 in archive, got %v", archived)
+	}
+
+	// Past the retention period
+	for _, a := range db.archive {
+		a.archived = time.Now().AddDate(0, 0, -31)
+	}
+
+	if result, _ = db.Cleanup(context.TODO()); result.PurgedArchive != 2 {
+		t.Errorf("Expected 2 purged archived sessions, got %d", result.PurgedArchive)
+	}
+
+	if len(db.archive) != 0 {
+		t.Errorf("Expected archive to be empty, got %d", len(db.archive))
+	}
+}
+
+func TestMemoryCleanupRetention(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{
+		TimedOutRetention: time.Hour,
+		KickedRetention:   time.Hour,
+		HostBanRetention:  24 * time.Hour,
+	})
+	ses1 := insertMemoryTest(db, "test1", "demo1")
+	ses2 := insertMemoryTest(db, "test2", "demo2")
+	ses3 := insertMemoryTest(db, "test3", "demo3")
+
+	db.AdminUpdateSessions([]int64{ses1.ListingId, ses2.ListingId}, true, "naughty", context.TODO())
+	db.sessions[ses2.ListingId].lastActive = time.Now().Add(-2 * time.Hour)
+	db.sessions[ses3.ListingId].lastActive = time.Now().Add(-30 * time.Minute)
+
+	db.AdminCreateHostBan(BanTypeHost, "expired.com", "", "2000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "banned.com", "", "3000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "forever.com", "", "", "", context.TODO())
+
+	result, err := db.Cleanup(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the session kicked two hours ago
+	if result.ArchivedSessions != 1 {
+		t.Errorf("Expected 1 archived session, got %d", result.ArchivedSessions)
+	}
+
+	if _, found := db.sessions[ses2.ListingId]; found {
+		t.Error("Kicked session past retention not archived")
+	}
+
+	if result.PurgedHostBans != 1 || len(db.hostBans) != 2 {
+		t.Errorf("Expected 1 purged host ban, got %d", result.PurgedHostBans)
+	}
+}
+
+func TestMemoryCleanupTask(t *testing.T) {
+	db := newMemoryDb(5, CleanupSettings{
+		Interval:          10 * time.Millisecond,
+		TimedOutRetention: 24 * time.Hour,
+	})
+	ses := insertMemoryTest(db, "test", "demo1")
+	db.DeleteSession(ses.ListingId, ses.UpdateKey, context.TODO())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mutex.RLock()
+		archived := len(db.archive)
+		db.mutex.RUnlock()
+		if archived == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Session not archived by cleanup task")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Waits for the task to stop
+	db.Close()
+}
@@ -0,0 +1,1632 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type postgresDb struct {
+	db              *sql.DB
+	timeoutMinutes  int
+	cleanupSettings CleanupSettings
+	cleanupTask     *periodicTask
+}
+
+func isPostgresUrl(dbname string) bool {
+	return strings.HasPrefix(dbname, "postgres://") || strings.HasPrefix(dbname, "postgresql://")
+}
+
+// The schema at baselineVersion
+var postgresBaselineSchema = []string{
+	`CREATE TABLE migrations (
+		version BIGINT PRIMARY KEY NOT NULL
+		)`,
+	`CREATE TABLE sessions (
+		id BIGSERIAL PRIMARY KEY NOT NULL,
+		host TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		session_id TEXT NOT NULL,
+		protocol TEXT NOT NULL,
+		title TEXT NOT NULL,
+		users INTEGER NOT NULL,
+		usernames TEXT NOT NULL,
+		password BOOLEAN NOT NULL,
+		nsfm BOOLEAN NOT NULL,
+		owner TEXT NOT NULL,
+		started TIMESTAMPTZ NOT NULL,
+		last_active TIMESTAMPTZ NOT NULL,
+		unlisted BOOLEAN NOT NULL,
+		update_key TEXT NOT NULL,
+		client_ip TEXT NOT NULL,
+		unlist_reason TEXT,
+		max_users INTEGER NOT NULL,
+		closed BOOLEAN NOT NULL,
+		active_drawing_users INTEGER NOT NULL DEFAULT -1,
+		allow_web BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+	`CREATE INDEX sessions_host_idx ON sessions (host)`,
+	`CREATE TABLE hostbans (
+		id BIGSERIAL PRIMARY KEY NOT NULL,
+		host TEXT NOT NULL,
+		expires TIMESTAMPTZ,
+		notes TEXT NOT NULL DEFAULT ''
+		)`,
+	`CREATE TABLE accesslevels (
+		id INTEGER PRIMARY KEY NOT NULL,
+		description TEXT NOT NULL
+		)`,
+	`INSERT INTO accesslevels (id, description) VALUES
+		(0, 'none'), (1, 'view'), (2, 'manage')`,
+	`CREATE TABLE roles (
+		id BIGSERIAL PRIMARY KEY NOT NULL,
+		name TEXT UNIQUE NOT NULL,
+		admin BOOLEAN NOT NULL,
+		access_sessions INTEGER NOT NULL REFERENCES accesslevels (id),
+		access_hostbans INTEGER NOT NULL REFERENCES accesslevels (id),
+		access_roles INTEGER NOT NULL REFERENCES accesslevels (id),
+		access_users INTEGER NOT NULL REFERENCES accesslevels (id)
+		)`,
+	`CREATE TABLE users (
+		id BIGSERIAL PRIMARY KEY NOT NULL,
+		name TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		role BIGINT NOT NULL REFERENCES roles (id)
+		)`,
+}
+
+// Run the given function in a transaction, rolling back if it fails
+func postgresTransaction(sqldb *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Println("Rollback error:", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func postgresExecAll(tx *sql.Tx, statements []string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type postgresMigrator struct {
+	db *sql.DB
+}
+
+// Key of the advisory lock held while migrating, arbitrary but fixed
+const postgresMigrationLock = 0x6c6973747372760
+
+// The advisory lock belongs to a database session, so it's taken on a
+// connection of its own that's kept until the migrations are done
+func (m postgresMigrator) lock(f func() error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock); err != nil {
+			log.Println("Migration unlock error:", err)
+		}
+	}()
+
+	return f()
+}
+
+func (m postgresMigrator) appliedMigrations() (map[int64]bool, error) {
+	var exists bool
+	err := m.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = 'migrations'
+		)
+	`).Scan(&exists)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := m.db.Query(`SELECT version FROM migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]bool{}
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func (m postgresMigrator) initSchema() error {
+	return postgresTransaction(m.db, func(tx *sql.Tx) error {
+		if err := postgresExecAll(tx, postgresBaselineSchema); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`INSERT INTO migrations (version) SELECT generate_series(1, $1::BIGINT)`,
+			baselineVersion)
+		return err
+	})
+}
+
+func (m postgresMigrator) applyMigration(mig *migration) error {
+	return postgresTransaction(m.db, func(tx *sql.Tx) error {
+		if err := postgresExecAll(tx, mig.postgres); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO migrations (version) VALUES ($1)`, mig.version)
+		return err
+	})
+}
+
+func postgresOpen(dbname string) (*sql.DB, error) {
+	sqldb, err := sql.Open("postgres", dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sqldb.Ping(); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+
+	return sqldb, nil
+}
+
+// Only reads are made when querying the status, so readOnly needs no special
+// handling here
+func withPostgresMigrator(dbname string, readOnly bool, f func(m migrator) error) error {
+	sqldb, err := postgresOpen(dbname)
+	if err != nil {
+		return err
+	}
+	defer sqldb.Close()
+	return f(postgresMigrator{sqldb})
+}
+
+func newPostgresDb(dbname string, sessionTimeout int, cleanup CleanupSettings) (*postgresDb, error) {
+	sqldb, err := postgresOpen(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrateSchema(postgresMigrator{sqldb}); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+
+	db := &postgresDb{
+		db:              sqldb,
+		timeoutMinutes:  sessionTimeout,
+		cleanupSettings: cleanup,
+	}
+
+	db.cleanupTask = startCleanupTask(db, cleanup.Interval)
+
+	return db, nil
+}
+
+// Move unlisted and long inactive sessions to the archive and purge
+// archived sessions and expired host bans past their retention period
+func (db *postgresDb) Cleanup(ctx context.Context) (CleanupResult, error) {
+	var result CleanupResult
+	var err error
+	cutoffs := db.cleanupSettings.cutoffs(time.Now())
+
+	result.ArchivedSessions, err = postgresRowsAffected(db.db.ExecContext(ctx, `
+		WITH expired AS (
+			DELETE FROM sessions
+			WHERE (NOT unlisted AND last_active < $1)
+				OR (unlisted AND (unlist_reason IS NULL OR last_active < $2))
+			RETURNING *
+		)
+		INSERT INTO session_archive (
+			listing_id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner, started, last_active, archived,
+			client_ip, unlist_reason, kicked)
+		SELECT id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner, started, last_active, NOW(),
+			client_ip,
+			CASE
+				WHEN NOT unlisted THEN 'timed out'
+				WHEN unlist_reason IS NULL THEN 'unlisted by owner'
+				ELSE unlist_reason
+			END,
+			unlisted AND unlist_reason IS NOT NULL
+		FROM expired`, cutoffs.timedOut, cutoffs.kicked))
+	if err != nil {
+		return result, err
+	}
+
+	if !cutoffs.archive.IsZero() {
+		result.PurgedArchive, err = postgresRowsAffected(db.db.ExecContext(ctx,
+			`DELETE FROM session_archive WHERE archived < $1`, cutoffs.archive))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if !cutoffs.hostBan.IsZero() {
+		result.PurgedHostBans, err = postgresRowsAffected(db.db.ExecContext(ctx,
+			`DELETE FROM hostbans WHERE expires < $1`, cutoffs.hostBan))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func (db *postgresDb) SessionTimeoutMinutes() int {
+	return db.timeoutMinutes
+}
+
+// Get a list of sessions that match the given query parameters
+func (db *postgresDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]SessionInfo, error) {
+	querySql := `
+	SELECT host, port, session_id, protocol, title, users, password, nsfm, owner,
+	to_char(started AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+	max_users, closed, active_drawing_users, allow_web
+	FROM sessions
+	WHERE last_active >= NOW() - make_interval(mins => $1) AND NOT unlisted AND NOT pending`
+	params := []interface{}{db.timeoutMinutes}
+
+	if len(opts.Title) > 0 {
+		params = append(params, opts.Title)
+		querySql += fmt.Sprintf(" AND strpos(lower(title), lower($%d)) > 0", len(params))
+	}
+
+	if !opts.Nsfm {
+		querySql += " AND NOT nsfm"
+	}
+
+	if opts.NoPassword {
+		querySql += " AND NOT password"
+	}
+
+	if opts.NoClosed {
+		querySql += " AND NOT closed"
+	}
+
+	if opts.NoFull {
+		querySql += " AND (max_users <= 0 OR users < max_users)"
+	}
+
+	if opts.WebOnly {
+		querySql += " AND allow_web"
+	}
+
+	if opts.MinUsers > 0 {
+		params = append(params, opts.MinUsers)
+		querySql += fmt.Sprintf(" AND users >= $%d", len(params))
+	}
+
+	if opts.MaxUsers > 0 {
+		params = append(params, opts.MaxUsers)
+		querySql += fmt.Sprintf(" AND users <= $%d", len(params))
+	}
+
+	if len(opts.Owner) > 0 {
+		params = append(params, opts.Owner)
+		querySql += fmt.Sprintf(" AND lower(owner) = lower($%d)", len(params))
+	}
+
+	if len(opts.Host) > 0 {
+		params = append(params, opts.Host)
+		querySql += fmt.Sprintf(" AND lower(host) = lower($%d)", len(params))
+	}
+
+	if len(opts.Protocol) > 0 {
+		params = append(params, pq.Array(strings.Split(opts.Protocol, ",")))
+		querySql += fmt.Sprintf(" AND protocol = ANY($%d)", len(params))
+	}
+
+	rows, err := db.db.QueryContext(ctx, querySql, params...)
+	if err != nil {
+		return []SessionInfo{}, err
+	}
+	defer rows.Close()
+
+	sessions := []SessionInfo{}
+	for rows.Next() {
+		s := SessionInfo{Usernames: []string{}}
+		err := rows.Scan(&s.Host, &s.Port, &s.Id, &s.Protocol, &s.Title,
+			&s.Users, &s.Password, &s.Nsfm, &s.Owner, &s.Started, &s.MaxUsers,
+			&s.Closed, &s.ActiveDrawingUsers, &s.AllowWeb)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return sessions, err
+	}
+
+	// Sorted here rather than in SQL, so that the order doesn't depend on the
+	// database collation and matches the order of merged included sessions
+	SortSessionList(sessions, opts)
+	return sessions, nil
+}
+
+// Is there an active announcement for this session
+func (db *postgresDb) IsActiveSession(host, id string, port int, ctx context.Context) (bool, error) {
+	var active bool
+	err := db.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1
+	FROM sessions
+	WHERE host=$1 AND port=$2 AND session_id=$3
+	AND last_active >= NOW() - make_interval(mins => $4) AND NOT unlisted
+	)`, host, port, id, db.timeoutMinutes).Scan(&active)
+	return active, err
+}
+
+// Get the number of active announcements on this server (all ports)
+func (db *postgresDb) GetHostSessionCount(host string, ctx context.Context) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions
+	WHERE host=$1 AND last_active >= NOW() - make_interval(mins => $2) AND NOT unlisted
+	`, host, db.timeoutMinutes).Scan(&count)
+	return count, err
+}
+
+// Check if the given host or any of the addresses is on the ban list
+func (db *postgresDb) IsBannedHost(host string, addrs []net.IP, ctx context.Context) (bool, error) {
+	// Ranges and wildcards are matched here rather than in SQL
+	rows, err := db.db.QueryContext(ctx, `SELECT host
+	FROM hostbans
+	WHERE kind = 'host' AND (expires IS NULL OR expires > NOW())
+	`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pattern string
+		if err := rows.Scan(&pattern); err != nil {
+			return false, err
+		}
+		if HostBanMatches(pattern, host, addrs) {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// Check if the session matches any of the bans that aren't host bans
+func (db *postgresDb) IsBannedSession(session SessionInfo, ctx context.Context) (bool, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT kind, host, pattern
+	FROM hostbans
+	WHERE kind != 'host' AND (expires IS NULL OR expires > NOW())
+	`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var banType, host, pattern string
+		if err := rows.Scan(&banType, &host, &pattern); err != nil {
+			return false, err
+		}
+		if SessionBanMatches(banType, host, pattern, &session) {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// Unlist the session if changing its title makes it match a ban. Returns
+// false if it doesn't or if the session can't be refreshed anyway.
+func (db *postgresDb) unlistIfBannedTitle(listingId int64, updateKey string, title string, ctx context.Context) (bool, error) {
+	session := SessionInfo{Title: title}
+	err := db.db.QueryRowContext(ctx, `
+		SELECT host, session_id, owner
+		FROM sessions
+		WHERE id = $1 AND update_key = $2 AND COALESCE(unlist_reason, '') = ''
+	`, listingId, updateKey).Scan(&session.Host, &session.Id, &session.Owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if banned, err := db.IsBannedSession(session, ctx); err != nil || !banned {
+		return false, err
+	}
+
+	_, err = db.db.ExecContext(ctx, `UPDATE sessions SET unlisted = TRUE, unlist_reason = $1 WHERE id = $2`,
+		BannedSessionReason, listingId)
+	return err == nil, err
+}
+
+// Insert a new session to the database
+// Note: this function does not validate the data;
+// that must be done before calling this
+func (db *postgresDb) InsertSession(session SessionInfo, clientIp string, pending bool, ctx context.Context) (NewSessionInfo, error) {
+	updateKey, err := generateUpdateKey()
+	if err != nil {
+		return NewSessionInfo{}, err
+	}
+
+	var listingId int64
+	err = db.db.QueryRowContext(ctx, `INSERT INTO sessions
+	(host, port, session_id, protocol, title, users, usernames, password, nsfm,
+	owner, started, last_active, unlisted, update_key, client_ip, max_users,
+	closed, active_drawing_users, allow_web, pending)
+	VALUES ($1, $2, $3, $4, $5, $6, '', $7, $8, $9, date_trunc('second', NOW()),
+	NOW(), FALSE, $10, $11, $12, $13, $14, $15, $16)
+	RETURNING id
+	`,
+		session.Host, session.Port, session.Id, session.Protocol, session.Title,
+		session.Users, session.Password, session.Nsfm, session.Owner, updateKey,
+		clientIp, session.MaxUsers, session.Closed, session.ActiveDrawingUsers,
+		session.AllowWeb, pending,
+	).Scan(&listingId)
+	if err != nil {
+		return NewSessionInfo{}, err
+	}
+
+	return NewSessionInfo{
+		listingId,
+		updateKey,
+	}, nil
+}
+
+// Refresh an announcement. Returns whether any of the listed fields changed.
+func (db *postgresDb) RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) (bool, error) {
+	// Construct update query, along with a condition that's true if any of
+	// the set columns changes
+	querySql := "UPDATE sessions SET last_active=NOW()"
+	changedSql := []string{}
+	params := []interface{}{}
+
+	set := func(column string, value interface{}) {
+		params = append(params, value)
+		querySql += fmt.Sprintf(", %s=$%d", column, len(params))
+		changedSql = append(changedSql, fmt.Sprintf("%s IS DISTINCT FROM $%d", column, len(params)))
+	}
+
+	if val, ok := optString(refreshFields, "title"); ok {
+		if banned, err := db.unlistIfBannedTitle(listingId, updateKey, val, ctx); err != nil {
+			return false, err
+		} else if banned {
+			return false, ErrBannedSession
+		}
+		set("title", val)
+	}
+
+	if val, ok := optInt(refreshFields, "users"); ok {
+		set("users", val)
+	}
+
+	if val, ok := optBool(refreshFields, "password"); ok {
+		set("password", val)
+	}
+
+	if val, ok := optBool(refreshFields, "nsfm"); ok {
+		set("nsfm", val)
+	}
+
+	if val, ok := optInt(refreshFields, "maxusers"); ok {
+		set("max_users", val)
+	}
+
+	if val, ok := optBool(refreshFields, "closed"); ok {
+		set("closed", val)
+	}
+
+	if val, ok := optInt(refreshFields, "activedrawingusers"); ok {
+		set("active_drawing_users", val)
+	} else {
+		set("active_drawing_users", -1)
+	}
+
+	if val, ok := optBool(refreshFields, "allowweb"); ok {
+		set("allow_web", val)
+	}
+
+	params = append(params, listingId, updateKey, db.timeoutMinutes)
+	querySql += fmt.Sprintf(`
+		WHERE id = $%d
+		AND update_key = $%d
+		AND COALESCE(unlist_reason, '') = ''
+		AND last_active >= NOW() - make_interval(mins => $%d)
+	`, len(params)-2, len(params)-1, len(params))
+
+	// Only update sessions with changes first, so that the caller knows
+	// whether the listing changed, then the others
+	for _, changed := range []bool{true, false} {
+		stmtSql := querySql
+		if changed {
+			stmtSql += "AND (" + strings.Join(changedSql, " OR ") + ")"
+		}
+
+		// Execute update
+		result, err := db.db.ExecContext(ctx, stmtSql, params...)
+		if err != nil {
+			return false, err
+		}
+
+		// If we actually executed an update, we're done
+		if changes, err := result.RowsAffected(); err != nil {
+			return false, err
+		} else if changes > 0 {
+			return changed, nil
+		}
+	}
+
+	// We didn't update anything, figure out what the error was.
+	var sessionKey string
+	var unlisted bool
+	var unlistReason sql.NullString
+	err := db.db.QueryRowContext(ctx, `
+		SELECT update_key, unlisted, unlist_reason
+		FROM sessions
+		WHERE id = $1
+	`, listingId).Scan(&sessionKey, &unlisted, &unlistReason)
+
+	if err == sql.ErrNoRows {
+		return false, RefreshError{"no such session"}
+	} else if err != nil {
+		return false, err
+	} else if sessionKey != updateKey {
+		return false, RefreshError{"invalid session key"}
+	} else if unlisted {
+		if unlistReason.String == "" {
+			return false, RefreshError{"already unlisted"}
+		} else {
+			return false, RefreshError{unlistReason.String}
+		}
+	} else {
+		return false, RefreshError{"timed out"} // (Probably.)
+	}
+}
+
+// Delete an announcement
+func (db *postgresDb) DeleteSession(listingId int64, updateKey string, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `UPDATE sessions
+	SET unlisted=TRUE
+	WHERE id=$1 AND update_key=$2 AND NOT unlisted`, listingId, updateKey)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminUpdateSessions(ids []int64, unlisted bool, unlistReason string, ctx context.Context) ([]int64, error) {
+	changedIds := []int64{}
+	handledIds := map[int64]bool{}
+	for _, id := range ids {
+		if !handledIds[id] {
+			result, err := db.db.ExecContext(ctx,
+				`UPDATE sessions SET unlisted = $1, unlist_reason = $2, flagged = '' WHERE id = $3`,
+				unlisted, unlistReason, id)
+			if changed, err := postgresChanged(result, err); err != nil {
+				return changedIds, err
+			} else if changed {
+				changedIds = append(changedIds, id)
+			}
+			handledIds[id] = true
+		}
+	}
+	return changedIds, nil
+}
+
+// Approve or reject sessions waiting for approval. Rejected sessions are
+// unlisted with the given reason.
+func (db *postgresDb) AdminReviewSessions(ids []int64, approved bool, rejectReason string, ctx context.Context) ([]int64, error) {
+	changedIds := []int64{}
+	handledIds := map[int64]bool{}
+	for _, id := range ids {
+		if !handledIds[id] {
+			var result sql.Result
+			var err error
+			if approved {
+				result, err = db.db.ExecContext(ctx, `UPDATE sessions SET pending = FALSE
+					WHERE id = $1 AND pending AND NOT unlisted`, id)
+			} else {
+				result, err = db.db.ExecContext(ctx, `UPDATE sessions
+					SET pending = FALSE, unlisted = TRUE, unlist_reason = $1
+					WHERE id = $2 AND pending AND NOT unlisted`, rejectReason, id)
+			}
+			if changed, err := postgresChanged(result, err); err != nil {
+				return changedIds, err
+			} else if changed {
+				changedIds = append(changedIds, id)
+			}
+			handledIds[id] = true
+		}
+	}
+	return changedIds, nil
+}
+
+func (db *postgresDb) AdminQuerySessions(ctx context.Context) ([]AdminSession, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, host, port, session_id, protocol, title, users,
+			password, nsfm, owner,
+			to_char(started AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_active AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			unlisted, update_key, client_ip, COALESCE(unlist_reason, ''), max_users,
+			closed, last_active < NOW() - make_interval(mins => $1) AS timed_out,
+			unlist_reason IS NOT NULL as kicked, active_drawing_users, allow_web,
+			flagged, pending
+		FROM sessions
+		ORDER BY host, id
+	`, db.timeoutMinutes)
+	if err != nil {
+		return []AdminSession{}, err
+	}
+	defer rows.Close()
+
+	sessions := []AdminSession{}
+	for rows.Next() {
+		var unlisted, timedOut, kicked bool
+		var unlistReason string
+		s := AdminSession{Usernames: []string{}}
+		err := rows.Scan(&s.Id, &s.Host, &s.Port, &s.SessionId, &s.Protocol,
+			&s.Title, &s.Users, &s.Password, &s.Nsfm, &s.Owner, &s.Started,
+			&s.LastActive, &unlisted, &s.UpdateKey, &s.ClientIp, &unlistReason,
+			&s.MaxUsers, &s.Closed, &timedOut, &kicked, &s.ActiveDrawingUsers,
+			&s.AllowWeb, &s.Flagged, &s.Pending)
+		if err != nil {
+			return sessions, err
+		}
+
+		if unlisted {
+			if kicked {
+				s.UnlistReason = unlistReason
+			} else {
+				s.UnlistReason = "unlisted by owner"
+			}
+		} else if timedOut {
+			s.UnlistReason = "timed out"
+		}
+		s.Unlisted = unlisted || timedOut
+		s.Kicked = kicked
+		s.TimedOut = timedOut
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (db *postgresDb) AdminQueryArchive(opts ArchiveQueryOptions, ctx context.Context) ([]ArchivedSession, error) {
+	querySql := `
+		SELECT id, listing_id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner,
+			to_char(started AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_active AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			to_char(archived AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			client_ip, unlist_reason, kicked
+		FROM session_archive
+		WHERE TRUE`
+	params := []interface{}{}
+
+	if len(opts.Host) > 0 {
+		params = append(params, opts.Host)
+		querySql += fmt.Sprintf(" AND lower(host)=lower($%d)", len(params))
+	}
+	if len(opts.Owner) > 0 {
+		params = append(params, opts.Owner)
+		querySql += fmt.Sprintf(" AND lower(owner)=lower($%d)", len(params))
+	}
+	if len(opts.Title) > 0 {
+		params = append(params, opts.Title)
+		querySql += fmt.Sprintf(" AND strpos(lower(title), lower($%d)) > 0", len(params))
+	}
+	if len(opts.From) > 0 {
+		params = append(params, opts.From)
+		querySql += fmt.Sprintf(" AND last_active >= CAST($%d AS DATE)::TIMESTAMP AT TIME ZONE 'UTC'", len(params))
+	}
+	if len(opts.To) > 0 {
+		before, err := nextDate(opts.To)
+		if err != nil {
+			return []ArchivedSession{}, err
+		}
+		params = append(params, before)
+		querySql += fmt.Sprintf(" AND started < CAST($%d AS DATE)::TIMESTAMP AT TIME ZONE 'UTC'", len(params))
+	}
+
+	params = append(params, opts.Limit, opts.Offset)
+	querySql += fmt.Sprintf(" ORDER BY last_active DESC, id DESC LIMIT $%d OFFSET $%d", len(params)-1, len(params))
+
+	rows, err := db.db.QueryContext(ctx, querySql, params...)
+	if err != nil {
+		return []ArchivedSession{}, err
+	}
+	defer rows.Close()
+
+	sessions := []ArchivedSession{}
+	for rows.Next() {
+		var s ArchivedSession
+		err := rows.Scan(&s.Id, &s.ListingId, &s.Host, &s.Port, &s.SessionId,
+			&s.Protocol, &s.Title, &s.Users, &s.MaxUsers, &s.Password, &s.Nsfm,
+			&s.Owner, &s.Started, &s.LastActive, &s.Archived, &s.ClientIp,
+			&s.UnlistReason, &s.Kicked)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (db *postgresDb) AdminCreateHostBan(banType string, host string, pattern string, expires string, notes string, ctx context.Context) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO hostbans (host, expires, notes, kind, pattern)
+		VALUES ($1, CAST(NULLIF($2, '') AS DATE)::TIMESTAMP AT TIME ZONE 'UTC', $3, $4, $5)
+		RETURNING id
+	`, host, expires, notes, banType, pattern).Scan(&id)
+	return id, err
+}
+
+func (db *postgresDb) AdminUpdateHostBan(id int64, banType string, host string, pattern string, expires string, notes string, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `
+		UPDATE hostbans SET host = $1,
+			expires = CAST(NULLIF($2, '') AS DATE)::TIMESTAMP AT TIME ZONE 'UTC',
+			notes = $3, kind = $4, pattern = $5
+		WHERE id = $6
+	`, host, expires, notes, banType, pattern, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminDeleteHostBan(id int64, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `DELETE FROM hostbans WHERE id = $1`, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, kind, host, pattern,
+			COALESCE(to_char(expires AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'), ''),
+			expires IS NULL OR expires > NOW() AS active, notes
+		FROM hostbans
+		ORDER BY id DESC
+	`)
+	if err != nil {
+		return []AdminHostBan{}, err
+	}
+	defer rows.Close()
+
+	hostBans := []AdminHostBan{}
+	for rows.Next() {
+		var b AdminHostBan
+		if err := rows.Scan(&b.Id, &b.Type, &b.Host, &b.Pattern, &b.Expires, &b.Active, &b.Notes); err != nil {
+			return hostBans, err
+		}
+		hostBans = append(hostBans, b)
+	}
+
+	return hostBans, rows.Err()
+}
+
+func (db *postgresDb) QuerySessionOverlays(ctx context.Context) ([]SessionOverlay, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, host, port, session_id, unlisted, unlist_reason, nsfm,
+			to_char(updated AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+		FROM session_overlays
+		ORDER BY id DESC
+	`)
+	if err != nil {
+		return []SessionOverlay{}, err
+	}
+	defer rows.Close()
+
+	overlays := []SessionOverlay{}
+	for rows.Next() {
+		var o SessionOverlay
+		err := rows.Scan(&o.Id, &o.Host, &o.Port, &o.SessionId, &o.Unlisted,
+			&o.UnlistReason, &o.Nsfm, &o.Updated)
+		if err != nil {
+			return overlays, err
+		}
+		overlays = append(overlays, o)
+	}
+
+	return overlays, rows.Err()
+}
+
+// Create an overlay or replace the one for the same session
+func (db *postgresDb) AdminPutSessionOverlay(overlay SessionOverlay, ctx context.Context) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO session_overlays
+			(host, port, session_id, unlisted, unlist_reason, nsfm, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (host, port, session_id) DO UPDATE SET
+			unlisted = excluded.unlisted, unlist_reason = excluded.unlist_reason,
+			nsfm = excluded.nsfm, updated = excluded.updated
+		RETURNING id
+	`, strings.ToLower(overlay.Host), overlay.Port, overlay.SessionId,
+		overlay.Unlisted, overlay.UnlistReason, overlay.Nsfm).Scan(&id)
+	return id, err
+}
+
+func (db *postgresDb) AdminDeleteSessionOverlay(id int64, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `DELETE FROM session_overlays WHERE id = $1`, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) FlagSession(listingId int64, reason string, ctx context.Context) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE sessions SET flagged = $1 WHERE id = $2`, reason, listingId)
+	return err
+}
+
+func (db *postgresDb) QueryTitleFilters(ctx context.Context) ([]TitleFilter, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, kind, pattern, action, notes
+		FROM title_filters
+		ORDER BY id
+	`)
+	if err != nil {
+		return []TitleFilter{}, err
+	}
+	defer rows.Close()
+
+	filters := []TitleFilter{}
+	for rows.Next() {
+		var f TitleFilter
+		if err := rows.Scan(&f.Id, &f.Type, &f.Pattern, &f.Action, &f.Notes); err != nil {
+			return filters, err
+		}
+		filters = append(filters, f)
+	}
+
+	return filters, rows.Err()
+}
+
+func (db *postgresDb) AdminCreateTitleFilter(filter TitleFilter, ctx context.Context) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO title_filters (kind, pattern, action, notes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, filter.Type, filter.Pattern, filter.Action, filter.Notes).Scan(&id)
+	return id, err
+}
+
+func (db *postgresDb) AdminUpdateTitleFilter(filter TitleFilter, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `
+		UPDATE title_filters SET kind = $1, pattern = $2, action = $3, notes = $4
+		WHERE id = $5
+	`, filter.Type, filter.Pattern, filter.Action, filter.Notes, filter.Id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminDeleteTitleFilter(id int64, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `DELETE FROM title_filters WHERE id = $1`, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) InsertSessionReport(report SessionReport, ctx context.Context) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO session_reports
+			(host, port, session_id, included, title, owner, category, message,
+			client_ip, reported, resolved_by, resolution)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, date_trunc('second', NOW()), '', '')
+		RETURNING id
+	`, report.Host, report.Port, report.SessionId, report.Included, report.Title,
+		report.Owner, report.Category, report.Message, report.ClientIp).Scan(&id)
+	return id, err
+}
+
+const postgresSessionReportColumns = `id, host, port, session_id, included, title, owner,
+	category, message, client_ip,
+	to_char(reported AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	COALESCE(to_char(resolved AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'), ''),
+	resolved_by, resolution`
+
+func postgresScanSessionReports(rows *sql.Rows) ([]SessionReport, error) {
+	reports := []SessionReport{}
+	for rows.Next() {
+		var r SessionReport
+		err := rows.Scan(&r.Id, &r.Host, &r.Port, &r.SessionId, &r.Included, &r.Title,
+			&r.Owner, &r.Category, &r.Message, &r.ClientIp, &r.Reported, &r.Resolved,
+			&r.ResolvedBy, &r.Resolution)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+func (db *postgresDb) AdminQuerySessionReports(includeResolved bool, ctx context.Context) ([]SessionReport, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT `+postgresSessionReportColumns+`
+		FROM session_reports
+		WHERE $1 OR resolved IS NULL
+		ORDER BY id DESC
+	`, includeResolved)
+	if err != nil {
+		return []SessionReport{}, err
+	}
+	defer rows.Close()
+
+	return postgresScanSessionReports(rows)
+}
+
+// Mark open reports as resolved. Returns the ids of the ones that were open.
+func (db *postgresDb) AdminResolveSessionReports(ids []int64, resolvedBy string, resolution string, ctx context.Context) ([]int64, error) {
+	resolvedIds := []int64{}
+	for _, id := range ids {
+		result, err := db.db.ExecContext(ctx, `
+			UPDATE session_reports
+			SET resolved = date_trunc('second', NOW()), resolved_by = $1, resolution = $2
+			WHERE id = $3 AND resolved IS NULL
+		`, resolvedBy, resolution, id)
+		if changed, err := postgresChanged(result, err); err != nil {
+			return resolvedIds, err
+		} else if changed {
+			resolvedIds = append(resolvedIds, id)
+		}
+	}
+	return resolvedIds, nil
+}
+
+func (db *postgresDb) InsertAuditEntry(entry AuditEntry, ctx context.Context) (int64, error) {
+	targetIds := entry.TargetIds
+	if targetIds == nil {
+		targetIds = []int64{}
+	}
+
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO audit_log
+			(logged, user_id, user_name, action, target_ids, before_values,
+			after_values, client_ip)
+		VALUES (date_trunc('second', NOW()), $1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, entry.UserId, entry.UserName, entry.Action, pq.Array(targetIds),
+		string(entry.Before), string(entry.After), entry.ClientIp).Scan(&id)
+	return id, err
+}
+
+const postgresAuditColumns = `id,
+	to_char(logged AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	user_id, user_name, action, target_ids, before_values, after_values, client_ip`
+
+func postgresScanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var a AuditEntry
+		var before, after string
+		err := rows.Scan(&a.Id, &a.Logged, &a.UserId, &a.UserName, &a.Action,
+			pq.Array(&a.TargetIds), &before, &after, &a.ClientIp)
+		if err != nil {
+			return entries, err
+		}
+		if a.TargetIds == nil {
+			a.TargetIds = []int64{}
+		}
+		if before != "" {
+			a.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			a.After = json.RawMessage(after)
+		}
+		entries = append(entries, a)
+	}
+	return entries, rows.Err()
+}
+
+func (db *postgresDb) AdminQueryAuditLog(opts AuditQueryOptions, ctx context.Context) ([]AuditEntry, error) {
+	querySql := `SELECT ` + postgresAuditColumns + ` FROM audit_log WHERE TRUE`
+	params := []interface{}{}
+
+	if len(opts.User) > 0 {
+		params = append(params, opts.User)
+		querySql += fmt.Sprintf(" AND lower(user_name)=lower($%d)", len(params))
+	}
+	if len(opts.Action) > 0 {
+		params = append(params, opts.Action)
+		querySql += fmt.Sprintf(" AND (action=$%d OR left(action, length($%d) + 1) = $%d || '.')",
+			len(params), len(params), len(params))
+	}
+	if opts.TargetId != 0 {
+		params = append(params, opts.TargetId)
+		querySql += fmt.Sprintf(" AND $%d = ANY(target_ids)", len(params))
+	}
+	if len(opts.From) > 0 {
+		params = append(params, opts.From)
+		querySql += fmt.Sprintf(" AND logged >= CAST($%d AS DATE)::TIMESTAMP AT TIME ZONE 'UTC'", len(params))
+	}
+	if len(opts.To) > 0 {
+		before, err := nextDate(opts.To)
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+		params = append(params, before)
+		querySql += fmt.Sprintf(" AND logged < CAST($%d AS DATE)::TIMESTAMP AT TIME ZONE 'UTC'", len(params))
+	}
+
+	params = append(params, opts.Limit, opts.Offset)
+	querySql += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(params)-1, len(params))
+
+	rows, err := db.db.QueryContext(ctx, querySql, params...)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	defer rows.Close()
+
+	return postgresScanAuditEntries(rows)
+}
+
+func (db *postgresDb) AdminCreateRole(
+	name string, admin bool, accessSessions int64, accessHostbans int64,
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (int64, error) {
+
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO roles (
+			name, admin, access_sessions, access_hostbans, access_roles, access_users,
+			access_backups, access_audit)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, name, admin, accessSessions, accessHostbans, accessRoles, accessUsers,
+		accessBackups, accessAudit).Scan(&id)
+	return id, err
+}
+
+func (db *postgresDb) AdminUpdateRole(
+	id int64, name string, admin bool, accessSessions int64, accessHostbans int64,
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (bool, error) {
+
+	result, err := db.db.ExecContext(ctx, `
+		UPDATE roles SET name = $1, admin = $2,
+			access_sessions = $3, access_hostbans = $4,
+			access_roles = $5, access_users = $6, access_backups = $7,
+			access_audit = $8
+		WHERE id = $9
+	`, name, admin, accessSessions, accessHostbans, accessRoles, accessUsers,
+		accessBackups, accessAudit, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminDeleteRole(id int64, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `DELETE FROM roles WHERE id = $1`, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminQueryRoles(ctx context.Context) ([]AdminRole, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT
+			r.id, r.name, r.admin, r.access_sessions, r.access_hostbans,
+			r.access_roles, r.access_users, r.access_backups, r.access_audit,
+			EXISTS (SELECT 1 FROM users u WHERE u.role = r.id) AS used
+		FROM roles r
+		ORDER BY name
+	`)
+	if err != nil {
+		return []AdminRole{}, err
+	}
+	defer rows.Close()
+
+	roles := []AdminRole{}
+	for rows.Next() {
+		var r AdminRole
+		err := rows.Scan(&r.Id, &r.Name, &r.Admin, &r.AccessSessions,
+			&r.AccessHostBans, &r.AccessRoles, &r.AccessUsers, &r.AccessBackups,
+			&r.AccessAudit, &r.Used)
+		if err != nil {
+			return roles, err
+		}
+		roles = append(roles, r)
+	}
+
+	return roles, rows.Err()
+}
+
+func (db *postgresDb) AdminQueryRoleByName(name string, ctx context.Context) (AdminRole, error) {
+	var r AdminRole
+	err := db.db.QueryRowContext(ctx, `
+		SELECT
+			r.id, r.name, r.admin, r.access_sessions, r.access_hostbans,
+			r.access_roles, r.access_users, r.access_backups, r.access_audit,
+			EXISTS (SELECT 1 FROM users u WHERE u.role = r.id) AS used
+		FROM roles r
+		WHERE r.name = $1
+	`, name).Scan(&r.Id, &r.Name, &r.Admin, &r.AccessSessions,
+		&r.AccessHostBans, &r.AccessRoles, &r.AccessUsers, &r.AccessBackups,
+		&r.AccessAudit, &r.Used)
+
+	if err == sql.ErrNoRows {
+		return AdminRole{}, nil
+	} else if err != nil {
+		return AdminRole{}, err
+	}
+	return r, nil
+}
+
+func (db *postgresDb) AdminCreateUser(name string, passwordHash string, role int64, ctx context.Context) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO users (name, password_hash, role)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, name, passwordHash, role).Scan(&id)
+	return id, err
+}
+
+func (db *postgresDb) AdminUpdateUser(id int64, name string, passwordHash string, role int64, ctx context.Context) (bool, error) {
+	var result sql.Result
+	var err error
+	if passwordHash == "" {
+		result, err = db.db.ExecContext(ctx,
+			`UPDATE users SET name = $1, role = $2 WHERE id = $3`,
+			name, role, id)
+	} else {
+		result, err = db.db.ExecContext(ctx,
+			`UPDATE users SET name = $1, role = $2, password_hash = $3 WHERE id = $4`,
+			name, role, passwordHash, id)
+	}
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminUpdateUserPassword(id int64, passwordHash string, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx,
+		`UPDATE users SET password_hash = $1 WHERE id = $2`, passwordHash, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminDeleteUser(id int64, ctx context.Context) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	return postgresChanged(result, err)
+}
+
+func (db *postgresDb) AdminQueryUserByName(name string, ctx context.Context) (AdminUserDetail, error) {
+	var user AdminUserDetail
+	err := db.db.QueryRowContext(ctx, `
+		SELECT
+			u.id, u.name, r.id, r.name, r.admin, r.access_sessions,
+			r.access_hostbans, r.access_roles, r.access_users, r.access_backups,
+			r.access_audit, u.password_hash
+		FROM users u
+		JOIN roles r ON r.id = u.role
+		WHERE u.name = $1
+	`, name).Scan(&user.Id, &user.Name, &user.Role.Id, &user.Role.Name,
+		&user.Role.Admin, &user.Role.AccessSessions, &user.Role.AccessHostBans,
+		&user.Role.AccessRoles, &user.Role.AccessUsers, &user.Role.AccessBackups,
+		&user.Role.AccessAudit, &user.PasswordHash)
+
+	if err == sql.ErrNoRows {
+		return AdminUserDetail{Id: 0}, nil
+	} else if err != nil {
+		return AdminUserDetail{}, err
+	}
+	return user, nil
+}
+
+func (db *postgresDb) AdminQueryUsers(ctx context.Context) ([]AdminUser, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT u.id, u.name, r.name
+		FROM users u
+		JOIN roles r ON r.id = u.role
+		ORDER BY u.name
+	`)
+	if err != nil {
+		return []AdminUser{}, err
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.Id, &u.Name, &u.Role); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+func (db *postgresDb) Export(ctx context.Context) (ExportData, error) {
+	data := newExportData()
+
+	// Read everything in one transaction to get a consistent snapshot
+	tx, err := db.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return data, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, host, port, session_id, protocol, title, users, max_users,
+			password, nsfm, owner,
+			to_char(started AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_active AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			unlisted, unlist_reason, update_key, client_ip, closed,
+			active_drawing_users, allow_web, flagged, pending
+		FROM sessions ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var s ExportSession
+		err := rows.Scan(&s.Id, &s.Host, &s.Port, &s.SessionId, &s.Protocol,
+			&s.Title, &s.Users, &s.MaxUsers, &s.Password, &s.Nsfm, &s.Owner,
+			&s.Started, &s.LastActive, &s.Unlisted, &s.UnlistReason, &s.UpdateKey,
+			&s.ClientIp, &s.Closed, &s.ActiveDrawingUsers, &s.AllowWeb, &s.Flagged,
+			&s.Pending)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Sessions = append(data.Sessions, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, listing_id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner,
+			to_char(started AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_active AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			to_char(archived AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+			client_ip, unlist_reason, kicked
+		FROM session_archive ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var a ArchivedSession
+		err := rows.Scan(&a.Id, &a.ListingId, &a.Host, &a.Port, &a.SessionId,
+			&a.Protocol, &a.Title, &a.Users, &a.MaxUsers, &a.Password, &a.Nsfm,
+			&a.Owner, &a.Started, &a.LastActive, &a.Archived, &a.ClientIp,
+			&a.UnlistReason, &a.Kicked)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Archive = append(data.Archive, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, kind, host, pattern,
+			COALESCE(to_char(expires AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'), ''),
+			notes
+		FROM hostbans ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var b ExportHostBan
+		if err := rows.Scan(&b.Id, &b.Type, &b.Host, &b.Pattern, &b.Expires, &b.Notes); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.HostBans = append(data.HostBans, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, name, admin, access_sessions, access_hostbans, access_roles,
+			access_users, access_backups, access_audit
+		FROM roles ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var r ExportRole
+		err := rows.Scan(&r.Id, &r.Name, &r.Admin, &r.AccessSessions,
+			&r.AccessHostBans, &r.AccessRoles, &r.AccessUsers, &r.AccessBackups,
+			&r.AccessAudit)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Roles = append(data.Roles, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT id, name, password_hash, role FROM users ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var u ExportUser
+		if err := rows.Scan(&u.Id, &u.Name, &u.PasswordHash, &u.Role); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Users = append(data.Users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, host, port, session_id, unlisted, unlist_reason, nsfm,
+			to_char(updated AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+		FROM session_overlays ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var o SessionOverlay
+		err := rows.Scan(&o.Id, &o.Host, &o.Port, &o.SessionId, &o.Unlisted,
+			&o.UnlistReason, &o.Nsfm, &o.Updated)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Overlays = append(data.Overlays, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT id, kind, pattern, action, notes FROM title_filters ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var f TitleFilter
+		if err := rows.Scan(&f.Id, &f.Type, &f.Pattern, &f.Action, &f.Notes); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Filters = append(data.Filters, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT `+postgresSessionReportColumns+`
+		FROM session_reports ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	data.Reports, err = postgresScanSessionReports(rows)
+	rows.Close()
+	if err != nil {
+		return data, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT `+postgresAuditColumns+`
+		FROM audit_log ORDER BY id`)
+	if err != nil {
+		return data, err
+	}
+	data.Audit, err = postgresScanAuditEntries(rows)
+	rows.Close()
+	if err != nil {
+		return data, err
+	}
+
+	return data, tx.Commit()
+}
+
+// Tables with a serial id, in the order they need to be emptied in
+var postgresImportTables = []string{"audit_log", "session_reports", "title_filters", "session_overlays", "users", "roles", "hostbans", "session_archive", "sessions"}
+
+func (db *postgresDb) Import(data ExportData, replace bool, ctx context.Context) error {
+	if err := data.normalize(); err != nil {
+		return err
+	}
+
+	return postgresTransaction(db.db, func(tx *sql.Tx) error {
+		if replace {
+			for _, table := range postgresImportTables {
+				if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+					return err
+				}
+			}
+		} else {
+			var empty bool
+			err := tx.QueryRowContext(ctx, `SELECT NOT (
+				EXISTS(SELECT 1 FROM sessions) OR EXISTS(SELECT 1 FROM session_archive) OR
+				EXISTS(SELECT 1 FROM hostbans) OR EXISTS(SELECT 1 FROM roles) OR
+				EXISTS(SELECT 1 FROM users) OR EXISTS(SELECT 1 FROM session_overlays) OR
+				EXISTS(SELECT 1 FROM title_filters) OR EXISTS(SELECT 1 FROM session_reports) OR
+				EXISTS(SELECT 1 FROM audit_log))`).Scan(&empty)
+			if err != nil {
+				return err
+			} else if !empty {
+				return ErrDatabaseNotEmpty
+			}
+		}
+
+		for _, s := range data.Sessions {
+			_, err := tx.ExecContext(ctx, `INSERT INTO sessions
+				(id, host, port, session_id, protocol, title, users, usernames, password,
+				nsfm, owner, started, last_active, unlisted, update_key, client_ip,
+				unlist_reason, max_users, closed, active_drawing_users, allow_web, flagged,
+				pending)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, '', $8, $9, $10,
+				$11::TIMESTAMP AT TIME ZONE 'UTC', $12::TIMESTAMP AT TIME ZONE 'UTC',
+				$13, $14, $15, $16, $17, $18, $19, $20, $21, $22)`,
+				s.Id, s.Host, s.Port, s.SessionId, s.Protocol, s.Title, s.Users,
+				s.Password, s.Nsfm, s.Owner, s.Started, s.LastActive, s.Unlisted,
+				s.UpdateKey, s.ClientIp, s.UnlistReason, s.MaxUsers, s.Closed,
+				s.ActiveDrawingUsers, s.AllowWeb, s.Flagged, s.Pending)
+			if err != nil {
+				return fmt.Errorf("Session %d: %s", s.Id, err)
+			}
+		}
+
+		for _, a := range data.Archive {
+			_, err := tx.ExecContext(ctx, `INSERT INTO session_archive
+				(id, listing_id, host, port, session_id, protocol, title, users,
+				max_users, password, nsfm, owner, started, last_active, archived,
+				client_ip, unlist_reason, kicked)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12,
+				$13::TIMESTAMP AT TIME ZONE 'UTC', $14::TIMESTAMP AT TIME ZONE 'UTC',
+				$15::TIMESTAMP AT TIME ZONE 'UTC', $16, $17, $18)`,
+				a.Id, a.ListingId, a.Host, a.Port, a.SessionId, a.Protocol, a.Title,
+				a.Users, a.MaxUsers, a.Password, a.Nsfm, a.Owner, a.Started,
+				a.LastActive, a.Archived, a.ClientIp, a.UnlistReason, a.Kicked)
+			if err != nil {
+				return fmt.Errorf("Archived session %d: %s", a.Id, err)
+			}
+		}
+
+		for _, b := range data.HostBans {
+			_, err := tx.ExecContext(ctx, `INSERT INTO hostbans (id, kind, host, pattern, expires, notes)
+				VALUES ($1, $2, $3, $4, NULLIF($5, '')::TIMESTAMP AT TIME ZONE 'UTC', $6)`,
+				b.Id, b.Type, b.Host, b.Pattern, b.Expires, b.Notes)
+			if err != nil {
+				return fmt.Errorf("Host ban %d: %s", b.Id, err)
+			}
+		}
+
+		for _, r := range data.Roles {
+			_, err := tx.ExecContext(ctx, `INSERT INTO roles
+				(id, name, admin, access_sessions, access_hostbans, access_roles,
+				access_users, access_backups, access_audit)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				r.Id, r.Name, r.Admin, r.AccessSessions, r.AccessHostBans,
+				r.AccessRoles, r.AccessUsers, r.AccessBackups, r.AccessAudit)
+			if err != nil {
+				return fmt.Errorf("Role %d: %s", r.Id, err)
+			}
+		}
+
+		for _, u := range data.Users {
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO users (id, name, password_hash, role) VALUES ($1, $2, $3, $4)`,
+				u.Id, u.Name, u.PasswordHash, u.Role)
+			if err != nil {
+				return fmt.Errorf("User %d: %s", u.Id, err)
+			}
+		}
+
+		for _, o := range data.Overlays {
+			_, err := tx.ExecContext(ctx, `INSERT INTO session_overlays
+				(id, host, port, session_id, unlisted, unlist_reason, nsfm, updated)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8::TIMESTAMP AT TIME ZONE 'UTC')`,
+				o.Id, strings.ToLower(o.Host), o.Port, o.SessionId, o.Unlisted,
+				o.UnlistReason, o.Nsfm, o.Updated)
+			if err != nil {
+				return fmt.Errorf("Session overlay %d: %s", o.Id, err)
+			}
+		}
+
+		for _, f := range data.Filters {
+			_, err := tx.ExecContext(ctx, `INSERT INTO title_filters (id, kind, pattern, action, notes)
+				VALUES ($1, $2, $3, $4, $5)`,
+				f.Id, f.Type, f.Pattern, f.Action, f.Notes)
+			if err != nil {
+				return fmt.Errorf("Title filter %d: %s", f.Id, err)
+			}
+		}
+
+		for _, r := range data.Reports {
+			_, err := tx.ExecContext(ctx, `INSERT INTO session_reports
+				(id, host, port, session_id, included, title, owner, category, message,
+				client_ip, reported, resolved, resolved_by, resolution)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10,
+				$11::TIMESTAMP AT TIME ZONE 'UTC', NULLIF($12, '')::TIMESTAMP AT TIME ZONE 'UTC',
+				$13, $14)`,
+				r.Id, r.Host, r.Port, r.SessionId, r.Included, r.Title, r.Owner,
+				r.Category, r.Message, r.ClientIp, r.Reported, r.Resolved,
+				r.ResolvedBy, r.Resolution)
+			if err != nil {
+				return fmt.Errorf("Session report %d: %s", r.Id, err)
+			}
+		}
+
+		for _, a := range data.Audit {
+			_, err := tx.ExecContext(ctx, `INSERT INTO audit_log
+				(id, logged, user_id, user_name, action, target_ids, before_values,
+				after_values, client_ip)
+				VALUES ($1, $2::TIMESTAMP AT TIME ZONE 'UTC', $3, $4, $5, $6, $7, $8, $9)`,
+				a.Id, a.Logged, a.UserId, a.UserName, a.Action, pq.Array(a.TargetIds),
+				string(a.Before), string(a.After), a.ClientIp)
+			if err != nil {
+				return fmt.Errorf("Audit log entry %d: %s", a.Id, err)
+			}
+		}
+
+		// The ids were inserted explicitly, so the sequences need to catch up
+		for _, table := range postgresImportTables {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s`,
+				table, table))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *postgresDb) Backup(ctx context.Context) (BackupInfo, error) {
+	return BackupInfo{}, ErrBackupNotSupported
+}
+
+func (db *postgresDb) QueryBackups(ctx context.Context) ([]BackupInfo, error) {
+	return nil, ErrBackupNotSupported
+}
+
+func (db *postgresDb) Close() error {
+	db.cleanupTask.stop()
+	return db.db.Close()
+}
+
+func postgresChanged(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	changes, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changes > 0, nil
+}
+
+func postgresRowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
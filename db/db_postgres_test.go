@@ -0,0 +1,333 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// The PostgreSQL tests need a scratch database to run against, given as a
+// postgres:// URL in the LS_TEST_POSTGRES environment variable. All tables in
+// it are dropped before each test!
+func initPostgresDb(t *testing.T) *postgresDb {
+	dbname := os.Getenv("LS_TEST_POSTGRES")
+	if dbname == "" {
+		t.Skip("LS_TEST_POSTGRES not set")
+	}
+
+	sqldb, err := sql.Open("postgres", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqldb.Exec(`DROP TABLE IF EXISTS
+		users, roles, accesslevels, hostbans, sessions, session_archive, session_overlays,
+		title_filters, session_reports, audit_log, migrations CASCADE`)
+	sqldb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := newPostgresDb(dbname, 5, testCleanupSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func insertPostgresTest(t *testing.T, db *postgresDb, title string, id string) NewSessionInfo {
+	ses, err := db.InsertSession(
+		SessionInfo{
+			Host:      "example.com",
+			Port:      27750,
+			Id:        id,
+			Protocol:  "dp:4.21.2",
+			Title:     title,
+			Users:     2,
+			Usernames: []string{"User1", "Other one"},
+			Password:  false,
+			Nsfm:      false,
+			Owner:     "User1",
+			Started:   "",
+		},
+		"192.168.1.1",
+		false,
+		context.TODO(),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ses
+}
+
+func TestPostgresQueryList(t *testing.T) {
+	db := initPostgresDb(t)
+	sessions, err := db.QuerySessionList(QueryOptions{}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatalf("Did not receive zero listings (got %d)", len(sessions))
+	}
+
+	insertPostgresTest(t, db, "Test", "demo1")
+	insertPostgresTest(t, db, "Example", "demo2")
+
+	sessions, err = db.QuerySessionList(QueryOptions{}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("Did not receive 2 listings (got %d)", len(sessions))
+	}
+
+	// Sessions are sorted by title
+	if sessions[0].Title != "Example" || sessions[0].Id != "demo2" {
+		t.Fatal("First item was not Example")
+	}
+	if sessions[1].Title != "Test" {
+		t.Fatal("Second item was not Test")
+	}
+
+	// Filter by title
+	sessions, err = db.QuerySessionList(QueryOptions{Title: "ex"}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Title != "Example" {
+		t.Fatalf("Expected only Example, got %v", sessions)
+	}
+
+	// Filter by protocol
+	sessions, err = db.QuerySessionList(QueryOptions{Protocol: "dp:4.20.1,dp:4.21.2"}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("Did not receive 2 listings (got %d)", len(sessions))
+	}
+}
+
+func TestPostgresQueryFilters(t *testing.T) {
+	testQueryFilters(t, initPostgresDb(t))
+}
+
+func TestPostgresSessionOverlays(t *testing.T) {
+	testSessionOverlays(t, initPostgresDb(t))
+}
+
+func TestPostgresSessionRefreshing(t *testing.T) {
+	db := initPostgresDb(t)
+	ses := insertPostgresTest(t, db, "test", "demo1")
+
+	fields := map[string]interface{}{
+		"title":    "Hello",
+		"users":    10,
+		"password": true,
+		"nsfm":     true,
+	}
+	changed, err := db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("Refresh with new values reported no change")
+	}
+
+	// Refreshing again with the same values only keeps the session alive
+	changed, err = db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Error("Refresh with the same values reported a change")
+	}
+
+	sessions, err := db.QuerySessionList(QueryOptions{Nsfm: true}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatalf("Did not receive 1 listing (got %d)", len(sessions))
+	}
+
+	s := sessions[0]
+	if s.Title != "Hello" || s.Users != 10 || !s.Password || !s.Nsfm {
+		t.Fatalf("Refresh did not apply: %v", s)
+	}
+
+	_, err = db.RefreshSession(map[string]interface{}{}, ses.ListingId, "wrong key", context.TODO())
+	if _, ok := err.(RefreshError); !ok {
+		t.Fatalf("Expected refresh error, got %v", err)
+	}
+}
+
+func TestPostgresExpiredSession(t *testing.T) {
+	db := initPostgresDb(t)
+	ses := insertPostgresTest(t, db, "test", "demo1")
+
+	_, err := db.db.Exec(
+		`UPDATE sessions SET last_active='2000-01-01T00:00:00Z' WHERE id=$1`,
+		ses.ListingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := db.QuerySessionList(QueryOptions{Nsfm: true}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Fatalf("Did not receive 0 listing (got %d)", len(sessions))
+	}
+
+	_, err = db.RefreshSession(map[string]interface{}{}, ses.ListingId, ses.UpdateKey, context.TODO())
+	if _, ok := err.(RefreshError); !ok {
+		t.Fatalf("Expected refresh error, got %v", err)
+	}
+}
+
+func tryPostgresIsBanned(t *testing.T, db *postgresDb, host string, expected bool) {
+	banned, err := db.IsBannedHost(host, nil, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if banned != expected {
+		t.Errorf("%s banned=%t, expected=%t", host, banned, expected)
+	}
+}
+
+func TestPostgresBanList(t *testing.T) {
+	db := initPostgresDb(t)
+
+	_, err := db.db.Exec(`INSERT INTO hostbans (host, expires) VALUES
+		('banned1.com', '3000-01-01T00:00:00Z'),
+		('banned2.com', NULL),
+		('BaNnEd3.cOm', NULL),
+		('expired.com', '2000-01-01T00:00:00Z'),
+		('rebanned.com', '2000-01-01T00:00:00Z'),
+		('rebanned.com', '3000-01-01T00:00:00Z'),
+		('192.0.2.0/24', NULL)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tryPostgresIsBanned(t, db, "banned1.com", true)
+	tryPostgresIsBanned(t, db, "banned2.com", true)
+	tryPostgresIsBanned(t, db, "BANNED2.com", true)
+	tryPostgresIsBanned(t, db, "banned3.com", true)
+	tryPostgresIsBanned(t, db, "rebanned.com", true)
+	tryPostgresIsBanned(t, db, "192.0.2.17", true)
+	tryPostgresIsBanned(t, db, "expired.com", false)
+	tryPostgresIsBanned(t, db, "not-banned.com", false)
+}
+
+func TestPostgresSessionBans(t *testing.T) {
+	testSessionBans(t, initPostgresDb(t))
+}
+
+func TestPostgresTitleFilters(t *testing.T) {
+	testTitleFilters(t, initPostgresDb(t))
+}
+
+func TestPostgresPendingSessions(t *testing.T) {
+	testPendingSessions(t, initPostgresDb(t))
+}
+
+func TestPostgresSessionReports(t *testing.T) {
+	testSessionReports(t, initPostgresDb(t))
+}
+
+func TestPostgresAuditLog(t *testing.T) {
+	testAuditLog(t, initPostgresDb(t))
+}
+
+func TestPostgresRolesAndUsers(t *testing.T) {
+	db := initPostgresDb(t)
+	ctx := context.TODO()
+
+	roleId, err := db.AdminCreateRole("mod", false, 2, 1, 0, 0, 1, 1, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userId, err := db.AdminCreateUser("someone", "hash", roleId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.AdminQueryUserByName("someone", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Id != userId || user.Role.Name != "mod" || user.Role.AccessSessions != 2 || user.PasswordHash != "hash" {
+		t.Fatalf("Unexpected user %v", user)
+	}
+
+	roles, err := db.AdminQueryRoles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || !roles[0].Used {
+		t.Fatalf("Unexpected roles %v", roles)
+	}
+
+	if deleted, err := db.AdminDeleteUser(userId, ctx); err != nil || !deleted {
+		t.Fatalf("User not deleted: %v", err)
+	}
+}
+
+func TestPostgresCleanup(t *testing.T) {
+	db := initPostgresDb(t)
+	ses1 := insertPostgresTest(t, db, "test1", "demo1")
+	ses2 := insertPostgresTest(t, db, "test2", "demo2")
+	insertPostgresTest(t, db, "test3", "demo3")
+
+	db.DeleteSession(ses1.ListingId, ses1.UpdateKey, context.TODO())
+	_, err := db.db.Exec(
+		`UPDATE sessions SET last_active=NOW() - INTERVAL '10 days' WHERE id=$1`,
+		ses2.ListingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := db.Cleanup(context.TODO()); err != nil {
+		t.Fatal(err)
+	} else if result.ArchivedSessions != 2 {
+		t.Errorf("Expected 2 archived sessions, got %d", result.ArchivedSessions)
+	}
+
+	var count int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&count); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("Expected only one row after cleanup, got %d", count)
+	}
+
+	archived, err := db.AdminQueryArchive(ArchiveQueryOptions{Limit: 10}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived) != 2 {
+		t.Fatalf("Expected two archived sessions, got %d", len(archived))
+	}
+
+	if archived[0].ListingId != ses1.ListingId || archived[0].UnlistReason != "unlisted by owner" {
+		t.Errorf("Unexpected first archived session %v", archived[0])
+	}
+
+	if archived[1].ListingId != ses2.ListingId || archived[1].UnlistReason != "timed out" {
+		t.Errorf("Unexpected second archived session %v", archived[1])
+	}
+}
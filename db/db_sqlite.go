@@ -1,10 +1,19 @@
+//go:build cgo
+
 package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"crawshaw.io/sqlite"
@@ -12,19 +21,60 @@ import (
 )
 
 type sqliteDb struct {
-	pool           *sqlitex.Pool
-	timeoutString  string
-	timeoutMinutes int
+	pool            *sqlitex.Pool
+	timeoutString   string
+	timeoutMinutes  int
+	cleanupSettings CleanupSettings
+	cleanupTask     *periodicTask
+	backupSettings  BackupSettings
+	backupTask      *periodicTask
+	backupMutex     sync.Mutex
 }
 
-func sqliteExec(conn *sqlite.Conn, statement string) {
+func sqliteExec(conn *sqlite.Conn, statement string) error {
 	stmt, _, err := conn.PrepareTransient(statement)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	defer stmt.Finalize()
 	_, err = stmt.Step()
-	stmt.Finalize()
+	return err
+}
+
+func sqliteExecAll(conn *sqlite.Conn, statements []string) error {
+	for _, statement := range statements {
+		if err := sqliteExec(conn, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the given function in a transaction, rolling back if it fails
+func sqliteTransaction(conn *sqlite.Conn, f func() error) error {
+	return sqliteBegin(conn, "BEGIN TRANSACTION", f)
+}
+
+// Like sqliteTransaction, but the write lock of the database is taken right
+// away instead of when the transaction first writes
+func sqliteImmediateTransaction(conn *sqlite.Conn, f func() error) error {
+	return sqliteBegin(conn, "BEGIN IMMEDIATE", f)
+}
+
+func sqliteBegin(conn *sqlite.Conn, begin string, f func() error) error {
+	if err := sqliteExec(conn, begin); err != nil {
+		return err
+	}
+
+	if err := f(); err != nil {
+		if rollbackErr := sqliteExec(conn, "ROLLBACK"); rollbackErr != nil {
+			log.Println("Rollback error:", rollbackErr)
+		}
+		return err
+	}
+
+	return sqliteExec(conn, "COMMIT")
 }
 
 // The SQLite library leaves (potentially large) WAL files laying around.
@@ -37,45 +87,32 @@ func sqliteCleanUpWal(ctx context.Context, dbname string) error {
 	return dbpool.Close()
 }
 
-func sqliteTableExists(conn *sqlite.Conn, tableName string) bool {
+func sqliteTableExists(conn *sqlite.Conn, tableName string) (bool, error) {
 	stmt, _, err := conn.PrepareTransient(`
 		SELECT EXISTS (
 			SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?
 		)
 	`)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
 	defer stmt.Finalize()
 	stmt.BindText(1, tableName)
 
 	if hasRow, err := stmt.Step(); err != nil {
-		panic(err)
-	} else {
-		return hasRow && stmt.ColumnInt(0) != 0
-	}
-}
-
-func sqliteMigrationExists(conn *sqlite.Conn, migration int64) bool {
-	stmt, _, err := conn.PrepareTransient(
-		`SELECT EXISTS (SELECT 1 FROM migrations WHERE version = ?)`)
-	if err != nil {
-		panic(err)
-	}
-
-	defer stmt.Finalize()
-	stmt.BindInt64(1, migration)
-
-	if hasRow, err := stmt.Step(); err != nil {
-		panic(err)
+		return false, err
 	} else {
-		return hasRow && stmt.ColumnInt(0) != 0
+		return hasRow && stmt.ColumnInt(0) != 0, nil
 	}
 }
 
-func sqliteCreateSessionsTable(conn *sqlite.Conn) {
-	sqliteExec(conn, `CREATE TABLE sessions (
+// The schema at baselineVersion
+var sqliteBaselineSchema = []string{
+	`CREATE TABLE migrations (
+		version INTEGER PRIMARY KEY NOT NULL
+		)`,
+	`CREATE TABLE sessions (
 		id INTEGER PRIMARY KEY NOT NULL,
 		host TEXT NOT NULL,
 		port INTEGER NOT NULL,
@@ -97,27 +134,20 @@ func sqliteCreateSessionsTable(conn *sqlite.Conn) {
 		closed INTEGER NOT NULL,
 		active_drawing_users INTEGER NOT NULL DEFAULT -1,
 		allow_web INTEGER NOT NULL DEFAULT 0
-		);`)
-}
-
-func sqliteInitDb(conn *sqlite.Conn) {
-	sqliteExec(conn, `CREATE TABLE migrations (
-		version INTEGER PRIMARY KEY NOT NULL
-		);`)
-	sqliteCreateSessionsTable(conn)
-	sqliteExec(conn, `CREATE TABLE hostbans (
+		)`,
+	`CREATE TABLE hostbans (
 		id INTEGER PRIMARY KEY NOT NULL,
 		host TEXT NOT NULL,
 		expires TEXT,
 		notes TEXT NOT NULL DEFAULT ''
-		);`)
-	sqliteExec(conn, `CREATE TABLE accesslevels (
+		)`,
+	`CREATE TABLE accesslevels (
 		id INTEGER PRIMARY KEY NOT NULL,
 		description TEXT NOT NULL
-		);`)
-	sqliteExec(conn, `INSERT INTO accesslevels (id, description) VALUES
-		(0, 'none'), (1, 'view'), (2, 'manage');`)
-	sqliteExec(conn, `CREATE TABLE roles (
+		)`,
+	`INSERT INTO accesslevels (id, description) VALUES
+		(0, 'none'), (1, 'view'), (2, 'manage')`,
+	`CREATE TABLE roles (
 		id INTEGER PRIMARY KEY NOT NULL,
 		name TEXT UNIQUE NOT NULL,
 		admin INTEGER NOT NULL,
@@ -125,49 +155,121 @@ func sqliteInitDb(conn *sqlite.Conn) {
 		access_hostbans INTEGER NOT NULL REFERENCES accesslevels (id),
 		access_roles INTEGER NOT NULL REFERENCES accesslevels (id),
 		access_users INTEGER NOT NULL REFERENCES accesslevels (id)
-		);`)
-	sqliteExec(conn, `CREATE TABLE users (
+		)`,
+	`CREATE TABLE users (
 		id INTEGER PRIMARY KEY NOT NULL,
 		name TEXT UNIQUE NOT NULL,
 		password_hash TEXT NOT NULL,
 		role INTEGER NOT NULL REFERENCES roles (id)
-		);`)
-	sqliteExec(conn, `INSERT INTO migrations (version) VALUES (1), (2), (3), (4);`)
+		)`,
+}
+
+type sqliteMigrator struct {
+	conn *sqlite.Conn
 }
 
-func sqliteMigrateFromLegacyFormat(conn *sqlite.Conn) {
-	sqliteExec(conn, `ALTER TABLE sessions RENAME TO sessions_old;`)
-	sqliteExec(conn, `ALTER TABLE hostbans RENAME TO hostbans_old;`)
-	sqliteInitDb(conn)
-	sqliteExec(conn, `INSERT INTO sessions SELECT
-		rowid, host, port, session_id, protocol, title, users, usernames,
-		password, nsfm, owner, started, last_active, unlisted, update_key,
-		client_ip, NULL, 0, 0, -1, 0 FROM sessions_old;`)
-	sqliteExec(conn, `INSERT INTO hostbans SELECT rowid, * FROM hostbans_old;`)
-	sqliteExec(conn, `DROP TABLE sessions_old;`)
-	sqliteExec(conn, `DROP TABLE hostbans_old;`)
+// SQLite has no lock that outlives a transaction, so that each migration can
+// be committed on its own, the schema is initialized and every migration is
+// applied in an immediate transaction that holds the write lock of the
+// database instead. They check again that no other list server got there
+// first once they have it.
+func (m sqliteMigrator) lock(f func() error) error {
+	return f()
+}
+
+func (m sqliteMigrator) appliedMigrations() (map[int64]bool, error) {
+	if exists, err := sqliteTableExists(m.conn, "migrations"); err != nil || !exists {
+		return nil, err
+	}
+
+	stmt, _, err := m.conn.PrepareTransient(`SELECT version FROM migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+
+	applied := map[int64]bool{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasRow {
+			break
+		}
+		applied[stmt.ColumnInt64(0)] = true
+	}
+	return applied, nil
 }
 
-func sqliteMigrateActiveDrawingUsers(conn *sqlite.Conn) {
-	sqliteExec(conn, `ALTER TABLE sessions ADD active_drawing_users INTEGER NOT NULL DEFAULT -1;`)
-	sqliteExec(conn, `INSERT INTO migrations (version) VALUES (2);`)
+func (m sqliteMigrator) recordMigration(version int64) error {
+	stmt, _, err := m.conn.PrepareTransient(`INSERT INTO migrations (version) VALUES (?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	stmt.BindInt64(1, version)
+	_, err = stmt.Step()
+	return err
 }
 
-func sqliteMigrateAllowWeb(conn *sqlite.Conn) {
-	sqliteExec(conn, `ALTER TABLE sessions ADD allow_web INTEGER NOT NULL DEFAULT 0;`)
-	sqliteExec(conn, `INSERT INTO migrations (version) VALUES (3);`)
+func (m sqliteMigrator) initSchema() error {
+	return sqliteImmediateTransaction(m.conn, func() error {
+		if exists, err := sqliteTableExists(m.conn, "migrations"); err != nil || exists {
+			return err
+		}
+
+		// Databases from before the migrations table was introduced
+		legacy, err := sqliteTableExists(m.conn, "sessions")
+		if err != nil {
+			return err
+		}
+
+		if legacy {
+			log.Println("Converting database from legacy format")
+			err = sqliteExecAll(m.conn, []string{
+				`ALTER TABLE sessions RENAME TO sessions_old`,
+				`ALTER TABLE hostbans RENAME TO hostbans_old`,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := sqliteExecAll(m.conn, sqliteBaselineSchema); err != nil {
+			return err
+		}
+
+		for version := int64(1); version <= baselineVersion; version++ {
+			if err := m.recordMigration(version); err != nil {
+				return err
+			}
+		}
+
+		if legacy {
+			return sqliteExecAll(m.conn, []string{
+				`INSERT INTO sessions SELECT
+					rowid, host, port, session_id, protocol, title, users, usernames,
+					password, nsfm, owner, started, last_active, unlisted, update_key,
+					client_ip, NULL, 0, 0, -1, 0 FROM sessions_old`,
+				`INSERT INTO hostbans SELECT rowid, * FROM hostbans_old`,
+				`DROP TABLE sessions_old`,
+				`DROP TABLE hostbans_old`,
+			})
+		}
+		return nil
+	})
 }
 
-func sqliteMigrateRoomcodeRemoval(conn *sqlite.Conn) {
-	sqliteExec(conn, `ALTER TABLE sessions RENAME TO sessions_old;`)
-	sqliteCreateSessionsTable(conn)
-	sqliteExec(conn, `INSERT INTO sessions SELECT
-		id, host, port, session_id, protocol, title, users, usernames, password,
-		nsfm, owner, started, last_active, unlisted, update_key, client_ip,
-		unlist_reason, max_users, closed, active_drawing_users, allow_web
-		FROM sessions_old;`)
-	sqliteExec(conn, `DROP TABLE sessions_old;`)
-	sqliteExec(conn, `INSERT INTO migrations (version) VALUES (4);`)
+func (m sqliteMigrator) applyMigration(mig *migration) error {
+	return sqliteImmediateTransaction(m.conn, func() error {
+		if applied, err := m.appliedMigrations(); err != nil || applied[mig.version] {
+			return err
+		}
+
+		if err := sqliteExecAll(m.conn, mig.sqlite); err != nil {
+			return err
+		}
+		return m.recordMigration(mig.version)
+	})
 }
 
 func sqliteEnableForeignKeys(dbpool *sqlitex.Pool, poolsize int) error {
@@ -182,14 +284,13 @@ func sqliteEnableForeignKeys(dbpool *sqlitex.Pool, poolsize int) error {
 	return nil
 }
 
-func newSqliteDb(dbname string, sessionTimeout int) (*sqliteDb, error) {
-	ctx := context.Background()
+func sqliteOpen(dbname string) (*sqlitex.Pool, error) {
 	poolsize := 5
 	if dbname == "memory" {
 		dbname = "file:memory:?mode=memory"
 		poolsize = 1 // memory database is not shared between connections
 	} else {
-		sqliteCleanUpWal(ctx, dbname)
+		sqliteCleanUpWal(context.Background(), dbname)
 	}
 
 	dbpool, err := sqlitex.Open(dbname, 0, poolsize)
@@ -199,60 +300,152 @@ func newSqliteDb(dbname string, sessionTimeout int) (*sqliteDb, error) {
 
 	err = sqliteEnableForeignKeys(dbpool, poolsize)
 	if err != nil {
+		dbpool.Close()
 		return nil, fmt.Errorf("Error enabling foreign keys: %s", err.Error())
 	}
 
-	conn := dbpool.Get(ctx)
+	return dbpool, nil
+}
+
+// A read-only migrator doesn't create the database if it doesn't exist
+func withSqliteMigrator(dbname string, readOnly bool, f func(m migrator) error) error {
+	if readOnly {
+		if _, err := os.Stat(dbname); errors.Is(err, os.ErrNotExist) {
+			return ErrNotInitialized
+		}
+
+		conn, err := sqlite.OpenConn(dbname, sqlite.SQLITE_OPEN_READONLY|sqlite.SQLITE_OPEN_NOMUTEX)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return f(sqliteMigrator{conn})
+	}
+
+	dbpool, err := sqliteOpen(dbname)
+	if err != nil {
+		return err
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(context.Background())
 	if conn == nil {
-		return nil, fmt.Errorf("No connection")
+		return fmt.Errorf("No connection")
 	}
 	defer dbpool.Put(conn)
 
-	sqliteExec(conn, "BEGIN TRANSACTION;")
-	if sqliteTableExists(conn, "migrations") {
-		if !sqliteMigrationExists(conn, 2) {
-			log.Println("Applying database migration 2: active drawing users")
-			sqliteMigrateActiveDrawingUsers(conn)
-		}
-		if !sqliteMigrationExists(conn, 3) {
-			log.Println("Applying database migration 3: allow web")
-			sqliteMigrateAllowWeb(conn)
-		}
-		if !sqliteMigrationExists(conn, 4) {
-			log.Println("Applying database migration 4: remove roomcodes")
-			sqliteMigrateRoomcodeRemoval(conn)
-		}
-	} else if sqliteTableExists(conn, "sessions") {
-		log.Println("Applying database migrations")
-		sqliteMigrateFromLegacyFormat(conn) // Pre-migrations table format.
-	} else {
-		log.Println("Initializing database")
-		sqliteInitDb(conn)
+	return f(sqliteMigrator{conn})
+}
+
+func newSqliteDb(dbname string, sessionTimeout int, cleanup CleanupSettings, backup BackupSettings) (*sqliteDb, error) {
+	dbpool, err := sqliteOpen(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := dbpool.Get(context.Background())
+	if conn == nil {
+		dbpool.Close()
+		return nil, fmt.Errorf("No connection")
+	}
+
+	err = migrateSchema(sqliteMigrator{conn})
+	dbpool.Put(conn)
+	if err != nil {
+		dbpool.Close()
+		return nil, err
 	}
-	sqliteExec(conn, "COMMIT;")
 
 	db := &sqliteDb{
-		pool:           dbpool,
-		timeoutString:  fmt.Sprintf("-%d minutes", sessionTimeout),
-		timeoutMinutes: sessionTimeout,
+		pool:            dbpool,
+		timeoutString:   fmt.Sprintf("-%d minutes", sessionTimeout),
+		timeoutMinutes:  sessionTimeout,
+		cleanupSettings: cleanup,
+		backupSettings:  backup,
 	}
 
-	go sqliteCleanupTask(db)
+	db.cleanupTask = startCleanupTask(db, cleanup.Interval)
+	db.backupTask = startBackupTask(db, backup)
 
 	return db, nil
 }
 
-func (db *sqliteDb) cleanup() {
-	conn := db.pool.Get(context.TODO())
-	defer db.pool.Put(conn)
-	sqliteExec(conn, "DELETE FROM sessions WHERE unlisted!=0 OR last_active < DATETIME('now', '-1 day')")
+// Same format as CURRENT_TIMESTAMP
+func sqliteTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
 }
 
-func sqliteCleanupTask(db *sqliteDb) {
-	for {
-		time.Sleep(24 * time.Hour)
-		db.cleanup()
+// Sessions that should be moved to the archive
+const sqliteExpiredSessions = `
+	(unlisted=0 AND last_active < $timedout)
+	OR (unlisted!=0 AND (unlist_reason IS NULL OR last_active < $kicked))`
+
+// Move unlisted and long inactive sessions to the archive and purge
+// archived sessions and expired host bans past their retention period
+func (db *sqliteDb) Cleanup(ctx context.Context) (CleanupResult, error) {
+	var result CleanupResult
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return result, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	// Same cutoffs for both statements, so that nothing gets deleted unarchived
+	cutoffs := db.cleanupSettings.cutoffs(time.Now())
+	err := sqliteTransaction(conn, func() error {
+		stmt := conn.Prep(`
+			INSERT INTO session_archive (
+				listing_id, host, port, session_id, protocol, title, users,
+				max_users, password, nsfm, owner, started, last_active, archived,
+				client_ip, unlist_reason, kicked)
+			SELECT id, host, port, session_id, protocol, title, users,
+				max_users, password, nsfm, owner, started, last_active, CURRENT_TIMESTAMP,
+				client_ip,
+				CASE
+					WHEN unlisted=0 THEN 'timed out'
+					WHEN unlist_reason IS NULL THEN 'unlisted by owner'
+					ELSE unlist_reason
+				END,
+				unlisted!=0 AND unlist_reason IS NOT NULL
+			FROM sessions
+			WHERE ` + sqliteExpiredSessions)
+		stmt.SetText("$timedout", sqliteTimestamp(cutoffs.timedOut))
+		stmt.SetText("$kicked", sqliteTimestamp(cutoffs.kicked))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		result.ArchivedSessions = int64(conn.Changes())
+
+		stmt = conn.Prep(`DELETE FROM sessions WHERE ` + sqliteExpiredSessions)
+		stmt.SetText("$timedout", sqliteTimestamp(cutoffs.timedOut))
+		stmt.SetText("$kicked", sqliteTimestamp(cutoffs.kicked))
+		_, err := stmt.Step()
+		return err
+	})
+	if err != nil {
+		return result, err
 	}
+
+	if !cutoffs.archive.IsZero() {
+		stmt := conn.Prep(`DELETE FROM session_archive WHERE archived < $cutoff`)
+		stmt.SetText("$cutoff", sqliteTimestamp(cutoffs.archive))
+		if _, err := stmt.Step(); err != nil {
+			return result, err
+		}
+		result.PurgedArchive = int64(conn.Changes())
+	}
+
+	if !cutoffs.hostBan.IsZero() {
+		stmt := conn.Prep(`DELETE FROM hostbans WHERE expires < $cutoff`)
+		stmt.SetText("$cutoff", sqliteTimestamp(cutoffs.hostBan))
+		if _, err := stmt.Step(); err != nil {
+			return result, err
+		}
+		result.PurgedHostBans = int64(conn.Changes())
+	}
+
+	return result, nil
 }
 
 func (db *sqliteDb) SessionTimeoutMinutes() int {
@@ -265,7 +458,7 @@ func (db *sqliteDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]
 	SELECT host, port, session_id, protocol, title, users, password, nsfm, owner,
 	started, max_users, closed, active_drawing_users, allow_web
 	FROM sessions
-	WHERE last_active >= DATETIME('now', $timeout) AND unlisted=false`
+	WHERE last_active >= DATETIME('now', $timeout) AND unlisted=false AND pending=false`
 
 	if len(opts.Title) > 0 {
 		querySql += " AND title LIKE '%' || $title || '%'"
@@ -275,6 +468,38 @@ func (db *sqliteDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]
 		querySql += " AND nsfm=0"
 	}
 
+	if opts.NoPassword {
+		querySql += " AND password=0"
+	}
+
+	if opts.NoClosed {
+		querySql += " AND closed=0"
+	}
+
+	if opts.NoFull {
+		querySql += " AND (max_users<=0 OR users<max_users)"
+	}
+
+	if opts.WebOnly {
+		querySql += " AND allow_web!=0"
+	}
+
+	if opts.MinUsers > 0 {
+		querySql += " AND users>=$minusers"
+	}
+
+	if opts.MaxUsers > 0 {
+		querySql += " AND users<=$maxusers"
+	}
+
+	if len(opts.Owner) > 0 {
+		querySql += " AND owner=$owner COLLATE NOCASE"
+	}
+
+	if len(opts.Host) > 0 {
+		querySql += " AND host=$host COLLATE NOCASE"
+	}
+
 	var protocols []string
 
 	if len(opts.Protocol) > 0 {
@@ -286,8 +511,6 @@ func (db *sqliteDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]
 		querySql += ` AND protocol IN (` + strings.Join(placeholders, ",") + `)`
 	}
 
-	querySql += ` ORDER BY title, users ASC`
-
 	conn := db.pool.Get(ctx)
 	if conn == nil {
 		return []SessionInfo{}, fmt.Errorf("Connection not available")
@@ -302,6 +525,22 @@ func (db *sqliteDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]
 		stmt.SetText("$title", opts.Title)
 	}
 
+	if opts.MinUsers > 0 {
+		stmt.SetInt64("$minusers", int64(opts.MinUsers))
+	}
+
+	if opts.MaxUsers > 0 {
+		stmt.SetInt64("$maxusers", int64(opts.MaxUsers))
+	}
+
+	if len(opts.Owner) > 0 {
+		stmt.SetText("$owner", opts.Owner)
+	}
+
+	if len(opts.Host) > 0 {
+		stmt.SetText("$host", opts.Host)
+	}
+
 	if len(protocols) > 0 {
 		for i, v := range protocols {
 			stmt.SetText(fmt.Sprintf("$proto%d", i), v)
@@ -335,6 +574,9 @@ func (db *sqliteDb) QuerySessionList(opts QueryOptions, ctx context.Context) ([]
 		})
 	}
 
+	// Sorted here rather than in SQL, so that the order is exactly the same
+	// as when the list is merged with included sessions
+	SortSessionList(sessions, opts)
 	return sessions, nil
 }
 
@@ -394,36 +636,110 @@ func (db *sqliteDb) GetHostSessionCount(host string, ctx context.Context) (int,
 	return count, nil
 }
 
-// Check if the given host is on the ban list
-func (db *sqliteDb) IsBannedHost(host string, ctx context.Context) (bool, error) {
+// Check if the given host or any of the addresses is on the ban list
+func (db *sqliteDb) IsBannedHost(host string, addrs []net.IP, ctx context.Context) (bool, error) {
 	conn := db.pool.Get(ctx)
 	if conn == nil {
 		return false, fmt.Errorf("Connection not available")
 	}
 	defer db.pool.Put(conn)
 
-	stmt := conn.Prep(`SELECT EXISTS(SELECT 1
+	// Ranges and wildcards are matched here rather than in SQL
+	stmt := conn.Prep(`SELECT host
 	FROM hostbans
-	WHERE host=$host COLLATE NOCASE AND (expires IS NULL OR expires > DATETIME('now'))
-	)`)
+	WHERE kind = 'host' AND (expires IS NULL OR expires > DATETIME('now'))
+	`)
 	defer stmt.Reset()
 
-	stmt.SetText("$host", host)
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return false, err
+		} else if !hasRow {
+			break
+		}
 
-	if hasRow, err := stmt.Step(); err != nil {
+		if HostBanMatches(stmt.GetText("host"), host, addrs) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Check if the session matches any of the bans that aren't host bans
+func (db *sqliteDb) IsBannedSession(session SessionInfo, ctx context.Context) (bool, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return false, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	return sqliteIsBannedSession(conn, &session)
+}
+
+func sqliteIsBannedSession(conn *sqlite.Conn, session *SessionInfo) (bool, error) {
+	stmt := conn.Prep(`SELECT kind, host, pattern
+	FROM hostbans
+	WHERE kind != 'host' AND (expires IS NULL OR expires > DATETIME('now'))
+	`)
+	defer stmt.Reset()
+
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return false, err
+		} else if !hasRow {
+			break
+		}
+
+		if SessionBanMatches(stmt.GetText("kind"), stmt.GetText("host"), stmt.GetText("pattern"), session) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Unlist the session if changing its title makes it match a ban. Returns
+// false if it doesn't or if the session can't be refreshed anyway.
+func sqliteUnlistIfBannedTitle(conn *sqlite.Conn, listingId int64, updateKey string, title string) (bool, error) {
+	stmt := conn.Prep(`
+		SELECT host, session_id, owner
+		FROM sessions
+		WHERE id = $id AND update_key = $updateKey AND COALESCE(unlist_reason, '') = ''
+	`)
+	stmt.SetInt64("$id", listingId)
+	stmt.SetText("$updateKey", updateKey)
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		stmt.Reset()
+		return false, err
+	}
+	session := SessionInfo{
+		Host:  stmt.GetText("host"),
+		Id:    stmt.GetText("session_id"),
+		Owner: stmt.GetText("owner"),
+		Title: title,
+	}
+	stmt.Reset()
+
+	if banned, err := sqliteIsBannedSession(conn, &session); err != nil || !banned {
 		return false, err
-	} else if !hasRow {
-		return false, fmt.Errorf("No row returned")
 	}
 
-	isBanned := stmt.ColumnInt(0) != 0
-	return isBanned, nil
+	stmt = conn.Prep(`UPDATE sessions SET unlisted = 1, unlist_reason = $reason WHERE id = $id`)
+	stmt.SetText("$reason", BannedSessionReason)
+	stmt.SetInt64("$id", listingId)
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Insert a new session to the database
 // Note: this function does not validate the data;
 // that must be done before calling this
-func (db *sqliteDb) InsertSession(session SessionInfo, clientIp string, ctx context.Context) (NewSessionInfo, error) {
+func (db *sqliteDb) InsertSession(session SessionInfo, clientIp string, pending bool, ctx context.Context) (NewSessionInfo, error) {
 	var updateKey string
 	updateKey, err := generateUpdateKey()
 	if err != nil {
@@ -439,9 +755,9 @@ func (db *sqliteDb) InsertSession(session SessionInfo, clientIp string, ctx cont
 	stmt := conn.Prep(`INSERT INTO sessions
 	(host, port, session_id, protocol, title, users, usernames, password, nsfm,
 	owner, started, last_active, unlisted, update_key, client_ip, max_users,
-	closed, active_drawing_users, allow_web)
+	closed, active_drawing_users, allow_web, pending)
 	VALUES (?, ?, ?, ?, ?, ?, '', ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
-	CURRENT_TIMESTAMP, 0, ?, ?, ?, ?, ?, ?)
+	CURRENT_TIMESTAMP, 0, ?, ?, ?, ?, ?, ?, ?)
 	`)
 
 	i := sqlite.BindIncrementor()
@@ -460,6 +776,7 @@ func (db *sqliteDb) InsertSession(session SessionInfo, clientIp string, ctx cont
 	stmt.BindBool(i(), session.Closed)
 	stmt.BindInt64(i(), int64(session.ActiveDrawingUsers))
 	stmt.BindBool(i(), session.AllowWeb)
+	stmt.BindBool(i(), pending)
 
 	if _, err := stmt.Step(); err != nil {
 		return NewSessionInfo{}, err
@@ -471,96 +788,108 @@ func (db *sqliteDb) InsertSession(session SessionInfo, clientIp string, ctx cont
 	}, nil
 }
 
-// Refresh an announcement
-func (db *sqliteDb) RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) error {
+// Refresh an announcement. Returns whether any of the listed fields changed.
+func (db *sqliteDb) RefreshSession(refreshFields map[string]interface{}, listingId int64, updateKey string, ctx context.Context) (bool, error) {
 	conn := db.pool.Get(ctx)
 	if conn == nil {
-		return fmt.Errorf("Connection not available")
+		return false, fmt.Errorf("Connection not available")
 	}
 	defer db.pool.Put(conn)
 
-	// Construct update query
+	// Construct update query, along with a condition that's true if any of
+	// the set columns changes
 	querySql := "UPDATE sessions SET last_active=CURRENT_TIMESTAMP"
+	changedSql := []string{}
 	params := []interface{}{}
 
+	set := func(column string, value interface{}) {
+		params = append(params, value)
+		querySql += fmt.Sprintf(", %s=?%d", column, len(params))
+		changedSql = append(changedSql, fmt.Sprintf("%s IS NOT ?%d", column, len(params)))
+	}
+
 	if val, ok := optString(refreshFields, "title"); ok {
-		querySql += ", title=?"
-		params = append(params, val)
+		if banned, err := sqliteUnlistIfBannedTitle(conn, listingId, updateKey, val); err != nil {
+			return false, err
+		} else if banned {
+			return false, ErrBannedSession
+		}
+		set("title", val)
 	}
 
 	if val, ok := optInt(refreshFields, "users"); ok {
-		querySql += ", users=?"
-		params = append(params, val)
+		set("users", val)
 	}
 
 	if val, ok := optBool(refreshFields, "password"); ok {
-		querySql += ", password=?"
-		params = append(params, val)
+		set("password", val)
 	}
 
 	if val, ok := optBool(refreshFields, "nsfm"); ok {
-		querySql += ", nsfm=?"
-		params = append(params, val)
+		set("nsfm", val)
 	}
 
 	if val, ok := optInt(refreshFields, "maxusers"); ok {
-		querySql += ", max_users=?"
-		params = append(params, val)
+		set("max_users", val)
 	}
 
 	if val, ok := optBool(refreshFields, "closed"); ok {
-		querySql += ", closed=?"
-		params = append(params, val)
+		set("closed", val)
 	}
 
-	var activeDrawingUsers int
 	if val, ok := optInt(refreshFields, "activedrawingusers"); ok {
-		activeDrawingUsers = val
+		set("active_drawing_users", val)
 	} else {
-		activeDrawingUsers = -1
+		set("active_drawing_users", -1)
 	}
-	querySql += ", active_drawing_users=?"
-	params = append(params, activeDrawingUsers)
 
 	if val, ok := optBool(refreshFields, "allowweb"); ok {
-		querySql += ", allow_web=?"
-		params = append(params, val)
+		set("allow_web", val)
 	}
 
-	querySql += `
-		WHERE id = ?
-		AND update_key = ?
-		AND COALESCE(unlist_reason, '') = ''
-		AND last_active >= DATETIME('now', ?)
-	`
 	params = append(params, listingId, updateKey, db.timeoutString)
+	querySql += fmt.Sprintf(`
+		WHERE id = ?%d
+		AND update_key = ?%d
+		AND COALESCE(unlist_reason, '') = ''
+		AND last_active >= DATETIME('now', ?%d)
+	`, len(params)-2, len(params)-1, len(params))
+
+	// Only update sessions with changes first, so that the caller knows
+	// whether the listing changed, then the others
+	for _, changed := range []bool{true, false} {
+		stmtSql := querySql
+		if changed {
+			stmtSql += "AND (" + strings.Join(changedSql, " OR ") + ")"
+		}
 
-	updateStmt := conn.Prep(querySql)
-	defer updateStmt.Reset()
-	for i, v := range params {
-		switch val := v.(type) {
-		case string:
-			updateStmt.BindText(i+1, val)
-		case int:
-			updateStmt.BindInt64(i+1, int64(val))
-		case int64:
-			updateStmt.BindInt64(i+1, val)
-		case bool:
-			updateStmt.BindBool(i+1, val)
-		default:
-			panic("Unhandled type")
-		}
-	}
-
-	// Execute update
-	_, err := updateStmt.Step()
-	if err != nil {
-		return err
-	}
+		updateStmt := conn.Prep(stmtSql)
+		for i, v := range params {
+			switch val := v.(type) {
+			case string:
+				updateStmt.BindText(i+1, val)
+			case int:
+				updateStmt.BindInt64(i+1, int64(val))
+			case int64:
+				updateStmt.BindInt64(i+1, val)
+			case bool:
+				updateStmt.BindBool(i+1, val)
+			default:
+				panic("Unhandled type")
+			}
+		}
 
-	// If we actually executed an update, we're done
-	if conn.Changes() > 0 {
-		return nil
+		// Execute update
+		_, err := updateStmt.Step()
+		updateStmt.Reset()
+		if err != nil {
+			return false, err
+		}
+
+		// If we actually executed an update, we're done
+		if conn.Changes() > 0 {
+			return changed, nil
+		}
 	}
 
 	// We didn't update anything, figure out what the error was.
@@ -574,20 +903,20 @@ func (db *sqliteDb) RefreshSession(refreshFields map[string]interface{}, listing
 	selectStmt.SetInt64("$id", listingId)
 
 	if hasRow, err := selectStmt.Step(); err != nil {
-		return err
+		return false, err
 	} else if !hasRow {
-		return RefreshError{"no such session"}
+		return false, RefreshError{"no such session"}
 	} else if selectStmt.GetText("update_key") != updateKey {
-		return RefreshError{"invalid session key"}
+		return false, RefreshError{"invalid session key"}
 	} else if selectStmt.GetInt64("unlisted") != 0 {
 		reason := selectStmt.GetText("unlist_reason")
 		if reason == "" {
-			return RefreshError{"already unlisted"}
+			return false, RefreshError{"already unlisted"}
 		} else {
-			return RefreshError{reason}
+			return false, RefreshError{reason}
 		}
 	} else {
-		return RefreshError{"timed out"} // (Probably.)
+		return false, RefreshError{"timed out"} // (Probably.)
 	}
 }
 
@@ -621,11 +950,11 @@ func (db *sqliteDb) AdminUpdateSessions(ids []int64, unlisted bool, unlistReason
 	defer db.pool.Put(conn)
 
 	var stmt *sqlite.Stmt
-	stmt = conn.Prep(`UPDATE sessions SET unlisted = $unlisted, unlist_reason = $reason WHERE id = $id`)
+	stmt = conn.Prep(`UPDATE sessions SET unlisted = $unlisted, unlist_reason = $reason, flagged = '' WHERE id = $id`)
 	stmt.SetBool("$unlisted", unlisted)
 	stmt.SetText("$reason", unlistReason)
 
-	changedIds := make([]int64, len(ids))
+	changedIds := []int64{}
 	handledIds := map[int64]bool{}
 	for _, id := range ids {
 		if !handledIds[id] {
@@ -642,31 +971,68 @@ func (db *sqliteDb) AdminUpdateSessions(ids []int64, unlisted bool, unlistReason
 	return changedIds, nil
 }
 
-func (db *sqliteDb) AdminQuerySessions(ctx context.Context) ([]AdminSession, error) {
+// Approve or reject sessions waiting for approval. Rejected sessions are
+// unlisted with the given reason.
+func (db *sqliteDb) AdminReviewSessions(ids []int64, approved bool, rejectReason string, ctx context.Context) ([]int64, error) {
 	conn := db.pool.Get(ctx)
 	if conn == nil {
-		return []AdminSession{}, fmt.Errorf("Connection not available")
+		return []int64{}, fmt.Errorf("Connection not available")
 	}
 	defer db.pool.Put(conn)
 
-	stmt := conn.Prep(`
-		SELECT id, host, port, session_id, protocol, title, users,
-			password, nsfm, owner, started, last_active, unlisted, update_key,
-			client_ip, unlist_reason, max_users, closed,
-			last_active < DATETIME('now', $timeout) AS timed_out,
-			unlist_reason IS NOT NULL as kicked, active_drawing_users, allow_web
-		FROM sessions
-		ORDER BY host, id
-	`)
-	stmt.SetText("$timeout", db.timeoutString)
-
-	sessions := []AdminSession{}
-	for {
-		if hasRow, err := stmt.Step(); err != nil {
-			return sessions, err
-		} else if !hasRow {
-			break
-		}
+	var stmt *sqlite.Stmt
+	if approved {
+		stmt = conn.Prep(`UPDATE sessions SET pending = 0
+			WHERE id = $id AND pending != 0 AND unlisted = 0`)
+	} else {
+		stmt = conn.Prep(`UPDATE sessions SET pending = 0, unlisted = 1, unlist_reason = $reason
+			WHERE id = $id AND pending != 0 AND unlisted = 0`)
+		stmt.SetText("$reason", rejectReason)
+	}
+
+	changedIds := []int64{}
+	handledIds := map[int64]bool{}
+	for _, id := range ids {
+		if !handledIds[id] {
+			stmt.Reset()
+			stmt.SetInt64("$id", id)
+			if _, err := stmt.Step(); err != nil {
+				return changedIds, err
+			} else if conn.Changes() > 0 {
+				changedIds = append(changedIds, id)
+			}
+			handledIds[id] = true
+		}
+	}
+	return changedIds, nil
+}
+
+func (db *sqliteDb) AdminQuerySessions(ctx context.Context) ([]AdminSession, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []AdminSession{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		SELECT id, host, port, session_id, protocol, title, users,
+			password, nsfm, owner, started, last_active, unlisted, update_key,
+			client_ip, unlist_reason, max_users, closed,
+			last_active < DATETIME('now', $timeout) AS timed_out,
+			unlist_reason IS NOT NULL as kicked, active_drawing_users, allow_web,
+			flagged, pending
+		FROM sessions
+		ORDER BY host, id
+	`)
+	stmt.SetText("$timeout", db.timeoutString)
+
+	sessions := []AdminSession{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return sessions, err
+		} else if !hasRow {
+			break
+		}
 
 		unlisted := stmt.GetInt64("unlisted") != 0
 		timedOut := stmt.GetInt64("timed_out") != 0
@@ -706,13 +1072,106 @@ func (db *sqliteDb) AdminQuerySessions(ctx context.Context) ([]AdminSession, err
 			TimedOut:           timedOut,
 			ActiveDrawingUsers: int(stmt.GetInt64("active_drawing_users")),
 			AllowWeb:           stmt.GetInt64("allow_web") != 0,
+			Flagged:            stmt.GetText("flagged"),
+			Pending:            stmt.GetInt64("pending") != 0,
+		})
+	}
+
+	return sessions, nil
+}
+
+func (db *sqliteDb) AdminQueryArchive(opts ArchiveQueryOptions, ctx context.Context) ([]ArchivedSession, error) {
+	querySql := `
+		SELECT id, listing_id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner, started, last_active, archived,
+			client_ip, unlist_reason, kicked
+		FROM session_archive
+		WHERE 1=1`
+
+	if len(opts.Host) > 0 {
+		querySql += " AND host=$host COLLATE NOCASE"
+	}
+	if len(opts.Owner) > 0 {
+		querySql += " AND owner=$owner COLLATE NOCASE"
+	}
+	if len(opts.Title) > 0 {
+		querySql += " AND title LIKE '%' || $title || '%'"
+	}
+	if len(opts.From) > 0 {
+		querySql += " AND last_active >= $from"
+	}
+
+	var before string
+	if len(opts.To) > 0 {
+		var err error
+		if before, err = nextDate(opts.To); err != nil {
+			return []ArchivedSession{}, err
+		}
+		querySql += " AND started < $before"
+	}
+
+	querySql += " ORDER BY last_active DESC, id DESC LIMIT $limit OFFSET $offset"
+
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []ArchivedSession{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(querySql)
+
+	if len(opts.Host) > 0 {
+		stmt.SetText("$host", opts.Host)
+	}
+	if len(opts.Owner) > 0 {
+		stmt.SetText("$owner", opts.Owner)
+	}
+	if len(opts.Title) > 0 {
+		stmt.SetText("$title", opts.Title)
+	}
+	if len(opts.From) > 0 {
+		stmt.SetText("$from", opts.From)
+	}
+	if len(before) > 0 {
+		stmt.SetText("$before", before)
+	}
+	stmt.SetInt64("$limit", int64(opts.Limit))
+	stmt.SetInt64("$offset", int64(opts.Offset))
+
+	sessions := []ArchivedSession{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return sessions, err
+		} else if !hasRow {
+			break
+		}
+
+		sessions = append(sessions, ArchivedSession{
+			Id:           stmt.GetInt64("id"),
+			ListingId:    stmt.GetInt64("listing_id"),
+			Host:         stmt.GetText("host"),
+			Port:         int(stmt.GetInt64("port")),
+			SessionId:    stmt.GetText("session_id"),
+			Protocol:     stmt.GetText("protocol"),
+			Title:        stmt.GetText("title"),
+			Users:        int(stmt.GetInt64("users")),
+			MaxUsers:     int(stmt.GetInt64("max_users")),
+			Password:     stmt.GetInt64("password") != 0,
+			Nsfm:         stmt.GetInt64("nsfm") != 0,
+			Owner:        stmt.GetText("owner"),
+			Started:      stmt.GetText("started"),
+			LastActive:   stmt.GetText("last_active"),
+			Archived:     stmt.GetText("archived"),
+			ClientIp:     stmt.GetText("client_ip"),
+			UnlistReason: stmt.GetText("unlist_reason"),
+			Kicked:       stmt.GetInt64("kicked") != 0,
 		})
 	}
 
 	return sessions, nil
 }
 
-func (db *sqliteDb) AdminCreateHostBan(host string, expires string, notes string, ctx context.Context) (int64, error) {
+func (db *sqliteDb) AdminCreateHostBan(banType string, host string, pattern string, expires string, notes string, ctx context.Context) (int64, error) {
 	conn := db.pool.Get(ctx)
 	if conn == nil {
 		return 0, fmt.Errorf("Connection not available")
@@ -721,12 +1180,16 @@ func (db *sqliteDb) AdminCreateHostBan(host string, expires string, notes string
 
 	var stmt *sqlite.Stmt
 	if expires == "" {
-		stmt = conn.Prep(`INSERT INTO hostbans (host, expires, notes) VALUES ($host, NULL, $notes)`)
+		stmt = conn.Prep(`INSERT INTO hostbans (kind, host, pattern, expires, notes)
+			VALUES ($kind, $host, $pattern, NULL, $notes)`)
 	} else {
-		stmt = conn.Prep(`INSERT INTO hostbans (host, expires, notes) VALUES ($host, DATETIME($expires), $notes)`)
+		stmt = conn.Prep(`INSERT INTO hostbans (kind, host, pattern, expires, notes)
+			VALUES ($kind, $host, $pattern, DATETIME($expires), $notes)`)
 		stmt.SetText("$expires", expires)
 	}
+	stmt.SetText("$kind", banType)
 	stmt.SetText("$host", host)
+	stmt.SetText("$pattern", pattern)
 	stmt.SetText("$notes", notes)
 
 	if _, err := stmt.Step(); err != nil {
@@ -736,7 +1199,7 @@ func (db *sqliteDb) AdminCreateHostBan(host string, expires string, notes string
 	}
 }
 
-func (db *sqliteDb) AdminUpdateHostBan(id int64, host string, expires string, notes string, ctx context.Context) (bool, error) {
+func (db *sqliteDb) AdminUpdateHostBan(id int64, banType string, host string, pattern string, expires string, notes string, ctx context.Context) (bool, error) {
 	conn := db.pool.Get(ctx)
 	if conn == nil {
 		return false, fmt.Errorf("Connection not available")
@@ -745,12 +1208,16 @@ func (db *sqliteDb) AdminUpdateHostBan(id int64, host string, expires string, no
 
 	var stmt *sqlite.Stmt
 	if expires == "" {
-		stmt = conn.Prep(`UPDATE hostbans SET host = $host, expires = NULL, notes = $notes WHERE id = $id`)
+		stmt = conn.Prep(`UPDATE hostbans SET kind = $kind, host = $host, pattern = $pattern,
+			expires = NULL, notes = $notes WHERE id = $id`)
 	} else {
-		stmt = conn.Prep(`UPDATE hostbans SET host = $host, expires = $expires, notes = $notes WHERE id = $id`)
+		stmt = conn.Prep(`UPDATE hostbans SET kind = $kind, host = $host, pattern = $pattern,
+			expires = $expires, notes = $notes WHERE id = $id`)
 		stmt.SetText("$expires", expires)
 	}
+	stmt.SetText("$kind", banType)
 	stmt.SetText("$host", host)
+	stmt.SetText("$pattern", pattern)
 	stmt.SetText("$notes", notes)
 	stmt.SetInt64("$id", id)
 
@@ -786,7 +1253,8 @@ func (db *sqliteDb) AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, err
 	defer db.pool.Put(conn)
 
 	stmt := conn.Prep(`
-		SELECT id, host, expires, expires IS NULL OR expires > DATETIME('now') AS active, notes
+		SELECT id, kind, host, pattern, expires,
+			expires IS NULL OR expires > DATETIME('now') AS active, notes
 		FROM hostbans
 		ORDER BY id DESC
 	`)
@@ -801,7 +1269,9 @@ func (db *sqliteDb) AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, err
 
 		hostBans = append(hostBans, AdminHostBan{
 			Id:      stmt.GetInt64("id"),
+			Type:    stmt.GetText("kind"),
 			Host:    stmt.GetText("host"),
+			Pattern: stmt.GetText("pattern"),
 			Expires: stmt.GetText("expires"),
 			Active:  stmt.GetInt64("active") != 0,
 			Notes:   stmt.GetText("notes"),
@@ -811,9 +1281,442 @@ func (db *sqliteDb) AdminQueryHostBans(ctx context.Context) ([]AdminHostBan, err
 	return hostBans, nil
 }
 
+func (db *sqliteDb) QuerySessionOverlays(ctx context.Context) ([]SessionOverlay, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []SessionOverlay{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		SELECT id, host, port, session_id, unlisted, unlist_reason, nsfm, updated
+		FROM session_overlays
+		ORDER BY id DESC
+	`)
+
+	overlays := []SessionOverlay{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return overlays, err
+		} else if !hasRow {
+			break
+		}
+
+		overlays = append(overlays, SessionOverlay{
+			Id:           stmt.GetInt64("id"),
+			Host:         stmt.GetText("host"),
+			Port:         int(stmt.GetInt64("port")),
+			SessionId:    stmt.GetText("session_id"),
+			Unlisted:     stmt.GetInt64("unlisted") != 0,
+			UnlistReason: stmt.GetText("unlist_reason"),
+			Nsfm:         stmt.GetInt64("nsfm") != 0,
+			Updated:      stmt.GetText("updated"),
+		})
+	}
+
+	return overlays, nil
+}
+
+// Create an overlay or replace the one for the same session
+func (db *sqliteDb) AdminPutSessionOverlay(overlay SessionOverlay, ctx context.Context) (int64, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	var id int64
+	err := sqliteTransaction(conn, func() error {
+		stmt := conn.Prep(`
+			INSERT INTO session_overlays
+				(host, port, session_id, unlisted, unlist_reason, nsfm, updated)
+			VALUES ($host, $port, $sessionId, $unlisted, $reason, $nsfm, CURRENT_TIMESTAMP)
+			ON CONFLICT (host, port, session_id) DO UPDATE SET
+				unlisted = excluded.unlisted, unlist_reason = excluded.unlist_reason,
+				nsfm = excluded.nsfm, updated = excluded.updated`)
+		stmt.SetText("$host", strings.ToLower(overlay.Host))
+		stmt.SetInt64("$port", int64(overlay.Port))
+		stmt.SetText("$sessionId", overlay.SessionId)
+		stmt.SetBool("$unlisted", overlay.Unlisted)
+		stmt.SetText("$reason", overlay.UnlistReason)
+		stmt.SetBool("$nsfm", overlay.Nsfm)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+
+		// LastInsertRowID isn't updated when an existing row was changed
+		stmt = conn.Prep(`
+			SELECT id FROM session_overlays
+			WHERE host = $host AND port = $port AND session_id = $sessionId`)
+		defer stmt.Reset()
+		stmt.SetText("$host", strings.ToLower(overlay.Host))
+		stmt.SetInt64("$port", int64(overlay.Port))
+		stmt.SetText("$sessionId", overlay.SessionId)
+		if hasRow, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasRow {
+			return fmt.Errorf("No row returned")
+		}
+		id = stmt.GetInt64("id")
+		return nil
+	})
+
+	return id, err
+}
+
+func (db *sqliteDb) AdminDeleteSessionOverlay(id int64, ctx context.Context) (bool, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return false, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`DELETE FROM session_overlays WHERE id = ?`)
+	stmt.BindInt64(1, id)
+
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	} else {
+		return conn.Changes() > 0, nil
+	}
+}
+
+func (db *sqliteDb) FlagSession(listingId int64, reason string, ctx context.Context) error {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`UPDATE sessions SET flagged = $reason WHERE id = $id`)
+	stmt.SetText("$reason", reason)
+	stmt.SetInt64("$id", listingId)
+	_, err := stmt.Step()
+	return err
+}
+
+func (db *sqliteDb) QueryTitleFilters(ctx context.Context) ([]TitleFilter, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []TitleFilter{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`SELECT id, kind, pattern, action, notes FROM title_filters ORDER BY id`)
+
+	filters := []TitleFilter{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return filters, err
+		} else if !hasRow {
+			break
+		}
+
+		filters = append(filters, TitleFilter{
+			Id:      stmt.GetInt64("id"),
+			Type:    stmt.GetText("kind"),
+			Pattern: stmt.GetText("pattern"),
+			Action:  stmt.GetText("action"),
+			Notes:   stmt.GetText("notes"),
+		})
+	}
+
+	return filters, nil
+}
+
+func (db *sqliteDb) AdminCreateTitleFilter(filter TitleFilter, ctx context.Context) (int64, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		INSERT INTO title_filters (kind, pattern, action, notes)
+		VALUES ($kind, $pattern, $action, $notes)`)
+	stmt.SetText("$kind", filter.Type)
+	stmt.SetText("$pattern", filter.Pattern)
+	stmt.SetText("$action", filter.Action)
+	stmt.SetText("$notes", filter.Notes)
+
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+func (db *sqliteDb) AdminUpdateTitleFilter(filter TitleFilter, ctx context.Context) (bool, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return false, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		UPDATE title_filters
+		SET kind = $kind, pattern = $pattern, action = $action, notes = $notes
+		WHERE id = $id`)
+	stmt.SetText("$kind", filter.Type)
+	stmt.SetText("$pattern", filter.Pattern)
+	stmt.SetText("$action", filter.Action)
+	stmt.SetText("$notes", filter.Notes)
+	stmt.SetInt64("$id", filter.Id)
+
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	} else {
+		return conn.Changes() > 0, nil
+	}
+}
+
+func (db *sqliteDb) AdminDeleteTitleFilter(id int64, ctx context.Context) (bool, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return false, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`DELETE FROM title_filters WHERE id = ?`)
+	stmt.BindInt64(1, id)
+
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	} else {
+		return conn.Changes() > 0, nil
+	}
+}
+
+func (db *sqliteDb) InsertSessionReport(report SessionReport, ctx context.Context) (int64, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		INSERT INTO session_reports
+			(host, port, session_id, included, title, owner, category, message,
+			client_ip, reported, resolved_by, resolution)
+		VALUES ($host, $port, $sessionId, $included, $title, $owner, $category, $message,
+			$clientIp, CURRENT_TIMESTAMP, '', '')`)
+	stmt.SetText("$host", report.Host)
+	stmt.SetInt64("$port", int64(report.Port))
+	stmt.SetText("$sessionId", report.SessionId)
+	stmt.SetBool("$included", report.Included)
+	stmt.SetText("$title", report.Title)
+	stmt.SetText("$owner", report.Owner)
+	stmt.SetText("$category", report.Category)
+	stmt.SetText("$message", report.Message)
+	stmt.SetText("$clientIp", report.ClientIp)
+
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+func sqliteSessionReport(stmt *sqlite.Stmt) SessionReport {
+	return SessionReport{
+		Id:         stmt.GetInt64("id"),
+		Host:       stmt.GetText("host"),
+		Port:       int(stmt.GetInt64("port")),
+		SessionId:  stmt.GetText("session_id"),
+		Included:   stmt.GetInt64("included") != 0,
+		Title:      stmt.GetText("title"),
+		Owner:      stmt.GetText("owner"),
+		Category:   stmt.GetText("category"),
+		Message:    stmt.GetText("message"),
+		ClientIp:   stmt.GetText("client_ip"),
+		Reported:   stmt.GetText("reported"),
+		Resolved:   stmt.GetText("resolved"),
+		ResolvedBy: stmt.GetText("resolved_by"),
+		Resolution: stmt.GetText("resolution"),
+	}
+}
+
+func (db *sqliteDb) AdminQuerySessionReports(includeResolved bool, ctx context.Context) ([]SessionReport, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []SessionReport{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		SELECT id, host, port, session_id, included, title, owner, category, message,
+			client_ip, reported, resolved, resolved_by, resolution
+		FROM session_reports
+		WHERE $includeResolved OR resolved IS NULL
+		ORDER BY id DESC
+	`)
+	stmt.SetBool("$includeResolved", includeResolved)
+
+	reports := []SessionReport{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return reports, err
+		} else if !hasRow {
+			break
+		}
+		reports = append(reports, sqliteSessionReport(stmt))
+	}
+
+	return reports, nil
+}
+
+// Mark open reports as resolved. Returns the ids of the ones that were open.
+func (db *sqliteDb) AdminResolveSessionReports(ids []int64, resolvedBy string, resolution string, ctx context.Context) ([]int64, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []int64{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	resolvedIds := []int64{}
+	err := sqliteTransaction(conn, func() error {
+		stmt := conn.Prep(`
+			UPDATE session_reports
+			SET resolved = CURRENT_TIMESTAMP, resolved_by = $resolvedBy, resolution = $resolution
+			WHERE id = $id AND resolved IS NULL`)
+		stmt.SetText("$resolvedBy", resolvedBy)
+		stmt.SetText("$resolution", resolution)
+
+		for _, id := range ids {
+			stmt.Reset()
+			stmt.SetInt64("$id", id)
+			if _, err := stmt.Step(); err != nil {
+				return err
+			} else if conn.Changes() > 0 {
+				resolvedIds = append(resolvedIds, id)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return []int64{}, err
+	}
+	return resolvedIds, nil
+}
+
+func (db *sqliteDb) InsertAuditEntry(entry AuditEntry, ctx context.Context) (int64, error) {
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(`
+		INSERT INTO audit_log
+			(logged, user_id, user_name, action, target_ids, before_values,
+			after_values, client_ip)
+		VALUES (CURRENT_TIMESTAMP, $userId, $userName, $action, $targetIds, $before,
+			$after, $clientIp)`)
+	stmt.SetInt64("$userId", entry.UserId)
+	stmt.SetText("$userName", entry.UserName)
+	stmt.SetText("$action", entry.Action)
+	stmt.SetText("$targetIds", formatAuditTargetIds(entry.TargetIds))
+	stmt.SetText("$before", string(entry.Before))
+	stmt.SetText("$after", string(entry.After))
+	stmt.SetText("$clientIp", entry.ClientIp)
+
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+func sqliteAuditEntry(stmt *sqlite.Stmt) AuditEntry {
+	entry := AuditEntry{
+		Id:        stmt.GetInt64("id"),
+		Logged:    stmt.GetText("logged"),
+		UserId:    stmt.GetInt64("user_id"),
+		UserName:  stmt.GetText("user_name"),
+		Action:    stmt.GetText("action"),
+		TargetIds: parseAuditTargetIds(stmt.GetText("target_ids")),
+		ClientIp:  stmt.GetText("client_ip"),
+	}
+	if before := stmt.GetText("before_values"); before != "" {
+		entry.Before = json.RawMessage(before)
+	}
+	if after := stmt.GetText("after_values"); after != "" {
+		entry.After = json.RawMessage(after)
+	}
+	return entry
+}
+
+func (db *sqliteDb) AdminQueryAuditLog(opts AuditQueryOptions, ctx context.Context) ([]AuditEntry, error) {
+	querySql := `
+		SELECT id, logged, user_id, user_name, action, target_ids, before_values,
+			after_values, client_ip
+		FROM audit_log
+		WHERE 1=1`
+
+	if len(opts.User) > 0 {
+		querySql += " AND user_name=$user COLLATE NOCASE"
+	}
+	if len(opts.Action) > 0 {
+		querySql += " AND (action=$action OR substr(action, 1, length($action) + 1) = $action || '.')"
+	}
+	if opts.TargetId != 0 {
+		querySql += " AND ',' || target_ids || ',' LIKE '%,' || $target || ',%'"
+	}
+	if len(opts.From) > 0 {
+		querySql += " AND logged >= $from"
+	}
+
+	var before string
+	if len(opts.To) > 0 {
+		var err error
+		if before, err = nextDate(opts.To); err != nil {
+			return []AuditEntry{}, err
+		}
+		querySql += " AND logged < $before"
+	}
+
+	querySql += " ORDER BY id DESC LIMIT $limit OFFSET $offset"
+
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return []AuditEntry{}, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	stmt := conn.Prep(querySql)
+
+	if len(opts.User) > 0 {
+		stmt.SetText("$user", opts.User)
+	}
+	if len(opts.Action) > 0 {
+		stmt.SetText("$action", opts.Action)
+	}
+	if opts.TargetId != 0 {
+		stmt.SetText("$target", strconv.FormatInt(opts.TargetId, 10))
+	}
+	if len(opts.From) > 0 {
+		stmt.SetText("$from", opts.From)
+	}
+	if len(before) > 0 {
+		stmt.SetText("$before", before)
+	}
+	stmt.SetInt64("$limit", int64(opts.Limit))
+	stmt.SetInt64("$offset", int64(opts.Offset))
+
+	entries := []AuditEntry{}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return entries, err
+		} else if !hasRow {
+			break
+		}
+		entries = append(entries, sqliteAuditEntry(stmt))
+	}
+
+	return entries, nil
+}
+
 func (db *sqliteDb) AdminCreateRole(
 	name string, admin bool, accessSessions int64, accessHostbans int64,
-	accessRoles int64, accessUsers int64, ctx context.Context) (int64, error) {
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (int64, error) {
 
 	conn := db.pool.Get(ctx)
 	if conn == nil {
@@ -823,8 +1726,9 @@ func (db *sqliteDb) AdminCreateRole(
 
 	var stmt *sqlite.Stmt = conn.Prep(`
 		INSERT INTO roles (
-			name, admin, access_sessions, access_hostbans, access_roles, access_users)
-		VALUES ($name, $admin, $sessions, $hostbans, $roles, $users)
+			name, admin, access_sessions, access_hostbans, access_roles, access_users,
+			access_backups, access_audit)
+		VALUES ($name, $admin, $sessions, $hostbans, $roles, $users, $backups, $audit)
 	`)
 	stmt.SetText("$name", name)
 	stmt.SetBool("$admin", admin)
@@ -832,6 +1736,8 @@ func (db *sqliteDb) AdminCreateRole(
 	stmt.SetInt64("$hostbans", accessHostbans)
 	stmt.SetInt64("$roles", accessRoles)
 	stmt.SetInt64("$users", accessUsers)
+	stmt.SetInt64("$backups", accessBackups)
+	stmt.SetInt64("$audit", accessAudit)
 
 	if _, err := stmt.Step(); err != nil {
 		return 0, err
@@ -842,7 +1748,7 @@ func (db *sqliteDb) AdminCreateRole(
 
 func (db *sqliteDb) AdminUpdateRole(
 	id int64, name string, admin bool, accessSessions int64, accessHostbans int64,
-	accessRoles int64, accessUsers int64, ctx context.Context) (bool, error) {
+	accessRoles int64, accessUsers int64, accessBackups int64, accessAudit int64, ctx context.Context) (bool, error) {
 
 	conn := db.pool.Get(ctx)
 	if conn == nil {
@@ -853,7 +1759,8 @@ func (db *sqliteDb) AdminUpdateRole(
 	var stmt *sqlite.Stmt = conn.Prep(`
 		UPDATE roles SET name = $name, admin = $admin,
 			access_sessions = $sessions, access_hostbans = $hostbans,
-			access_roles = $roles, access_users = $users
+			access_roles = $roles, access_users = $users, access_backups = $backups,
+			access_audit = $audit
 		WHERE id = $id
 	`)
 	stmt.SetText("$name", name)
@@ -862,6 +1769,8 @@ func (db *sqliteDb) AdminUpdateRole(
 	stmt.SetInt64("$hostbans", accessHostbans)
 	stmt.SetInt64("$roles", accessRoles)
 	stmt.SetInt64("$users", accessUsers)
+	stmt.SetInt64("$backups", accessBackups)
+	stmt.SetInt64("$audit", accessAudit)
 	stmt.SetInt64("$id", id)
 
 	if _, err := stmt.Step(); err != nil {
@@ -898,7 +1807,7 @@ func (db *sqliteDb) AdminQueryRoles(ctx context.Context) ([]AdminRole, error) {
 	stmt := conn.Prep(`
 		SELECT
 			r.id, r.name, r.admin, r.access_sessions, r.access_hostbans,
-			r.access_roles, r.access_users,
+			r.access_roles, r.access_users, r.access_backups, r.access_audit,
 			(SELECT EXISTS (SELECT 1 FROM users u WHERE u.role = r.id)) AS used
 		FROM roles r
 		ORDER BY name
@@ -920,6 +1829,8 @@ func (db *sqliteDb) AdminQueryRoles(ctx context.Context) ([]AdminRole, error) {
 			AccessHostBans: int(stmt.GetInt64("access_hostbans")),
 			AccessRoles:    int(stmt.GetInt64("access_roles")),
 			AccessUsers:    int(stmt.GetInt64("access_users")),
+			AccessBackups:  int(stmt.GetInt64("access_backups")),
+			AccessAudit:    int(stmt.GetInt64("access_audit")),
 			Used:           stmt.GetInt64("used") != 0,
 		})
 	}
@@ -937,7 +1848,7 @@ func (db *sqliteDb) AdminQueryRoleByName(name string, ctx context.Context) (Admi
 	stmt := conn.Prep(`
 		SELECT
 			r.id, r.name, r.admin, r.access_sessions, r.access_hostbans,
-			r.access_roles, r.access_users,
+			r.access_roles, r.access_users, r.access_backups, r.access_audit,
 			(SELECT EXISTS (SELECT 1 FROM users u WHERE u.role = r.id)) AS used
 		FROM roles r
 		WHERE r.name = $name
@@ -959,6 +1870,8 @@ func (db *sqliteDb) AdminQueryRoleByName(name string, ctx context.Context) (Admi
 		AccessHostBans: int(stmt.GetInt64("access_hostbans")),
 		AccessRoles:    int(stmt.GetInt64("access_roles")),
 		AccessUsers:    int(stmt.GetInt64("access_users")),
+		AccessBackups:  int(stmt.GetInt64("access_backups")),
+		AccessAudit:    int(stmt.GetInt64("access_audit")),
 		Used:           stmt.GetInt64("used") != 0,
 	}, nil
 }
@@ -1061,7 +1974,8 @@ func (db *sqliteDb) AdminQueryUserByName(name string, ctx context.Context) (Admi
 		SELECT
 			u.id as user_id, u.name as user_name, r.id as role_id,
 			r.name as role_name, r.admin, r.access_sessions, r.access_hostbans,
-			r.access_roles, r.access_users, u.password_hash
+			r.access_roles, r.access_users, r.access_backups, r.access_audit,
+			u.password_hash
 		FROM users u
 		JOIN roles r ON r.id = u.role
 		WHERE u.name = $name
@@ -1083,6 +1997,8 @@ func (db *sqliteDb) AdminQueryUserByName(name string, ctx context.Context) (Admi
 				AccessHostBans: int(stmt.GetInt64("access_hostbans")),
 				AccessRoles:    int(stmt.GetInt64("access_roles")),
 				AccessUsers:    int(stmt.GetInt64("access_users")),
+				AccessBackups:  int(stmt.GetInt64("access_backups")),
+				AccessAudit:    int(stmt.GetInt64("access_audit")),
 			},
 			PasswordHash: stmt.GetText("password_hash"),
 		}
@@ -1125,6 +2041,542 @@ func (db *sqliteDb) AdminQueryUsers(ctx context.Context) ([]AdminUser, error) {
 	return users, nil
 }
 
+func (db *sqliteDb) Export(ctx context.Context) (ExportData, error) {
+	data := newExportData()
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return data, fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	// Read everything in one transaction to get a consistent snapshot
+	err := sqliteTransaction(conn, func() error {
+		stmt := conn.Prep(`
+			SELECT id, host, port, session_id, protocol, title, users, max_users,
+				password, nsfm, owner, started, last_active, unlisted, unlist_reason,
+				update_key, client_ip, closed, active_drawing_users, allow_web, flagged,
+				pending
+			FROM sessions ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			var unlistReason *string
+			if stmt.ColumnType(stmt.ColumnIndex("unlist_reason")) != sqlite.SQLITE_NULL {
+				reason := stmt.GetText("unlist_reason")
+				unlistReason = &reason
+			}
+
+			data.Sessions = append(data.Sessions, ExportSession{
+				Id:                 stmt.GetInt64("id"),
+				Host:               stmt.GetText("host"),
+				Port:               int(stmt.GetInt64("port")),
+				SessionId:          stmt.GetText("session_id"),
+				Protocol:           stmt.GetText("protocol"),
+				Title:              stmt.GetText("title"),
+				Users:              int(stmt.GetInt64("users")),
+				MaxUsers:           int(stmt.GetInt64("max_users")),
+				Password:           stmt.GetInt64("password") != 0,
+				Nsfm:               stmt.GetInt64("nsfm") != 0,
+				Owner:              stmt.GetText("owner"),
+				Started:            stmt.GetText("started"),
+				LastActive:         stmt.GetText("last_active"),
+				Unlisted:           stmt.GetInt64("unlisted") != 0,
+				UnlistReason:       unlistReason,
+				UpdateKey:          stmt.GetText("update_key"),
+				ClientIp:           stmt.GetText("client_ip"),
+				Closed:             stmt.GetInt64("closed") != 0,
+				ActiveDrawingUsers: int(stmt.GetInt64("active_drawing_users")),
+				AllowWeb:           stmt.GetInt64("allow_web") != 0,
+				Flagged:            stmt.GetText("flagged"),
+				Pending:            stmt.GetInt64("pending") != 0,
+			})
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, listing_id, host, port, session_id, protocol, title, users,
+				max_users, password, nsfm, owner, started, last_active, archived,
+				client_ip, unlist_reason, kicked
+			FROM session_archive ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.Archive = append(data.Archive, ArchivedSession{
+				Id:           stmt.GetInt64("id"),
+				ListingId:    stmt.GetInt64("listing_id"),
+				Host:         stmt.GetText("host"),
+				Port:         int(stmt.GetInt64("port")),
+				SessionId:    stmt.GetText("session_id"),
+				Protocol:     stmt.GetText("protocol"),
+				Title:        stmt.GetText("title"),
+				Users:        int(stmt.GetInt64("users")),
+				MaxUsers:     int(stmt.GetInt64("max_users")),
+				Password:     stmt.GetInt64("password") != 0,
+				Nsfm:         stmt.GetInt64("nsfm") != 0,
+				Owner:        stmt.GetText("owner"),
+				Started:      stmt.GetText("started"),
+				LastActive:   stmt.GetText("last_active"),
+				Archived:     stmt.GetText("archived"),
+				ClientIp:     stmt.GetText("client_ip"),
+				UnlistReason: stmt.GetText("unlist_reason"),
+				Kicked:       stmt.GetInt64("kicked") != 0,
+			})
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, kind, host, pattern, COALESCE(expires, '') AS expires, notes
+			FROM hostbans ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.HostBans = append(data.HostBans, ExportHostBan{
+				Id:      stmt.GetInt64("id"),
+				Type:    stmt.GetText("kind"),
+				Host:    stmt.GetText("host"),
+				Pattern: stmt.GetText("pattern"),
+				Expires: stmt.GetText("expires"),
+				Notes:   stmt.GetText("notes"),
+			})
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, name, admin, access_sessions, access_hostbans, access_roles,
+				access_users, access_backups, access_audit
+			FROM roles ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.Roles = append(data.Roles, ExportRole{
+				Id:             stmt.GetInt64("id"),
+				Name:           stmt.GetText("name"),
+				Admin:          stmt.GetInt64("admin") != 0,
+				AccessSessions: int(stmt.GetInt64("access_sessions")),
+				AccessHostBans: int(stmt.GetInt64("access_hostbans")),
+				AccessRoles:    int(stmt.GetInt64("access_roles")),
+				AccessUsers:    int(stmt.GetInt64("access_users")),
+				AccessBackups:  int(stmt.GetInt64("access_backups")),
+				AccessAudit:    int(stmt.GetInt64("access_audit")),
+			})
+		}
+
+		stmt = conn.Prep(`SELECT id, name, password_hash, role FROM users ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.Users = append(data.Users, ExportUser{
+				Id:           stmt.GetInt64("id"),
+				Name:         stmt.GetText("name"),
+				PasswordHash: stmt.GetText("password_hash"),
+				Role:         stmt.GetInt64("role"),
+			})
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, host, port, session_id, unlisted, unlist_reason, nsfm, updated
+			FROM session_overlays ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.Overlays = append(data.Overlays, SessionOverlay{
+				Id:           stmt.GetInt64("id"),
+				Host:         stmt.GetText("host"),
+				Port:         int(stmt.GetInt64("port")),
+				SessionId:    stmt.GetText("session_id"),
+				Unlisted:     stmt.GetInt64("unlisted") != 0,
+				UnlistReason: stmt.GetText("unlist_reason"),
+				Nsfm:         stmt.GetInt64("nsfm") != 0,
+				Updated:      stmt.GetText("updated"),
+			})
+		}
+
+		stmt = conn.Prep(`SELECT id, kind, pattern, action, notes FROM title_filters ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+
+			data.Filters = append(data.Filters, TitleFilter{
+				Id:      stmt.GetInt64("id"),
+				Type:    stmt.GetText("kind"),
+				Pattern: stmt.GetText("pattern"),
+				Action:  stmt.GetText("action"),
+				Notes:   stmt.GetText("notes"),
+			})
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, host, port, session_id, included, title, owner, category, message,
+				client_ip, reported, resolved, resolved_by, resolution
+			FROM session_reports ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+			data.Reports = append(data.Reports, sqliteSessionReport(stmt))
+		}
+
+		stmt = conn.Prep(`
+			SELECT id, logged, user_id, user_name, action, target_ids, before_values,
+				after_values, client_ip
+			FROM audit_log ORDER BY id`)
+		for {
+			if hasRow, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasRow {
+				break
+			}
+			data.Audit = append(data.Audit, sqliteAuditEntry(stmt))
+		}
+
+		return nil
+	})
+
+	return data, err
+}
+
+func sqliteIsEmpty(conn *sqlite.Conn) (bool, error) {
+	stmt := conn.Prep(`SELECT
+		EXISTS(SELECT 1 FROM sessions) OR EXISTS(SELECT 1 FROM session_archive) OR
+		EXISTS(SELECT 1 FROM hostbans) OR EXISTS(SELECT 1 FROM roles) OR
+		EXISTS(SELECT 1 FROM users) OR EXISTS(SELECT 1 FROM session_overlays) OR
+		EXISTS(SELECT 1 FROM title_filters) OR EXISTS(SELECT 1 FROM session_reports) OR
+		EXISTS(SELECT 1 FROM audit_log)`)
+	defer stmt.Reset()
+
+	if hasRow, err := stmt.Step(); err != nil {
+		return false, err
+	} else if !hasRow {
+		return false, fmt.Errorf("No row returned")
+	}
+	return stmt.ColumnInt(0) == 0, nil
+}
+
+func (db *sqliteDb) Import(data ExportData, replace bool, ctx context.Context) error {
+	if err := data.normalize(); err != nil {
+		return err
+	}
+
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("Connection not available")
+	}
+	defer db.pool.Put(conn)
+
+	return sqliteTransaction(conn, func() error {
+		if replace {
+			err := sqliteExecAll(conn, []string{
+				`DELETE FROM audit_log`,
+				`DELETE FROM session_reports`,
+				`DELETE FROM title_filters`,
+				`DELETE FROM session_overlays`,
+				`DELETE FROM users`,
+				`DELETE FROM roles`,
+				`DELETE FROM hostbans`,
+				`DELETE FROM session_archive`,
+				`DELETE FROM sessions`,
+			})
+			if err != nil {
+				return err
+			}
+		} else if empty, err := sqliteIsEmpty(conn); err != nil {
+			return err
+		} else if !empty {
+			return ErrDatabaseNotEmpty
+		}
+
+		stmt := conn.Prep(`INSERT INTO sessions
+			(id, host, port, session_id, protocol, title, users, usernames, password,
+			nsfm, owner, started, last_active, unlisted, update_key, client_ip,
+			unlist_reason, max_users, closed, active_drawing_users, allow_web, flagged,
+			pending)
+			VALUES (?, ?, ?, ?, ?, ?, ?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		for _, s := range data.Sessions {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), s.Id)
+			stmt.BindText(i(), s.Host)
+			stmt.BindInt64(i(), int64(s.Port))
+			stmt.BindText(i(), s.SessionId)
+			stmt.BindText(i(), s.Protocol)
+			stmt.BindText(i(), s.Title)
+			stmt.BindInt64(i(), int64(s.Users))
+			stmt.BindBool(i(), s.Password)
+			stmt.BindBool(i(), s.Nsfm)
+			stmt.BindText(i(), s.Owner)
+			stmt.BindText(i(), s.Started)
+			stmt.BindText(i(), s.LastActive)
+			stmt.BindBool(i(), s.Unlisted)
+			stmt.BindText(i(), s.UpdateKey)
+			stmt.BindText(i(), s.ClientIp)
+			if s.UnlistReason == nil {
+				stmt.BindNull(i())
+			} else {
+				stmt.BindText(i(), *s.UnlistReason)
+			}
+			stmt.BindInt64(i(), int64(s.MaxUsers))
+			stmt.BindBool(i(), s.Closed)
+			stmt.BindInt64(i(), int64(s.ActiveDrawingUsers))
+			stmt.BindBool(i(), s.AllowWeb)
+			stmt.BindText(i(), s.Flagged)
+			stmt.BindBool(i(), s.Pending)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Session %d: %s", s.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO session_archive
+			(id, listing_id, host, port, session_id, protocol, title, users,
+			max_users, password, nsfm, owner, started, last_active, archived,
+			client_ip, unlist_reason, kicked)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		for _, a := range data.Archive {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), a.Id)
+			stmt.BindInt64(i(), a.ListingId)
+			stmt.BindText(i(), a.Host)
+			stmt.BindInt64(i(), int64(a.Port))
+			stmt.BindText(i(), a.SessionId)
+			stmt.BindText(i(), a.Protocol)
+			stmt.BindText(i(), a.Title)
+			stmt.BindInt64(i(), int64(a.Users))
+			stmt.BindInt64(i(), int64(a.MaxUsers))
+			stmt.BindBool(i(), a.Password)
+			stmt.BindBool(i(), a.Nsfm)
+			stmt.BindText(i(), a.Owner)
+			stmt.BindText(i(), a.Started)
+			stmt.BindText(i(), a.LastActive)
+			stmt.BindText(i(), a.Archived)
+			stmt.BindText(i(), a.ClientIp)
+			stmt.BindText(i(), a.UnlistReason)
+			stmt.BindBool(i(), a.Kicked)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Archived session %d: %s", a.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO hostbans (id, kind, host, pattern, expires, notes)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`)
+		for _, b := range data.HostBans {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), b.Id)
+			stmt.BindText(i(), b.Type)
+			stmt.BindText(i(), b.Host)
+			stmt.BindText(i(), b.Pattern)
+			stmt.BindText(i(), b.Expires)
+			stmt.BindText(i(), b.Notes)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Host ban %d: %s", b.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO roles
+			(id, name, admin, access_sessions, access_hostbans, access_roles,
+			access_users, access_backups, access_audit)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		for _, r := range data.Roles {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), r.Id)
+			stmt.BindText(i(), r.Name)
+			stmt.BindBool(i(), r.Admin)
+			stmt.BindInt64(i(), int64(r.AccessSessions))
+			stmt.BindInt64(i(), int64(r.AccessHostBans))
+			stmt.BindInt64(i(), int64(r.AccessRoles))
+			stmt.BindInt64(i(), int64(r.AccessUsers))
+			stmt.BindInt64(i(), int64(r.AccessBackups))
+			stmt.BindInt64(i(), int64(r.AccessAudit))
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Role %d: %s", r.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO users (id, name, password_hash, role) VALUES (?, ?, ?, ?)`)
+		for _, u := range data.Users {
+			stmt.Reset()
+			stmt.BindInt64(1, u.Id)
+			stmt.BindText(2, u.Name)
+			stmt.BindText(3, u.PasswordHash)
+			stmt.BindInt64(4, u.Role)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("User %d: %s", u.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO session_overlays
+			(id, host, port, session_id, unlisted, unlist_reason, nsfm, updated)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+		for _, o := range data.Overlays {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), o.Id)
+			stmt.BindText(i(), strings.ToLower(o.Host))
+			stmt.BindInt64(i(), int64(o.Port))
+			stmt.BindText(i(), o.SessionId)
+			stmt.BindBool(i(), o.Unlisted)
+			stmt.BindText(i(), o.UnlistReason)
+			stmt.BindBool(i(), o.Nsfm)
+			stmt.BindText(i(), o.Updated)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Session overlay %d: %s", o.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO title_filters (id, kind, pattern, action, notes)
+			VALUES (?, ?, ?, ?, ?)`)
+		for _, f := range data.Filters {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), f.Id)
+			stmt.BindText(i(), f.Type)
+			stmt.BindText(i(), f.Pattern)
+			stmt.BindText(i(), f.Action)
+			stmt.BindText(i(), f.Notes)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Title filter %d: %s", f.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO session_reports
+			(id, host, port, session_id, included, title, owner, category, message,
+			client_ip, reported, resolved, resolved_by, resolution)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)`)
+		for _, r := range data.Reports {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), r.Id)
+			stmt.BindText(i(), r.Host)
+			stmt.BindInt64(i(), int64(r.Port))
+			stmt.BindText(i(), r.SessionId)
+			stmt.BindBool(i(), r.Included)
+			stmt.BindText(i(), r.Title)
+			stmt.BindText(i(), r.Owner)
+			stmt.BindText(i(), r.Category)
+			stmt.BindText(i(), r.Message)
+			stmt.BindText(i(), r.ClientIp)
+			stmt.BindText(i(), r.Reported)
+			stmt.BindText(i(), r.Resolved)
+			stmt.BindText(i(), r.ResolvedBy)
+			stmt.BindText(i(), r.Resolution)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Session report %d: %s", r.Id, err)
+			}
+		}
+
+		stmt = conn.Prep(`INSERT INTO audit_log
+			(id, logged, user_id, user_name, action, target_ids, before_values,
+			after_values, client_ip)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		for _, a := range data.Audit {
+			stmt.Reset()
+			i := sqlite.BindIncrementor()
+			stmt.BindInt64(i(), a.Id)
+			stmt.BindText(i(), a.Logged)
+			stmt.BindInt64(i(), a.UserId)
+			stmt.BindText(i(), a.UserName)
+			stmt.BindText(i(), a.Action)
+			stmt.BindText(i(), formatAuditTargetIds(a.TargetIds))
+			stmt.BindText(i(), string(a.Before))
+			stmt.BindText(i(), string(a.After))
+			stmt.BindText(i(), a.ClientIp)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Audit log entry %d: %s", a.Id, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Copy the database into the backup directory using SQLite's online backup
+// API, which gives a consistent snapshot even while the database is in use.
+// The copy is written under a temporary name first, so that a partially
+// written backup never counts as one of the kept copies.
+func (db *sqliteDb) Backup(ctx context.Context) (BackupInfo, error) {
+	dir := db.backupSettings.Dir
+	if dir == "" {
+		return BackupInfo{}, ErrBackupNotConfigured
+	}
+
+	db.backupMutex.Lock()
+	defer db.backupMutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return BackupInfo{}, err
+	}
+
+	name := backupFileName(time.Now())
+	path := filepath.Join(dir, name)
+	tmpPath := path + ".tmp"
+
+	conn := db.pool.Get(ctx)
+	if conn == nil {
+		return BackupInfo{}, fmt.Errorf("Connection not available")
+	}
+	dst, err := conn.BackupToDB("", tmpPath)
+	db.pool.Put(conn)
+	if err != nil {
+		os.Remove(tmpPath)
+		return BackupInfo{}, err
+	}
+
+	// Make the backup a single self-contained file
+	err = sqliteExec(dst, "PRAGMA journal_mode=DELETE")
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return BackupInfo{}, err
+	}
+
+	if err := rotateBackups(dir, db.backupSettings.Keep); err != nil {
+		log.Println("Backup rotation error:", err)
+	}
+
+	return backupFileInfo(dir, name)
+}
+
+func (db *sqliteDb) QueryBackups(ctx context.Context) ([]BackupInfo, error) {
+	if db.backupSettings.Dir == "" {
+		return nil, ErrBackupNotConfigured
+	}
+	return listBackups(db.backupSettings.Dir)
+}
+
 func (db *sqliteDb) Close() error {
+	db.cleanupTask.stop()
+	db.backupTask.stop()
 	return db.pool.Close()
 }
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package db
+
+import "fmt"
+
+// The SQLite driver is written in C, so it's not available in cgo-free
+// builds. The memory and PostgreSQL databases work without it.
+func newSqliteDb(dbname string, sessionTimeout int, cleanup CleanupSettings, backup BackupSettings) (Database, error) {
+	return nil, fmt.Errorf("SQLite support not available, listserver was built without cgo")
+}
+
+func withSqliteMigrator(dbname string, readOnly bool, f func(m migrator) error) error {
+	return fmt.Errorf("SQLite support not available, listserver was built without cgo")
+}
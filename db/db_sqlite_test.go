@@ -1,12 +1,22 @@
+//go:build cgo
+
 package db
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func initDb() *sqliteDb {
-	db, err := newSqliteDb("memory", 5)
+	db, err := newSqliteDb("memory", 5, testCleanupSettings, BackupSettings{})
 	if err != nil {
 		panic(err)
 	}
@@ -29,6 +39,7 @@ func insertTest(db *sqliteDb, title string, id string) NewSessionInfo {
 			Started:   "",
 		},
 		"192.168.1.1",
+		false,
 		context.TODO(),
 	)
 
@@ -102,20 +113,55 @@ func TestQueryList(t *testing.T) {
 	}
 }
 
+func TestQueryFilters(t *testing.T) {
+	testQueryFilters(t, initDb())
+}
+
+func TestSessionOverlays(t *testing.T) {
+	testSessionOverlays(t, initDb())
+}
+
+func TestTitleFilters(t *testing.T) {
+	testTitleFilters(t, initDb())
+}
+
+func TestPendingSessions(t *testing.T) {
+	testPendingSessions(t, initDb())
+}
+
+func TestSessionReports(t *testing.T) {
+	testSessionReports(t, initDb())
+}
+
+func TestAuditLog(t *testing.T) {
+	testAuditLog(t, initDb())
+}
+
 func TestSessionRefreshing(t *testing.T) {
 	db := initDb()
 	ses := insertTest(db, "test", "demo1")
 
-	err := db.RefreshSession(map[string]interface{}{
+	fields := map[string]interface{}{
 		"title":     "Hello",
 		"users":     10,
 		"usernames": []string{"a", "b"},
 		"password":  true,
 		"nsfm":      true,
 		"private":   false,
-	}, ses.ListingId, ses.UpdateKey, context.TODO())
+	}
+	changed, err := db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
 	if err != nil {
 		panic(err)
+	} else if !changed {
+		t.Error("Refresh with new values reported no change")
+	}
+
+	// Refreshing again with the same values only keeps the session alive
+	changed, err = db.RefreshSession(fields, ses.ListingId, ses.UpdateKey, context.TODO())
+	if err != nil {
+		panic(err)
+	} else if changed {
+		t.Error("Refresh with the same values reported a change")
 	}
 
 	sessions, err := db.QuerySessionList(QueryOptions{Nsfm: true}, context.TODO())
@@ -181,7 +227,7 @@ func TestExpiredSession(t *testing.T) {
 	}
 
 	// Can't refresh either
-	if err := db.RefreshSession(map[string]interface{}{}, ses.ListingId, ses.UpdateKey, context.TODO()); err != nil {
+	if _, err := db.RefreshSession(map[string]interface{}{}, ses.ListingId, ses.UpdateKey, context.TODO()); err != nil {
 		if _, ok := err.(RefreshError); !ok {
 			panic(err)
 		}
@@ -189,7 +235,7 @@ func TestExpiredSession(t *testing.T) {
 }
 
 func tryIsBanned(t *testing.T, db *sqliteDb, host string, expected bool) {
-	banned, err := db.IsBannedHost(host, context.TODO())
+	banned, err := db.IsBannedHost(host, nil, context.TODO())
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -210,7 +256,9 @@ func TestBanList(t *testing.T) {
 		('BaNnEd3.cOm', NULL),
 		('expired.com', '2000-01-01T00:00:00Z'),
 		('rebanned.com', '2000-01-01T00:00:00Z'),
-		('rebanned.com', '3000-01-01T00:00:00Z')
+		('rebanned.com', '3000-01-01T00:00:00Z'),
+		('192.0.2.0/24', NULL),
+		('*.wild.com', NULL)
 	`)
 	db.pool.Put(conn)
 
@@ -223,6 +271,17 @@ func TestBanList(t *testing.T) {
 	tryIsBanned(t, db, "rebanned.com", true)
 	tryIsBanned(t, db, "expired.com", false)
 	tryIsBanned(t, db, "not-banned.com", false)
+	tryIsBanned(t, db, "192.0.2.17", true)
+	tryIsBanned(t, db, "sub.wild.com", true)
+
+	// Addresses the host resolves to are checked too
+	if banned, _ := db.IsBannedHost("resolves.com", []net.IP{net.ParseIP("192.0.2.5")}, context.TODO()); !banned {
+		t.Error("Host resolving to a banned range is not banned")
+	}
+}
+
+func TestSessionBans(t *testing.T) {
+	testSessionBans(t, initDb())
 }
 
 func TestCleanup(t *testing.T) {
@@ -231,13 +290,20 @@ func TestCleanup(t *testing.T) {
 	// Insert a few test entries
 	conn := db.pool.Get(context.TODO())
 	sqliteExec(conn, `INSERT INTO sessions VALUES
-		(1, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now'), 0, 'x', '127.0.0.1', NULL, 255, 0, -1, 0),
-		(2, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now'), 1, 'x', '127.0.0.1', NULL, 32, 0, -1, 0),
-		(3, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now', '-10 days'), 0, 'x', '127.0.0.1', NULL, 8, 1, -1, 0)
+		(1, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now'), 0, 'x', '127.0.0.1', NULL, 255, 0, -1, 0, '', 0),
+		(2, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now'), 1, 'x', '127.0.0.1', NULL, 32, 0, -1, 0, '', 0),
+		(3, 'example.com', 27750, 'abc1', 'dp:0.1.2', 'Test1', 0, '', 0, 0, 'X', '0000-00-00', DATETIME('now', '-10 days'), 0, 'x', '127.0.0.1', NULL, 8, 1, -1, 0, '', 0)
 	`)
 	db.pool.Put(conn)
 
-	db.cleanup()
+	result, err := db.Cleanup(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ArchivedSessions != 2 {
+		t.Errorf("Expected 2 archived sessions, got %d", result.ArchivedSessions)
+	}
 
 	conn = db.pool.Get(context.TODO())
 	stmt := conn.Prep("SELECT COUNT(*) FROM sessions")
@@ -246,4 +312,322 @@ func TestCleanup(t *testing.T) {
 	if stmt.ColumnInt(0) != 1 {
 		t.Errorf("Expected only one row after cleanup, got %d", stmt.ColumnInt(0))
 	}
+	stmt.Reset()
+	db.pool.Put(conn)
+
+	archived, err := db.AdminQueryArchive(ArchiveQueryOptions{Limit: 10}, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived) != 2 {
+		t.Fatalf("Expected two archived sessions, got %d", len(archived))
+	}
+
+	// Most recently active first
+	if archived[0].ListingId != 2 || archived[0].UnlistReason != "unlisted by owner" {
+		t.Errorf("Unexpected first archived session %v", archived[0])
+	}
+
+	if archived[1].ListingId != 3 || archived[1].UnlistReason != "timed out" || archived[1].MaxUsers != 8 {
+		t.Errorf("Unexpected second archived session %v", archived[1])
+	}
+}
+
+func TestCleanupHostBans(t *testing.T) {
+	db, err := newSqliteDb("memory", 5, CleanupSettings{
+		TimedOutRetention: time.Hour,
+		HostBanRetention:  24 * time.Hour,
+	}, BackupSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AdminCreateHostBan(BanTypeHost, "expired.com", "", "2000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "banned.com", "", "3000-01-01", "", context.TODO())
+	db.AdminCreateHostBan(BanTypeHost, "forever.com", "", "", "", context.TODO())
+
+	result, err := db.Cleanup(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.PurgedHostBans != 1 {
+		t.Errorf("Expected 1 purged host ban, got %d", result.PurgedHostBans)
+	}
+
+	bans, _ := db.AdminQueryHostBans(context.TODO())
+	if len(bans) != 2 {
+		t.Errorf("Expected 2 remaining host bans, got %d", len(bans))
+	}
+}
+
+func TestArchiveQuery(t *testing.T) {
+	db := initDb()
+
+	conn := db.pool.Get(context.TODO())
+	sqliteExec(conn, `INSERT INTO session_archive (
+		listing_id, host, port, session_id, protocol, title, users, max_users,
+		password, nsfm, owner, started, last_active, archived, client_ip,
+		unlist_reason, kicked) VALUES
+		(1, 'example.com', 27750, 'a', 'dp:4.21.2', 'Hello', 1, 8, 0, 0, 'Alice', '2020-01-01T10:00:00Z', '2020-01-01 12:00:00', '2020-01-02 12:00:00', '127.0.0.1', 'timed out', 0),
+		(2, 'EXAMPLE.com', 27750, 'b', 'dp:4.21.2', 'World', 1, 8, 0, 0, 'Bob', '2020-01-05T10:00:00Z', '2020-01-05 12:00:00', '2020-01-06 12:00:00', '127.0.0.1', 'naughty', 1),
+		(3, 'other.com', 27750, 'c', 'dp:4.21.2', 'Hello again', 1, 8, 0, 0, 'alice', '2020-01-10T10:00:00Z', '2020-01-10 12:00:00', '2020-01-11 12:00:00', '127.0.0.2', 'unlisted by owner', 0)
+	`)
+	db.pool.Put(conn)
+
+	tryQuery := func(opts ArchiveQueryOptions, expected ...int64) {
+		opts.Limit = 10
+		archived, err := db.AdminQueryArchive(opts, context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []int64{}
+		for _, a := range archived {
+			ids = append(ids, a.ListingId)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("Query %v returned %v, expected %v", opts, ids, expected)
+		}
+	}
+
+	tryQuery(ArchiveQueryOptions{}, 3, 2, 1)
+	tryQuery(ArchiveQueryOptions{Host: "example.com"}, 2, 1)
+	tryQuery(ArchiveQueryOptions{Owner: "ALICE"}, 3, 1)
+	tryQuery(ArchiveQueryOptions{Title: "hello"}, 3, 1)
+	tryQuery(ArchiveQueryOptions{From: "2020-01-05"}, 3, 2)
+	tryQuery(ArchiveQueryOptions{To: "2020-01-05"}, 2, 1)
+	tryQuery(ArchiveQueryOptions{From: "2020-01-02", To: "2020-01-09"}, 2)
+	tryQuery(ArchiveQueryOptions{Offset: 1}, 2, 1)
+}
+
+func TestMigrations(t *testing.T) {
+	dbname := t.TempDir() + "/test.db"
+
+	if _, err := QueryMigrationStatus(dbname); err != ErrNotInitialized {
+		t.Fatalf("Expected ErrNotInitialized, got %v", err)
+	}
+	if _, err := os.Stat(dbname); err == nil {
+		t.Fatal("Querying the migration status created the database")
+	}
+
+	// Several list servers starting at once on an existing database must not
+	// apply migrations twice
+	if dbpool, err := sqliteOpen(dbname); err != nil {
+		t.Fatal(err)
+	} else {
+		dbpool.Close()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ApplyMigrations(dbname)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := QueryMigrationStatus(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != len(migrations) {
+		t.Fatalf("Expected %d migrations, got %d", len(migrations), len(infos))
+	}
+
+	for _, info := range infos {
+		if !info.Applied {
+			t.Errorf("Migration %d not applied", info.Version)
+		}
+	}
+
+	// Pretend a newer listserver has been run on this database
+	dbpool, err := sqliteOpen(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dbpool.Get(context.TODO())
+	if err := sqliteExec(conn, `INSERT INTO migrations (version) VALUES (99999)`); err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+	dbpool.Close()
+
+	if _, err := newSqliteDb(dbname, 5, CleanupSettings{}, BackupSettings{}); err == nil {
+		t.Fatal("Database with newer schema was opened")
+	} else if _, ok := err.(SchemaTooNewError); !ok {
+		t.Fatalf("Expected SchemaTooNewError, got %v", err)
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	dbname := t.TempDir() + "/test.db"
+	if err := ApplyMigrations(dbname); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing migration must not take the ones before it down with it
+	latest := latestSchemaVersion()
+	defer func(saved []migration) { migrations = saved }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{version: latest + 1, sqlite: []string{`CREATE TABLE good (id INTEGER)`}},
+		migration{version: latest + 2, sqlite: []string{`CREATE TABLE bad (`}},
+	)
+
+	if err := ApplyMigrations(dbname); err == nil {
+		t.Fatal("Broken migration was applied")
+	}
+
+	infos, err := QueryMigrationStatus(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Applied != (info.Version <= latest+1) {
+			t.Errorf("Migration %d applied: %v", info.Version, info.Applied)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	db := initDb()
+	ctx := context.TODO()
+
+	ses1 := insertTest(db, "test1", "demo1")
+	ses2 := insertTest(db, "test2", "demo2")
+	db.DeleteSession(ses1.ListingId, ses1.UpdateKey, ctx)
+	db.Cleanup(ctx)
+	db.AdminUpdateSessions([]int64{ses2.ListingId}, true, "naughty", ctx)
+	ses3 := insertTest(db, "test3", "demo3")
+	db.FlagSession(ses3.ListingId, "test", ctx)
+	db.AdminCreateHostBan(BanTypeHost, "banned.com", "", "3000-01-01", "notes", ctx)
+	db.AdminCreateHostBan(BanTypeHost, "forever.com", "", "", "", ctx)
+	db.AdminCreateHostBan(BanTypeSession, "example.com", "evil", "", "", ctx)
+	roleId, _ := db.AdminCreateRole("mod", false, 2, 1, 0, 0, 1, 1, ctx)
+	db.AdminCreateUser("someone", "hash", roleId, ctx)
+	db.AdminPutSessionOverlay(SessionOverlay{
+		Host: "included.com", Port: 27750, SessionId: "abc", Unlisted: true, UnlistReason: "spam"}, ctx)
+	db.AdminCreateTitleFilter(TitleFilter{Type: "word", Pattern: "test", Action: "flag"}, ctx)
+	reportId, _ := db.InsertSessionReport(SessionReport{
+		Host: "example.com", Port: 27750, SessionId: "demo3", Category: "spam", ClientIp: "192.168.1.1"}, ctx)
+	db.InsertSessionReport(SessionReport{
+		Host: "included.com", Port: 27750, SessionId: "abc", Included: true, Category: "title"}, ctx)
+	db.AdminResolveSessionReports([]int64{reportId}, "admin", "", ctx)
+	db.InsertAuditEntry(AuditEntry{
+		UserName: "admin", Action: "bans.create", TargetIds: []int64{1},
+		After: json.RawMessage(`{"host":"banned.com"}`), ClientIp: "192.168.1.1"}, ctx)
+	db.InsertAuditEntry(AuditEntry{UserId: 1, UserName: "someone", Action: "cleanup"}, ctx)
+
+	exported, err := db.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exported.Sessions) != 2 || len(exported.Archive) != 1 || len(exported.HostBans) != 3 ||
+		len(exported.Roles) != 1 || len(exported.Users) != 1 || len(exported.Overlays) != 1 ||
+		len(exported.Filters) != 1 || exported.Sessions[1].Flagged != "test" ||
+		len(exported.Reports) != 2 || exported.Reports[0].Resolved == "" ||
+		len(exported.Audit) != 2 || string(exported.Audit[0].After) != `{"host":"banned.com"}` {
+		t.Fatalf("Unexpected export %v", exported)
+	}
+
+	// Round trip through another backend
+	mem := newMemoryDb(5, testCleanupSettings)
+	if err := mem.Import(exported, false, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	reexported, err := mem.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reexported.Exported = exported.Exported
+
+	if !reflect.DeepEqual(reexported, exported) {
+		t.Errorf("Export changed in round trip:\n%+v\n%+v", exported, reexported)
+	}
+
+	// The update key still works
+	_, err = mem.RefreshSession(map[string]interface{}{"users": 5}, ses2.ListingId, ses2.UpdateKey, ctx)
+	if err == nil || err.Error() != "naughty" {
+		t.Errorf("Expected unlist reason as error, got %v", err)
+	}
+
+	if err := db.Import(reexported, false, ctx); err != ErrDatabaseNotEmpty {
+		t.Errorf("Expected ErrDatabaseNotEmpty, got %v", err)
+	}
+
+	if err := db.Import(reexported, true, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if user, err := db.AdminQueryUserByName("someone", ctx); err != nil {
+		t.Fatal(err)
+	} else if user.PasswordHash != "hash" || user.Role.Name != "mod" {
+		t.Errorf("Unexpected user after import %v", user)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+
+	if _, err := initDb().Backup(ctx); err != ErrBackupNotConfigured {
+		t.Errorf("Expected ErrBackupNotConfigured, got %v", err)
+	}
+
+	db, err := newSqliteDb("memory", 5, testCleanupSettings, BackupSettings{Dir: dir, Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTest(db, "Backed up", "backup")
+
+	// Older backups to rotate out, plus a file that isn't a backup at all
+	for _, name := range []string{"listserver-20000101-000000.db", "listserver-20000102-000000.db", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := db.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := db.QueryBackups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0] != info || backups[1].Name != "listserver-20000102-000000.db" {
+		t.Errorf("Unexpected backups %v", backups)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Unrelated file was touched: %v", err)
+	}
+
+	copy, err := newSqliteDb(filepath.Join(dir, info.Name), 5, testCleanupSettings, BackupSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copy.Close()
+
+	sessions, err := copy.AdminQuerySessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Title != "Backed up" {
+		t.Errorf("Unexpected sessions in backup %v", sessions)
+	}
 }
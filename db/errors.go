@@ -7,3 +7,7 @@ type RefreshError struct {
 func (e RefreshError) Error() string {
 	return e.message
 }
+
+// Returned by RefreshSession when the new title matches a ban. The session
+// has been unlisted.
+var ErrBannedSession = RefreshError{BannedSessionReason}
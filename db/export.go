@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version of the export document format. Increment it when making changes
+// that older versions of the listserver can't import. Documents from older
+// versions can still be imported.
+const ExportVersion = 2
+
+// Returned when importing into a database that already has content
+var ErrDatabaseNotEmpty = errors.New("Database is not empty")
+
+// The full content of a database, for moving it to another one.
+// Timestamps are in UTC, using the same formats as the admin API.
+type ExportData struct {
+	Version  int               `json:"version"`
+	Exported string            `json:"exported"`
+	Sessions []ExportSession   `json:"sessions"`
+	Archive  []ArchivedSession `json:"archive"`
+	HostBans []ExportHostBan   `json:"hostbans"`
+	Roles    []ExportRole      `json:"roles"`
+	Users    []ExportUser      `json:"users"`
+	Overlays []SessionOverlay  `json:"overlays"`
+	Filters  []TitleFilter     `json:"titlefilters"`
+	Reports  []SessionReport   `json:"reports"`
+	Audit    []AuditEntry      `json:"audit"`
+}
+
+type ExportSession struct {
+	Id                 int64   `json:"id"`
+	Host               string  `json:"host"`
+	Port               int     `json:"port"`
+	SessionId          string  `json:"sessionid"`
+	Protocol           string  `json:"protocol"`
+	Title              string  `json:"title"`
+	Users              int     `json:"users"`
+	MaxUsers           int     `json:"maxusers"`
+	Password           bool    `json:"password"`
+	Nsfm               bool    `json:"nsfm"`
+	Owner              string  `json:"owner"`
+	Started            string  `json:"started"`
+	LastActive         string  `json:"lastactive"`
+	Unlisted           bool    `json:"unlisted"`
+	UnlistReason       *string `json:"unlistreason"` // nil unless unlisted by an admin
+	UpdateKey          string  `json:"updatekey"`
+	ClientIp           string  `json:"clientip"`
+	Closed             bool    `json:"closed"`
+	ActiveDrawingUsers int     `json:"activedrawingusers"`
+	AllowWeb           bool    `json:"allowweb"`
+	Flagged            string  `json:"flagged"`
+	Pending            bool    `json:"pending"`
+}
+
+type ExportHostBan struct {
+	Id      int64  `json:"id"`
+	Type    string `json:"type"` // empty in version 1, where all bans are host bans
+	Host    string `json:"host"`
+	Pattern string `json:"pattern"`
+	Expires string `json:"expires"` // empty if the ban never expires
+	Notes   string `json:"notes"`
+}
+
+type ExportRole struct {
+	Id             int64  `json:"id"`
+	Name           string `json:"name"`
+	Admin          bool   `json:"admin"`
+	AccessSessions int    `json:"accesssessions"`
+	AccessHostBans int    `json:"accesshostbans"`
+	AccessRoles    int    `json:"accessroles"`
+	AccessUsers    int    `json:"accessusers"`
+	AccessBackups  int    `json:"accessbackups"`
+	AccessAudit    int    `json:"accessaudit"`
+}
+
+type ExportUser struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordhash"`
+	Role         int64  `json:"role"`
+}
+
+const (
+	exportStartedFormat   = "2006-01-02T15:04:05Z"
+	exportTimestampFormat = "2006-01-02 15:04:05"
+)
+
+func newExportData() ExportData {
+	return ExportData{
+		Version:  ExportVersion,
+		Exported: time.Now().UTC().Format(exportTimestampFormat),
+		Sessions: []ExportSession{},
+		Archive:  []ArchivedSession{},
+		HostBans: []ExportHostBan{},
+		Roles:    []ExportRole{},
+		Users:    []ExportUser{},
+		Overlays: []SessionOverlay{},
+		Filters:  []TitleFilter{},
+		Reports:  []SessionReport{},
+		Audit:    []AuditEntry{},
+	}
+}
+
+// Older databases may contain timestamps in either format
+func parseExportTimestamp(s string) (time.Time, error) {
+	for _, layout := range []string{exportTimestampFormat, time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid timestamp '%s'", s)
+}
+
+func normalizeExportTimestamp(s *string, layout string) error {
+	t, err := parseExportTimestamp(*s)
+	if err != nil {
+		return err
+	}
+	*s = t.Format(layout)
+	return nil
+}
+
+// Check the document version and bring all timestamps into the same format,
+// so that the backends can insert them as they are.
+func (data *ExportData) normalize() error {
+	if data.Version < 1 || data.Version > ExportVersion {
+		return fmt.Errorf("Unsupported export version %d, expected at most %d", data.Version, ExportVersion)
+	}
+
+	for i := range data.Sessions {
+		s := &data.Sessions[i]
+		if err := normalizeExportTimestamp(&s.Started, exportStartedFormat); err != nil {
+			return fmt.Errorf("Session %d: %s", s.Id, err)
+		}
+		if err := normalizeExportTimestamp(&s.LastActive, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Session %d: %s", s.Id, err)
+		}
+	}
+
+	for i := range data.Archive {
+		a := &data.Archive[i]
+		if err := normalizeExportTimestamp(&a.Started, exportStartedFormat); err != nil {
+			return fmt.Errorf("Archived session %d: %s", a.Id, err)
+		}
+		if err := normalizeExportTimestamp(&a.LastActive, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Archived session %d: %s", a.Id, err)
+		}
+		if err := normalizeExportTimestamp(&a.Archived, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Archived session %d: %s", a.Id, err)
+		}
+	}
+
+	for i := range data.HostBans {
+		b := &data.HostBans[i]
+		if b.Type == "" {
+			b.Type = BanTypeHost
+		}
+		if b.Expires != "" {
+			if err := normalizeExportTimestamp(&b.Expires, exportTimestampFormat); err != nil {
+				return fmt.Errorf("Host ban %d: %s", b.Id, err)
+			}
+		}
+	}
+
+	for i := range data.Overlays {
+		o := &data.Overlays[i]
+		if err := normalizeExportTimestamp(&o.Updated, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Session overlay %d: %s", o.Id, err)
+		}
+	}
+
+	for i := range data.Reports {
+		r := &data.Reports[i]
+		if err := normalizeExportTimestamp(&r.Reported, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Session report %d: %s", r.Id, err)
+		}
+		if r.Resolved != "" {
+			if err := normalizeExportTimestamp(&r.Resolved, exportTimestampFormat); err != nil {
+				return fmt.Errorf("Session report %d: %s", r.Id, err)
+			}
+		}
+	}
+
+	for i := range data.Audit {
+		a := &data.Audit[i]
+		if err := normalizeExportTimestamp(&a.Logged, exportTimestampFormat); err != nil {
+			return fmt.Errorf("Audit log entry %d: %s", a.Id, err)
+		}
+		if a.TargetIds == nil {
+			a.TargetIds = []int64{}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// What a ban applies to
+const (
+	BanTypeHost       = "host"       // host name, wildcard domain, address or range
+	BanTypeOwner      = "owner"      // owner name, ignoring case
+	BanTypeOwnerRegex = "ownerregex" // regular expression matching the owner name
+	BanTypeTitle      = "title"      // regular expression matching the title
+	BanTypeSession    = "session"    // session ID (or alias) at a host
+)
+
+// Refreshes that change the title to a banned one unlist the session with
+// this reason
+const BannedSessionReason = "This session is not allowed to be listed here"
+
+var hostBanNameRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Check a host ban pattern and bring it into its canonical form. A pattern is
+// a host name, a wildcard domain like *.example.com that matches all of its
+// subdomains, an IP address or an IPv4 or IPv6 CIDR range like 192.0.2.0/24.
+func NormalizeHostBan(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return "", fmt.Errorf("Invalid CIDR range %q", pattern)
+		}
+		return network.String(), nil
+	}
+
+	if ip := net.ParseIP(pattern); ip != nil {
+		return ip.String(), nil
+	}
+
+	name := strings.TrimPrefix(pattern, "*.")
+	if !hostBanNameRe.MatchString(name) {
+		return "", fmt.Errorf("Invalid host %q", pattern)
+	}
+	return pattern, nil
+}
+
+// Check if a host ban pattern matches the host name or address, or any of
+// the given addresses. Patterns that aren't valid, e.g. ones stored before
+// they were checked, only match the host exactly (ignoring case.)
+func HostBanMatches(pattern string, host string, addrs []net.IP) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if hostIp := net.ParseIP(host); hostIp != nil {
+		addrs = append([]net.IP{hostIp}, addrs...)
+	}
+
+	if strings.Contains(pattern, "/") {
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			for _, ip := range addrs {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	} else if ip := net.ParseIP(pattern); ip != nil {
+		for _, addr := range addrs {
+			if ip.Equal(addr) {
+				return true
+			}
+		}
+		return false
+	} else if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return host == pattern
+}
+
+// Check if any of the host ban patterns match, see HostBanMatches
+func AnyHostBanMatches(patterns []string, host string, addrs []net.IP) bool {
+	for _, pattern := range patterns {
+		if HostBanMatches(pattern, host, addrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a ban of any type and bring its host and pattern into their canonical
+// form. Host bans only have a host, session bans a host and a session ID as
+// the pattern, the other types only a pattern.
+func NormalizeBan(banType string, host string, pattern string) (string, string, error) {
+	host = strings.TrimSpace(host)
+	pattern = strings.TrimSpace(pattern)
+
+	switch banType {
+	case BanTypeHost:
+		if host == "" {
+			return "", "", fmt.Errorf("Host can't be blank")
+		}
+		host, err := NormalizeHostBan(host)
+		return host, "", err
+
+	case BanTypeOwner:
+		if pattern == "" {
+			return "", "", fmt.Errorf("Owner name can't be blank")
+		}
+		return "", pattern, nil
+
+	case BanTypeOwnerRegex, BanTypeTitle:
+		if pattern == "" {
+			return "", "", fmt.Errorf("Pattern can't be blank")
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return "", "", fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		return "", pattern, nil
+
+	case BanTypeSession:
+		if host == "" || pattern == "" {
+			return "", "", fmt.Errorf("Host and session ID can't be blank")
+		}
+		host, err := NormalizeHostBan(host)
+		return host, pattern, err
+
+	default:
+		return "", "", fmt.Errorf("Unknown ban type %q", banType)
+	}
+}
+
+// Ban patterns are matched case-insensitively
+func compileBanRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// Check if a ban other than a host ban matches an announced session. Bans
+// with broken patterns never match.
+func SessionBanMatches(banType string, banHost string, pattern string, session *SessionInfo) bool {
+	switch banType {
+	case BanTypeOwner:
+		return strings.EqualFold(pattern, session.Owner)
+	case BanTypeOwnerRegex:
+		re, err := compileBanRegex(pattern)
+		return err == nil && re.MatchString(session.Owner)
+	case BanTypeTitle:
+		re, err := compileBanRegex(pattern)
+		return err == nil && re.MatchString(session.Title)
+	case BanTypeSession:
+		return pattern == session.Id && HostBanMatches(banHost, session.Host, nil)
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNormalizeHostBan(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"Example.COM", "example.com"},
+		{" *.example.com ", "*.example.com"},
+		{"192.0.2.17/24", "192.0.2.0/24"},
+		{"2001:DB8::1/32", "2001:db8::/32"},
+		{"2001:0db8::0001", "2001:db8::1"},
+		{"*example.com", ""},
+		{"example.*.com", ""},
+		{"192.0.2.0/33", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		normalized, err := NormalizeHostBan(test.pattern)
+		if test.expected == "" && err == nil {
+			t.Errorf("%q: expected an error, got %q", test.pattern, normalized)
+		} else if test.expected != "" && normalized != test.expected {
+			t.Errorf("%q: expected %q, got %q (%v)", test.pattern, test.expected, normalized, err)
+		}
+	}
+}
+
+func TestHostBanMatches(t *testing.T) {
+	resolved := []net.IP{net.ParseIP("198.51.100.7")}
+
+	tests := []struct {
+		pattern string
+		host    string
+		addrs   []net.IP
+		matches bool
+	}{
+		{"example.com", "EXAMPLE.com", nil, true},
+		{"example.com", "www.example.com", nil, false},
+		{"*.example.com", "www.example.com", nil, true},
+		{"*.example.com", "example.com", nil, false},
+		{"*.example.com", "badexample.com", nil, false},
+		{"192.0.2.0/24", "192.0.2.55", nil, true},
+		{"192.0.2.0/24", "192.0.3.55", nil, false},
+		{"198.51.100.0/24", "example.com", resolved, true},
+		{"198.51.100.7", "example.com", resolved, true},
+		{"198.51.100.8", "example.com", resolved, false},
+		{"2001:db8::/32", "2001:db8:1::5", nil, true},
+		{"2001:db8::/32", "example.com", []net.IP{net.ParseIP("2001:db9::1")}, false},
+		{"192.0.2.0/24", "::ffff:192.0.2.1", nil, true},
+		{"not/valid", "not/valid", nil, true},
+	}
+
+	for _, test := range tests {
+		if HostBanMatches(test.pattern, test.host, test.addrs) != test.matches {
+			t.Errorf("%s against %s %v: expected %t", test.pattern, test.host, test.addrs, test.matches)
+		}
+	}
+}
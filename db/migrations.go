@@ -0,0 +1,452 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A numbered schema migration. Each database dialect has its own list of
+// statements. They are run in a single transaction, together with recording
+// the migration version in the migrations table.
+type migration struct {
+	version     int64
+	description string
+	sqlite      []string
+	postgres    []string
+}
+
+// Fresh databases are created with the baseline schema of each dialect, which
+// corresponds to this version. Migrations up to and including it are only
+// needed to upgrade existing databases and are recorded as applied right away.
+const baselineVersion = 4
+
+// All schema migrations, in order. Schema changes must be added to the end of
+// this list, with statements for every dialect.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+	},
+	{
+		version:     2,
+		description: "active drawing users",
+		sqlite: []string{
+			`ALTER TABLE sessions ADD active_drawing_users INTEGER NOT NULL DEFAULT -1`,
+		},
+	},
+	{
+		version:     3,
+		description: "allow web",
+		sqlite: []string{
+			`ALTER TABLE sessions ADD allow_web INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     4,
+		description: "remove roomcodes",
+		sqlite: []string{
+			`ALTER TABLE sessions RENAME TO sessions_old`,
+			`CREATE TABLE sessions (
+				id INTEGER PRIMARY KEY NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				protocol TEXT NOT NULL,
+				title TEXT NOT NULL,
+				users INTEGER NOT NULL,
+				usernames TEXT NOT NULL,
+				password INTEGER NOT NULL,
+				nsfm INTEGER NOT NULL,
+				owner TEXT NOT NULL,
+				started TEXT NOT NULL,
+				last_active TEXT NOT NULL,
+				unlisted INTEGER NOT NULL,
+				update_key TEXT NOT NULL,
+				client_ip TEXT NOT NULL,
+				unlist_reason TEXT,
+				max_users INTEGER NOT NULL,
+				closed INTEGER NOT NULL,
+				active_drawing_users INTEGER NOT NULL DEFAULT -1,
+				allow_web INTEGER NOT NULL DEFAULT 0
+				)`,
+			`INSERT INTO sessions SELECT
+				id, host, port, session_id, protocol, title, users, usernames, password,
+				nsfm, owner, started, last_active, unlisted, update_key, client_ip,
+				unlist_reason, max_users, closed, active_drawing_users, allow_web
+				FROM sessions_old`,
+			`DROP TABLE sessions_old`,
+		},
+	},
+	{
+		version:     5,
+		description: "session archive",
+		sqlite: []string{
+			`CREATE TABLE session_archive (
+				id INTEGER PRIMARY KEY NOT NULL,
+				listing_id INTEGER NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				protocol TEXT NOT NULL,
+				title TEXT NOT NULL,
+				users INTEGER NOT NULL,
+				max_users INTEGER NOT NULL,
+				password INTEGER NOT NULL,
+				nsfm INTEGER NOT NULL,
+				owner TEXT NOT NULL,
+				started TEXT NOT NULL,
+				last_active TEXT NOT NULL,
+				archived TEXT NOT NULL,
+				client_ip TEXT NOT NULL,
+				unlist_reason TEXT NOT NULL,
+				kicked INTEGER NOT NULL
+				)`,
+			`CREATE INDEX session_archive_last_active_idx ON session_archive (last_active)`,
+		},
+		postgres: []string{
+			`CREATE TABLE session_archive (
+				id BIGSERIAL PRIMARY KEY NOT NULL,
+				listing_id BIGINT NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				protocol TEXT NOT NULL,
+				title TEXT NOT NULL,
+				users INTEGER NOT NULL,
+				max_users INTEGER NOT NULL,
+				password BOOLEAN NOT NULL,
+				nsfm BOOLEAN NOT NULL,
+				owner TEXT NOT NULL,
+				started TIMESTAMPTZ NOT NULL,
+				last_active TIMESTAMPTZ NOT NULL,
+				archived TIMESTAMPTZ NOT NULL,
+				client_ip TEXT NOT NULL,
+				unlist_reason TEXT NOT NULL,
+				kicked BOOLEAN NOT NULL
+				)`,
+			`CREATE INDEX session_archive_last_active_idx ON session_archive (last_active)`,
+		},
+	},
+	{
+		version:     6,
+		description: "backup access",
+		sqlite: []string{
+			// SQLite doesn't allow adding a foreign key column with a default value
+			`ALTER TABLE roles ADD access_backups INTEGER NOT NULL DEFAULT 0`,
+		},
+		postgres: []string{
+			`ALTER TABLE roles ADD access_backups INTEGER NOT NULL DEFAULT 0 REFERENCES accesslevels (id)`,
+		},
+	},
+	{
+		version:     7,
+		description: "session overlays",
+		sqlite: []string{
+			`CREATE TABLE session_overlays (
+				id INTEGER PRIMARY KEY NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				unlisted INTEGER NOT NULL,
+				unlist_reason TEXT NOT NULL,
+				nsfm INTEGER NOT NULL,
+				updated TEXT NOT NULL,
+				UNIQUE (host, port, session_id)
+				)`,
+		},
+		postgres: []string{
+			`CREATE TABLE session_overlays (
+				id BIGSERIAL PRIMARY KEY NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				unlisted BOOLEAN NOT NULL,
+				unlist_reason TEXT NOT NULL,
+				nsfm BOOLEAN NOT NULL,
+				updated TIMESTAMPTZ NOT NULL,
+				UNIQUE (host, port, session_id)
+				)`,
+		},
+	},
+	{
+		version:     8,
+		description: "ban types",
+		sqlite: []string{
+			`ALTER TABLE hostbans ADD kind TEXT NOT NULL DEFAULT 'host'`,
+			`ALTER TABLE hostbans ADD pattern TEXT NOT NULL DEFAULT ''`,
+		},
+		postgres: []string{
+			`ALTER TABLE hostbans ADD kind TEXT NOT NULL DEFAULT 'host'`,
+			`ALTER TABLE hostbans ADD pattern TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     9,
+		description: "title filters",
+		sqlite: []string{
+			`CREATE TABLE title_filters (
+				id INTEGER PRIMARY KEY NOT NULL,
+				kind TEXT NOT NULL,
+				pattern TEXT NOT NULL,
+				action TEXT NOT NULL,
+				notes TEXT NOT NULL
+				)`,
+			`ALTER TABLE sessions ADD flagged TEXT NOT NULL DEFAULT ''`,
+		},
+		postgres: []string{
+			`CREATE TABLE title_filters (
+				id BIGSERIAL PRIMARY KEY NOT NULL,
+				kind TEXT NOT NULL,
+				pattern TEXT NOT NULL,
+				action TEXT NOT NULL,
+				notes TEXT NOT NULL
+				)`,
+			`ALTER TABLE sessions ADD flagged TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     10,
+		description: "pending sessions",
+		sqlite: []string{
+			`ALTER TABLE sessions ADD pending INTEGER NOT NULL DEFAULT 0`,
+		},
+		postgres: []string{
+			`ALTER TABLE sessions ADD pending BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version:     11,
+		description: "session reports",
+		sqlite: []string{
+			`CREATE TABLE session_reports (
+				id INTEGER PRIMARY KEY NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				included INTEGER NOT NULL,
+				title TEXT NOT NULL,
+				owner TEXT NOT NULL,
+				category TEXT NOT NULL,
+				message TEXT NOT NULL,
+				client_ip TEXT NOT NULL,
+				reported TEXT NOT NULL,
+				resolved TEXT,
+				resolved_by TEXT NOT NULL,
+				resolution TEXT NOT NULL
+				)`,
+		},
+		postgres: []string{
+			`CREATE TABLE session_reports (
+				id BIGSERIAL PRIMARY KEY NOT NULL,
+				host TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				session_id TEXT NOT NULL,
+				included BOOLEAN NOT NULL,
+				title TEXT NOT NULL,
+				owner TEXT NOT NULL,
+				category TEXT NOT NULL,
+				message TEXT NOT NULL,
+				client_ip TEXT NOT NULL,
+				reported TIMESTAMPTZ NOT NULL,
+				resolved TIMESTAMPTZ,
+				resolved_by TEXT NOT NULL,
+				resolution TEXT NOT NULL
+				)`,
+		},
+	},
+	{
+		version:     12,
+		description: "audit log",
+		sqlite: []string{
+			`ALTER TABLE roles ADD access_audit INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE audit_log (
+				id INTEGER PRIMARY KEY NOT NULL,
+				logged TEXT NOT NULL,
+				user_id INTEGER NOT NULL,
+				user_name TEXT NOT NULL,
+				action TEXT NOT NULL,
+				target_ids TEXT NOT NULL,
+				before_values TEXT NOT NULL,
+				after_values TEXT NOT NULL,
+				client_ip TEXT NOT NULL
+				)`,
+		},
+		postgres: []string{
+			`ALTER TABLE roles ADD access_audit INTEGER NOT NULL DEFAULT 0 REFERENCES accesslevels (id)`,
+			`CREATE TABLE audit_log (
+				id BIGSERIAL PRIMARY KEY NOT NULL,
+				logged TIMESTAMPTZ NOT NULL,
+				user_id BIGINT NOT NULL,
+				user_name TEXT NOT NULL,
+				action TEXT NOT NULL,
+				target_ids BIGINT[] NOT NULL,
+				before_values TEXT NOT NULL,
+				after_values TEXT NOT NULL,
+				client_ip TEXT NOT NULL
+				)`,
+		},
+	},
+}
+
+func init() {
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			panic(fmt.Sprintf("Migration %d registered out of order", m.version))
+		}
+	}
+}
+
+func latestSchemaVersion() int64 {
+	return migrations[len(migrations)-1].version
+}
+
+// Implemented by each database backend that has a schema
+type migrator interface {
+	// Run f while holding a lock that keeps other list servers from
+	// migrating the same database at the same time. Backends without a lock
+	// that lasts across transactions must make initSchema and applyMigration
+	// skip work that has been done in the meantime instead.
+	lock(f func() error) error
+	// Versions of the migrations applied so far.
+	// Returns nil if the database hasn't been initialized.
+	appliedMigrations() (map[int64]bool, error)
+	// Create the baseline schema, recording migrations up to baselineVersion
+	initSchema() error
+	// Run the migration's statements in a transaction and record it
+	applyMigration(m *migration) error
+}
+
+// Returned when the database has migrations that this version of the
+// list server doesn't know about.
+type SchemaTooNewError struct {
+	Version int64
+}
+
+func (e SchemaTooNewError) Error() string {
+	return fmt.Sprintf(
+		"Database schema version %d is newer than the latest version %d supported by this listserver",
+		e.Version, latestSchemaVersion())
+}
+
+// Returned by QueryMigrationStatus if the database doesn't exist yet or has
+// no schema
+var ErrNotInitialized = errors.New("Database is not initialized")
+
+type MigrationInfo struct {
+	Version     int64
+	Description string
+	Applied     bool
+}
+
+func checkSchemaVersion(applied map[int64]bool) error {
+	latest := latestSchemaVersion()
+	for version := range applied {
+		if version > latest {
+			return SchemaTooNewError{version}
+		}
+	}
+	return nil
+}
+
+func migrationStatus(m migrator) ([]MigrationInfo, error) {
+	applied, err := m.appliedMigrations()
+	if err != nil {
+		return nil, err
+	} else if applied == nil {
+		return nil, ErrNotInitialized
+	}
+
+	infos := make([]MigrationInfo, 0, len(migrations))
+	for _, mig := range migrations {
+		infos = append(infos, MigrationInfo{
+			Version:     mig.version,
+			Description: mig.description,
+			Applied:     applied[mig.version],
+		})
+	}
+
+	latest := latestSchemaVersion()
+	for version := range applied {
+		if version > latest {
+			infos = append(infos, MigrationInfo{
+				Version:     version,
+				Description: "(unknown, newer than this listserver)",
+				Applied:     true,
+			})
+		}
+	}
+
+	return infos, nil
+}
+
+// Bring the database schema up to date. Several list servers may be started
+// on the same database at once, so the whole run holds the migration lock
+// and only looks at which migrations have been applied once it has it. Each
+// migration is committed on its own, so one that fails leaves the ones before
+// it applied.
+func migrateSchema(m migrator) error {
+	return m.lock(func() error {
+		return migrateLocked(m)
+	})
+}
+
+func migrateLocked(m migrator) error {
+	applied, err := m.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	if applied == nil {
+		log.Println("Initializing database")
+		if err := m.initSchema(); err != nil {
+			return fmt.Errorf("Error initializing database: %s", err.Error())
+		}
+		if applied, err = m.appliedMigrations(); err != nil {
+			return err
+		}
+	}
+
+	if err := checkSchemaVersion(applied); err != nil {
+		return err
+	}
+
+	for i := range migrations {
+		mig := &migrations[i]
+		if !applied[mig.version] {
+			log.Printf("Applying database migration %d: %s\n", mig.version, mig.description)
+			if err := m.applyMigration(mig); err != nil {
+				return fmt.Errorf("Error applying database migration %d: %s", mig.version, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get the migration status of the given database without changing it. The
+// database is opened read-only, so one that doesn't exist isn't created.
+func QueryMigrationStatus(dbname string) ([]MigrationInfo, error) {
+	var infos []MigrationInfo
+	err := withMigrator(dbname, true, func(m migrator) error {
+		var err error
+		infos, err = migrationStatus(m)
+		return err
+	})
+	return infos, err
+}
+
+// Apply all pending migrations to the given database
+func ApplyMigrations(dbname string) error {
+	return withMigrator(dbname, false, migrateSchema)
+}
+
+func withMigrator(dbname string, readOnly bool, f func(m migrator) error) error {
+	if dbname == "" || dbname == "memory" {
+		return fmt.Errorf("Database '%s' has no schema to migrate", dbname)
+	} else if isPostgresUrl(dbname) {
+		return withPostgresMigrator(dbname, readOnly, f)
+	} else {
+		return withSqliteMigrator(dbname, readOnly, f)
+	}
+}
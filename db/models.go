@@ -57,9 +57,25 @@ type NewSessionInfo struct {
 
 // Session list querying options
 type QueryOptions struct {
-	Title    string // filter by title
-	Nsfm     bool   // show NSFM sessions
-	Protocol string // filter by protocol version (comma separated list accepted)
+	Title      string // filter by title
+	Nsfm       bool   // show NSFM sessions
+	Protocol   string // filter by protocol version (comma separated list accepted)
+	NoPassword bool   // hide password protected sessions
+	NoClosed   bool   // hide sessions closed to new users
+	NoFull     bool   // hide sessions where users >= maxusers
+	WebOnly    bool   // show only sessions that allow joining via WebSocket
+	MinUsers   int    // minimum user count, zero means no minimum
+	MaxUsers   int    // maximum user count, zero means no maximum
+	Owner      string // filter by owner name (case insensitive)
+	Host       string // filter by host (case insensitive)
+	Sort       string // one of the Sort* keys, title by default
+	Descending bool   // reverse the sort order
+
+	// Page of the sorted list to return. These are applied with
+	// PageSessionList after merging the database and included server
+	// sessions, so that the total count is known.
+	Limit  int // zero means no limit
+	Offset int
 }
 
 type AdminSession struct {
@@ -87,18 +103,123 @@ type AdminSession struct {
 	Closed             bool     `json:"closed"`
 	Included           bool     `json:"included"`
 	Error              string   `json:"error,omitempty"`
+	OverlayId          int64    `json:"overlayid,omitempty"` // moderation overlay of an included session
+	Flagged            string   `json:"flagged,omitempty"`   // why the title filter flagged it for review
+	Pending            bool     `json:"pending,omitempty"`   // waiting for approval by an admin
 	ActiveDrawingUsers int      `json:"activedrawingusers"`
 	AllowWeb           bool     `json:"allowweb,omitempty"`
 }
 
+// A session that was removed from the list by the periodic cleanup
+type ArchivedSession struct {
+	Id           int64  `json:"id"`
+	ListingId    int64  `json:"listingid"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	SessionId    string `json:"sessionid"`
+	Protocol     string `json:"protocol"`
+	Title        string `json:"title"`
+	Users        int    `json:"users"`
+	MaxUsers     int    `json:"maxusers,omitempty"`
+	Password     bool   `json:"password"`
+	Nsfm         bool   `json:"nsfm"`
+	Owner        string `json:"owner"`
+	Started      string `json:"started"`
+	LastActive   string `json:"lastactive"`
+	Archived     string `json:"archived"`
+	ClientIp     string `json:"clientip"`
+	UnlistReason string `json:"unlistreason"`
+	Kicked       bool   `json:"kicked"`
+}
+
+// Session archive search options. Empty fields are not filtered on.
+type ArchiveQueryOptions struct {
+	Host   string // filter by host (case insensitive)
+	Owner  string // filter by owner name (case insensitive)
+	Title  string // filter by title substring
+	From   string // sessions active on or after this date (YYYY-MM-DD)
+	To     string // sessions started on or before this date (YYYY-MM-DD)
+	Limit  int
+	Offset int
+}
+
 type AdminHostBan struct {
 	Id      int64  `json:"id"`
-	Host    string `json:"host"`
+	Type    string `json:"type"`
+	Host    string `json:"host,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
 	Expires string `json:"expires,omitempty"`
 	Active  bool   `json:"active"`
 	Notes   string `json:"notes,omitempty"`
 }
 
+// Moderation of a session on an included server. Those sessions can't be
+// changed like announced ones, so the changes are applied on top of them
+// whenever they're listed.
+type SessionOverlay struct {
+	Id           int64  `json:"id"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	SessionId    string `json:"sessionid"`
+	Unlisted     bool   `json:"unlisted"`
+	UnlistReason string `json:"unlistreason"`
+	Nsfm         bool   `json:"nsfm"`
+	Updated      string `json:"updated"` // last change, in UTC
+}
+
+// A rule of the title filter. The types and actions are the ones of the
+// titlefilter package.
+type TitleFilter struct {
+	Id      int64  `json:"id"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Notes   string `json:"notes,omitempty"`
+}
+
+// A report about a listed session, made by someone viewing the list. The
+// title and owner are the ones the session had when it was reported.
+type SessionReport struct {
+	Id         int64  `json:"id"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	SessionId  string `json:"sessionid"`
+	Included   bool   `json:"included"` // the session is from an included server
+	Title      string `json:"title"`
+	Owner      string `json:"owner"`
+	Category   string `json:"category"`
+	Message    string `json:"message"`
+	ClientIp   string `json:"clientip"`
+	Reported   string `json:"reported"`           // in UTC
+	Resolved   string `json:"resolved,omitempty"` // in UTC, empty while the report is open
+	ResolvedBy string `json:"resolvedby,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// A change made through the admin API. Before and after hold the changed
+// values as JSON, they are left out when there's nothing to show.
+type AuditEntry struct {
+	Id        int64           `json:"id"`
+	Logged    string          `json:"logged"` // in UTC
+	UserId    int64           `json:"userid"` // 0 for the admin user from the environment
+	UserName  string          `json:"username"`
+	Action    string          `json:"action"`
+	TargetIds []int64         `json:"targetids"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	ClientIp  string          `json:"clientip"`
+}
+
+type AuditQueryOptions struct {
+	User     string // filter by user name (case insensitive)
+	Action   string // filter by action, or a group of actions like "bans"
+	TargetId int64  // filter by target id, if not 0
+	From     string // entries logged on or after this date (YYYY-MM-DD)
+	To       string // entries logged on or before this date (YYYY-MM-DD)
+	Limit    int
+	Offset   int
+}
+
 type AdminRole struct {
 	Id             int64  `json:"id"`
 	Name           string `json:"name"`
@@ -107,6 +228,8 @@ type AdminRole struct {
 	AccessHostBans int    `json:"accesshostbans"`
 	AccessRoles    int    `json:"accessroles"`
 	AccessUsers    int    `json:"accessusers"`
+	AccessBackups  int    `json:"accessbackups"`
+	AccessAudit    int    `json:"accessaudit"`
 	Used           bool   `json:"used"`
 }
 
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Overlays by host, port and session ID
+type SessionOverlayIndex map[string]*SessionOverlay
+
+func sessionOverlayKey(host string, port int, sessionId string) string {
+	return fmt.Sprintf("%s-%d-%s", strings.ToLower(host), port, sessionId)
+}
+
+func NewSessionOverlayIndex(overlays []SessionOverlay) SessionOverlayIndex {
+	index := make(SessionOverlayIndex, len(overlays))
+	for i := range overlays {
+		o := &overlays[i]
+		index[sessionOverlayKey(o.Host, o.Port, o.SessionId)] = o
+	}
+	return index
+}
+
+// Returns nil if there's no overlay for the session
+func (index SessionOverlayIndex) Find(host string, port int, sessionId string) *SessionOverlay {
+	return index[sessionOverlayKey(host, port, sessionId)]
+}
+
+// Apply the overlays to a list of included sessions, dropping unlisted ones
+func (index SessionOverlayIndex) Apply(sessions []SessionInfo) []SessionInfo {
+	if len(index) == 0 {
+		return sessions
+	}
+
+	applied := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		if o := index.Find(s.Host, s.Port, s.Id); o != nil {
+			if o.Unlisted {
+				continue
+			}
+			if o.Nsfm {
+				s.Nsfm = true
+			}
+		}
+		applied = append(applied, s)
+	}
+	return applied
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"sort"
+)
+
+// Reports about the same session, so that they can be dealt with at once
+type SessionReportGroup struct {
+	Host       string         `json:"host"`
+	Port       int            `json:"port"`
+	SessionId  string         `json:"sessionid"`
+	Included   bool           `json:"included"`
+	Title      string         `json:"title"` // as of the latest report
+	Owner      string         `json:"owner"`
+	Count      int            `json:"count"`
+	Categories map[string]int `json:"categories"` // number of reports per category
+	First      string         `json:"first"`
+	Last       string         `json:"last"`
+	ReportIds  []int64        `json:"reportids"`
+}
+
+// Group reports by host, port and session ID. The most reported sessions come
+// first, ties are broken by the latest report.
+func GroupSessionReports(reports []SessionReport) []SessionReportGroup {
+	groups := []SessionReportGroup{}
+	index := map[string]int{}
+
+	for _, r := range reports {
+		key := sessionOverlayKey(r.Host, r.Port, r.SessionId)
+		i, found := index[key]
+		if !found {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, SessionReportGroup{
+				Host:       r.Host,
+				Port:       r.Port,
+				SessionId:  r.SessionId,
+				Included:   r.Included,
+				Categories: map[string]int{},
+				First:      r.Reported,
+				Last:       r.Reported,
+				ReportIds:  []int64{},
+			})
+		}
+
+		g := &groups[i]
+		g.Count++
+		g.Categories[r.Category]++
+		g.ReportIds = append(g.ReportIds, r.Id)
+		if r.Reported < g.First {
+			g.First = r.Reported
+		}
+		if r.Reported >= g.Last {
+			g.Last = r.Reported
+			g.Title = r.Title
+			g.Owner = r.Owner
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Last > groups[j].Last
+	})
+
+	return groups
+}
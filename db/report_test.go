@@ -0,0 +1,41 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupSessionReports(t *testing.T) {
+	reports := []SessionReport{
+		{Id: 1, Host: "example.com", Port: 27750, SessionId: "a", Title: "Old", Category: "title", Reported: "2024-01-01 10:00:00"},
+		{Id: 2, Host: "example.com", Port: 27750, SessionId: "b", Title: "B", Category: "spam", Reported: "2024-01-01 12:00:00"},
+		{Id: 3, Host: "Example.com", Port: 27750, SessionId: "a", Title: "New", Category: "title", Reported: "2024-01-01 11:00:00"},
+		{Id: 4, Host: "example.com", Port: 27751, SessionId: "a", Title: "C", Category: "nsfm", Reported: "2024-01-01 13:00:00"},
+		{Id: 5, Host: "example.com", Port: 27750, SessionId: "a", Title: "New", Category: "nsfm", Reported: "2024-01-01 09:00:00"},
+	}
+
+	groups := GroupSessionReports(reports)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %+v", groups)
+	}
+
+	expected := SessionReportGroup{
+		Host:       "example.com",
+		Port:       27750,
+		SessionId:  "a",
+		Title:      "New",
+		Count:      3,
+		Categories: map[string]int{"title": 2, "nsfm": 1},
+		First:      "2024-01-01 09:00:00",
+		Last:       "2024-01-01 11:00:00",
+		ReportIds:  []int64{1, 3, 5},
+	}
+	if !reflect.DeepEqual(groups[0], expected) {
+		t.Errorf("Expected %+v, got %+v", expected, groups[0])
+	}
+
+	// Single reports are ordered by the time they were made
+	if groups[1].Port != 27751 || groups[2].SessionId != "b" {
+		t.Errorf("Wrong order of single reports: %+v", groups[1:])
+	}
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session list sort keys
+const (
+	SortTitle    = "title"
+	SortUsers    = "users"
+	SortStarted  = "started"
+	SortActivity = "activity" // number of actively drawing users
+)
+
+func IsValidSortKey(key string) bool {
+	return key == "" || key == SortTitle || key == SortUsers || key == SortStarted || key == SortActivity
+}
+
+// Included servers and the database backends don't all use the same format
+func parseStarted(s string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareSessions(a, b *SessionInfo, key string) int {
+	c := 0
+	switch key {
+	case SortUsers:
+		c = compareInts(a.Users, b.Users)
+	case SortStarted:
+		c = parseStarted(a.Started).Compare(parseStarted(b.Started))
+	case SortActivity:
+		c = compareInts(a.ActiveDrawingUsers, b.ActiveDrawingUsers)
+	}
+
+	// Ties are broken by title and user count like in the default order, then
+	// by the session address so that pages don't overlap
+	if c == 0 {
+		c = strings.Compare(a.Title, b.Title)
+	}
+	if c == 0 {
+		c = compareInts(a.Users, b.Users)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Host, b.Host)
+	}
+	if c == 0 {
+		c = compareInts(a.Port, b.Port)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Id, b.Id)
+	}
+	return c
+}
+
+// Sort a session list in the order given by the query options. Every session
+// has a unique position, so the order is the same for every request.
+func SortSessionList(sessions []SessionInfo, opts QueryOptions) {
+	sort.Slice(sessions, func(i, j int) bool {
+		c := compareSessions(&sessions[i], &sessions[j], opts.Sort)
+		if opts.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+// Get the requested page of a sorted session list
+func PageSessionList(sessions []SessionInfo, opts QueryOptions) []SessionInfo {
+	if opts.Offset >= len(sessions) {
+		return []SessionInfo{}
+	}
+	sessions = sessions[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(sessions) {
+		sessions = sessions[:opts.Limit]
+	}
+	return sessions
+}
+
+// Check the password, closed, full, web, user count, owner and host filters.
+// Matches also checks the title, NSFM and protocol filters.
+func (opts *QueryOptions) MatchesFilters(info *SessionInfo) bool {
+	return !(opts.NoPassword && info.Password) &&
+		!(opts.NoClosed && info.Closed) &&
+		!(opts.NoFull && info.MaxUsers > 0 && info.Users >= info.MaxUsers) &&
+		!(opts.WebOnly && !info.AllowWeb) &&
+		(opts.MinUsers <= 0 || info.Users >= opts.MinUsers) &&
+		(opts.MaxUsers <= 0 || info.Users <= opts.MaxUsers) &&
+		(opts.Owner == "" || strings.EqualFold(info.Owner, opts.Owner)) &&
+		(opts.Host == "" || strings.EqualFold(info.Host, opts.Host))
+}
+
+// Check all filters of the query options, the same way the database
+// backends do, for sessions that didn't come from a query
+func (opts *QueryOptions) Matches(info *SessionInfo) bool {
+	if len(opts.Title) > 0 && !strings.Contains(strings.ToLower(info.Title), strings.ToLower(opts.Title)) {
+		return false
+	}
+
+	if !opts.Nsfm && info.Nsfm {
+		return false
+	}
+
+	if len(opts.Protocol) > 0 {
+		found := false
+		for _, p := range strings.Split(opts.Protocol, ",") {
+			if info.Protocol == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return opts.MatchesFilters(info)
+}
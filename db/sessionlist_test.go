@@ -0,0 +1,90 @@
+package db
+
+import (
+	"testing"
+)
+
+func sessionIds(sessions []SessionInfo) string {
+	ids := ""
+	for _, s := range sessions {
+		ids += s.Id
+	}
+	return ids
+}
+
+func TestSortAndPageSessionList(t *testing.T) {
+	sessions := []SessionInfo{
+		{Host: "b.com", Id: "a", Title: "Same", Users: 3, Started: "2020-01-03T10:00:00Z", ActiveDrawingUsers: 1},
+		{Host: "a.com", Id: "b", Title: "Same", Users: 3, Started: "2020-01-01 10:00:00", ActiveDrawingUsers: -1},
+		{Host: "a.com", Id: "c", Title: "Alpha", Users: 5, Started: "2020-01-02T10:00:00Z", ActiveDrawingUsers: 2},
+		{Host: "a.com", Id: "d", Title: "Zulu", Users: 1, Started: "2020-01-04T10:00:00Z", ActiveDrawingUsers: 0},
+	}
+
+	tests := []struct {
+		opts     QueryOptions
+		expected string
+	}{
+		{QueryOptions{}, "cbad"},
+		{QueryOptions{Descending: true}, "dabc"},
+		{QueryOptions{Sort: SortUsers}, "dbac"},
+		{QueryOptions{Sort: SortUsers, Descending: true}, "cabd"},
+		{QueryOptions{Sort: SortStarted}, "bcad"},
+		{QueryOptions{Sort: SortActivity, Descending: true}, "cadb"},
+	}
+
+	for _, test := range tests {
+		SortSessionList(sessions, test.opts)
+		if ids := sessionIds(sessions); ids != test.expected {
+			t.Errorf("Sort %+v: expected %s, got %s", test.opts, test.expected, ids)
+		}
+	}
+
+	SortSessionList(sessions, QueryOptions{})
+	pages := []struct {
+		limit, offset int
+		expected      string
+	}{
+		{0, 0, "cbad"},
+		{2, 0, "cb"},
+		{2, 2, "ad"},
+		{2, 3, "d"},
+		{0, 1, "bad"},
+		{1, 4, ""},
+		{1, 10, ""},
+	}
+
+	for _, page := range pages {
+		result := PageSessionList(sessions, QueryOptions{Limit: page.limit, Offset: page.offset})
+		if ids := sessionIds(result); ids != page.expected {
+			t.Errorf("Page %d+%d: expected %s, got %s", page.offset, page.limit, page.expected, ids)
+		}
+	}
+}
+
+func TestQueryOptionsMatches(t *testing.T) {
+	session := SessionInfo{
+		Host: "Example.com", Title: "Hello World", Protocol: "dp:4.24.0",
+		Users: 3, MaxUsers: 5, Owner: "Alice", Nsfm: true,
+	}
+
+	tests := []struct {
+		opts     QueryOptions
+		expected bool
+	}{
+		{QueryOptions{}, false},
+		{QueryOptions{Nsfm: true}, true},
+		{QueryOptions{Nsfm: true, Title: "world"}, true},
+		{QueryOptions{Nsfm: true, Title: "moon"}, false},
+		{QueryOptions{Nsfm: true, Protocol: "dp:4.21.2,dp:4.24.0"}, true},
+		{QueryOptions{Nsfm: true, Protocol: "dp:4.21.2"}, false},
+		{QueryOptions{Nsfm: true, Owner: "alice", Host: "example.com"}, true},
+		{QueryOptions{Nsfm: true, MinUsers: 4}, false},
+		{QueryOptions{Nsfm: true, NoFull: true}, true},
+	}
+
+	for _, test := range tests {
+		if matches := test.opts.Matches(&session); matches != test.expected {
+			t.Errorf("Options %+v: expected %v, got %v", test.opts, test.expected, matches)
+		}
+	}
+}
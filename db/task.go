@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Runs a function periodically in the background until stopped
+type periodicTask struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Returns nil if the interval is zero, which disables the task
+func startPeriodicTask(interval time.Duration, run func(ctx context.Context)) *periodicTask {
+	if interval <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &periodicTask{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(task.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				run(ctx)
+			}
+		}
+	}()
+
+	return task
+}
+
+// Stop the task and wait for a running invocation to finish
+func (t *periodicTask) stop() {
+	if t != nil {
+		t.cancel()
+		<-t.done
+	}
+}
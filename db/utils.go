@@ -3,6 +3,7 @@ package db
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"time"
 )
 
 func generateUpdateKey() (string, error) {
@@ -50,3 +51,12 @@ func optBool(fields map[string]interface{}, name string) (bool, bool) {
 	}
 	return false, false
 }
+
+// The day after the given YYYY-MM-DD date, for use as an exclusive upper bound
+func nextDate(date string) (string, error) {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "", err
+	}
+	return t.AddDate(0, 0, 1).Format("2006-01-02"), nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -15,6 +17,7 @@ import (
 	"github.com/drawpile/listserver/db"
 	"github.com/drawpile/listserver/drawpile"
 	"github.com/drawpile/listserver/inclsrv"
+	"github.com/drawpile/listserver/titlefilter"
 	"github.com/drawpile/listserver/validation"
 	"github.com/gorilla/mux"
 )
@@ -23,7 +26,7 @@ var nameRe = regexp.MustCompile(`\A[a-z0-9_]+\z`)
 
 func serverInfo(ctx apiContext) map[string]interface{} {
 	readonly := len(ctx.cfg.Database) == 0
-	return map[string]interface{}{
+	info := map[string]interface{}{
 		"api_name":    apiName,
 		"version":     apiVersion,
 		"name":        ctx.cfg.Name,
@@ -34,6 +37,12 @@ func serverInfo(ctx apiContext) map[string]interface{} {
 		"public":      ctx.cfg.Public,
 		"private":     false,
 	}
+	if ctx.cfg.HasIncludes() {
+		total, available := inclsrv.CountAvailable()
+		info["included_servers"] = total
+		info["included_servers_available"] = available
+	}
+	return info
 }
 
 // Return info about this list server
@@ -42,38 +51,120 @@ func apiRootHandler(r *http.Request) http.Handler {
 	return JsonResponseOk(serverInfo(ctx))
 }
 
-// Return the session list
-func apiSessionListHandler(r *http.Request) http.Handler {
-	ctx := r.Context().Value(apiCtxKey).(apiContext)
-	if !ctx.cfg.Public && len(ctx.cfg.IncludeServers) == 0 {
-		return ErrorResponse("No public listings on this server", http.StatusNotFound)
-	}
-
+// Parse the filter and sort parameters shared by the session list and events
+func parseSessionQueryOptions(r *http.Request) (db.QueryOptions, error) {
 	if err := r.ParseForm(); err != nil {
-		return ErrorResponse("Bad request", http.StatusBadRequest)
+		return db.QueryOptions{}, fmt.Errorf("Bad request")
 	}
 
 	opts := db.QueryOptions{
-		Title:    r.Form.Get("title"),
-		Nsfm:     r.Form.Get("nsfm") == "true",
-		Protocol: r.Form.Get("protocol"),
+		Title:      r.Form.Get("title"),
+		Nsfm:       r.Form.Get("nsfm") == "true",
+		Protocol:   r.Form.Get("protocol"),
+		NoPassword: r.Form.Get("password") == "false",
+		NoClosed:   r.Form.Get("closed") == "false",
+		NoFull:     r.Form.Get("full") == "false",
+		WebOnly:    r.Form.Get("allowweb") == "true",
+		Owner:      strings.TrimSpace(r.Form.Get("owner")),
+		Host:       strings.TrimSpace(r.Form.Get("host")),
+		Sort:       r.Form.Get("sort"),
+	}
+
+	if minUsers := r.Form.Get("minusers"); minUsers != "" {
+		value, err := strconv.Atoi(minUsers)
+		if err != nil || value < 0 {
+			return opts, fmt.Errorf("Invalid minimum user count")
+		}
+		opts.MinUsers = value
+	}
+
+	if maxUsers := r.Form.Get("maxusers"); maxUsers != "" {
+		value, err := strconv.Atoi(maxUsers)
+		if err != nil || value < 1 {
+			return opts, fmt.Errorf("Invalid maximum user count")
+		}
+		opts.MaxUsers = value
+	}
+
+	if !db.IsValidSortKey(opts.Sort) {
+		return opts, fmt.Errorf("Sort must be one of title, users, started or activity")
+	}
+
+	switch r.Form.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("Order must be asc or desc")
+	}
+
+	if limit := r.Form.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return opts, fmt.Errorf("Limit must be a positive number")
+		}
+		opts.Limit = value
 	}
 
+	if offset := r.Form.Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return opts, fmt.Errorf("Invalid offset")
+		}
+		opts.Offset = value
+	}
+
+	return opts, nil
+}
+
+// Get the sorted session list from the database merged with the included
+// servers. Returns nil if neither is configured. For requests from other list
+// servers, only the sessions that didn't come from a list server are returned.
+func querySessionList(ctx apiContext, opts db.QueryOptions, federation bool, reqCtx context.Context) ([]db.SessionInfo, error) {
 	var list []db.SessionInfo
-	var err error
+	var overlays []db.SessionOverlay
 	if ctx.db != nil {
-		list, err = ctx.db.QuerySessionList(opts, r.Context())
+		var err error
+		list, err = ctx.db.QuerySessionList(opts, reqCtx)
 		if err != nil {
-			log.Println("Session list query error:", err)
-			return ErrorResponse("An error occurred while querying session list", http.StatusInternalServerError)
+			return nil, err
+		}
+		if ctx.cfg.HasIncludes() {
+			overlays, err = ctx.db.QuerySessionOverlays(reqCtx)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if len(ctx.cfg.IncludeServers) > 0 {
+	if ctx.cfg.HasIncludes() {
 		list = inclsrv.MergeLists(
 			list,
-			inclsrv.FetchFilteredSessionLists(opts, ctx.cfg.IncludeServers...),
+			inclsrv.CachedSessionLists(opts, federation, db.NewSessionOverlayIndex(overlays)),
 		)
+		db.SortSessionList(list, opts)
+	}
+
+	return list, nil
+}
+
+// Return the session list
+func apiSessionListHandler(r *http.Request) http.Handler {
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	if !ctx.cfg.Public && !ctx.cfg.HasIncludes() {
+		return ErrorResponse("No public listings on this server", http.StatusNotFound)
+	}
+
+	opts, err := parseSessionQueryOptions(r)
+	if err != nil {
+		return ErrorResponse(err.Error(), http.StatusBadRequest)
+	}
+
+	federation := r.Header.Get(inclsrv.FederationHeader) != ""
+	list, err := querySessionList(ctx, opts, federation, r.Context())
+	if err != nil {
+		log.Println("Session list query error:", err)
+		return ErrorResponse("An error occurred while querying session list", http.StatusInternalServerError)
 	}
 
 	if list == nil {
@@ -81,14 +172,32 @@ func apiSessionListHandler(r *http.Request) http.Handler {
 		return ErrorResponse("Server is misconfigured", http.StatusInternalServerError)
 	}
 
-	return JsonResponseOk(list)
+	// The body stays a bare array for older clients, so the total goes in a header
+	return JsonResponseOk(db.PageSessionList(list, opts)).
+		WithHeader("X-Total-Count", strconv.Itoa(len(list))).
+		WithHeader("Cache-Control", sessionListCacheControl(ctx.cfg)).
+		WithHeader("Vary", inclsrv.FederationHeader).
+		WithValidators(ctx.changes.lastModified(time.Now()))
+}
+
+// Without a database, the list only changes when the included servers are
+// fetched again. Otherwise, announcements show up right away, so clients
+// should always revalidate. Stale lists can be shown for up to a session
+// timeout if the server is unreachable, since sessions would be listed at
+// least that long anyway.
+func sessionListCacheControl(cfg *config) string {
+	maxAge := 0
+	if len(cfg.Database) == 0 {
+		maxAge = cfg.IncludeCacheTtl
+	}
+	return fmt.Sprintf("public, max-age=%d, stale-if-error=%d", maxAge, cfg.SessionTimeout*60)
 }
 
 // Announce a new session
 func apiAnnounceSessionHandler(r *http.Request) http.Handler {
 	clientIP := parseIp(r.RemoteAddr)
 
-	if clientIP.IsUnspecified() {
+	if clientIP == nil || clientIP.IsUnspecified() {
 		log.Println("Couldn't parse IP address:", r.RemoteAddr)
 		return ErrorResponse("Server is misconfigured", http.StatusInternalServerError)
 	}
@@ -115,7 +224,8 @@ func apiAnnounceSessionHandler(r *http.Request) http.Handler {
 		ProtocolWhitelist:   ctx.cfg.ProtocolWhitelist,
 	}
 
-	if err := validation.ValidateAnnouncement(info, rules); err != nil {
+	hostIps, err := validation.ValidateAnnouncement(r.Context(), info, rules)
+	if err != nil {
 		if _, isValidationError := err.(validation.ValidationError); isValidationError {
 			return ErrorResponse(err.Error(), http.StatusBadRequest)
 		} else {
@@ -131,20 +241,48 @@ func apiAnnounceSessionHandler(r *http.Request) http.Handler {
 		info.Port = 27750
 	}
 
-	info.Nsfm = info.Nsfm || ctx.cfg.ContainsNsfmWords(info.Title)
+	// Limit the announcements per host only now that the host is known to
+	// belong to the client, so that nobody can use up another server's limit
+	if ok, wait := ctx.limits.announceHost.Allow(strings.ToLower(info.Host), time.Now()); !ok {
+		return rateLimitedResponse(wait)
+	}
 
 	// Don't allow listing sessions on servers that are included anyway
 	if validation.IsHostInList(info.Host, inclsrv.IncludeHosts()) {
 		return ErrorResponse("Sessions from this host are already included in listings automatically", http.StatusBadRequest)
 	}
 
-	// Make sure this host isn't banned
-	if banned, err := ctx.db.IsBannedHost(info.Host, r.Context()); banned || validation.IsHostInList(info.Host, ctx.cfg.BannedHosts) {
+	// Make sure this host isn't banned, neither by name nor by any of the
+	// addresses it resolved to during validation or the address it was
+	// announced from
+	banAddrs := append([]net.IP{clientIP}, hostIps...)
+	if banned, err := ctx.db.IsBannedHost(info.Host, banAddrs, r.Context()); banned || db.AnyHostBanMatches(ctx.cfg.BannedHosts, info.Host, banAddrs) {
 		return ErrorResponse("This host is not allowed to announce here", http.StatusForbidden)
 	} else if err != nil {
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
 
+	// Make sure the owner, title or session isn't banned
+	if banned, err := ctx.db.IsBannedSession(info, r.Context()); err != nil {
+		log.Println("Session ban check error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if banned {
+		return ErrorResponse(db.BannedSessionReason, http.StatusForbidden)
+	}
+
+	// Run the title through the filter, which may reject or change it
+	titleFilter, err := loadTitleFilter(ctx, r.Context())
+	if err != nil {
+		log.Println("Title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	filtered := titleFilter.Check(info.Title)
+	if filtered.Rejected {
+		return ErrorResponse(titlefilter.RejectedMessage, http.StatusBadRequest)
+	}
+	info.Title = filtered.Title
+	info.Nsfm = info.Nsfm || filtered.Nsfm
+
 	// Make sure this hasn't been announced yet
 	if isActive, err := ctx.db.IsActiveSession(info.Host, info.Id, info.Port, r.Context()); err != nil {
 		log.Println("IsActive check error:", err)
@@ -182,15 +320,23 @@ func apiAnnounceSessionHandler(r *http.Request) http.Handler {
 	}
 
 	// Insert to database
-	newses, err := ctx.db.InsertSession(info, clientIP.String(), r.Context())
+	pending := ctx.cfg.NeedsApproval(info.Host, info.Owner)
+	newses, err := ctx.db.InsertSession(info, clientIP.String(), pending, r.Context())
 	if err != nil {
 		log.Println("Session insertion error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
+	flagFilteredSession(ctx, newses.ListingId, filtered, r.Context())
 
-	// Add a warning message if hostname is an IPv6 address
+	// Pending sessions don't show up in the list until they're approved
 	welcomeMsg := ctx.cfg.Welcome
+	if pending {
+		welcomeMsg = ctx.cfg.PendingMessage
+	} else {
+		ctx.sessionsChanged()
+	}
 
+	// Add a warning message if hostname is an IPv6 address
 	if ctx.cfg.WarnIpv6 && validation.IsIpv6Address(info.Host) {
 		welcomeMsg = welcomeMsg + "\nNote: your host address is an IPv6 address. It may not be accessible by all users."
 	}
@@ -207,8 +353,9 @@ func parseIp(addr string) (remoteAddr net.IP) {
 
 	if remoteAddr == nil {
 		// Remote address may be in format IP:port
-		sep := strings.LastIndex(addr, ":")
-		remoteAddr = net.ParseIP(addr[0:sep])
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			remoteAddr = net.ParseIP(host)
+		}
 	}
 	return
 }
@@ -236,7 +383,8 @@ func apiBatchRefreshHandler(r *http.Request) http.Handler {
 
 	responses := make(map[string]interface{})
 	errors := make(map[string]interface{})
-	idlist := make([]string, 0, len(refreshBatch))
+	refreshed := false
+	changed := false
 
 	for id, info := range refreshBatch {
 		sessionId, err := strconv.ParseInt(id, 10, 64)
@@ -254,21 +402,43 @@ func apiBatchRefreshHandler(r *http.Request) http.Handler {
 			return ErrorResponse(id+".updatekey: expected string", http.StatusBadRequest)
 		}
 
-		err = ctx.db.RefreshSession(sessionInfo, sessionId, updateKey, r.Context())
+		filtered, err := filterRefreshTitle(ctx, sessionInfo, r.Context())
+		if err != nil {
+			log.Println("Title filter error:", err)
+			return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+		} else if filtered.Rejected {
+			responses[id] = "error"
+			errors[id] = titlefilter.RejectedMessage
+			continue
+		}
+
+		sessionChanged, err := ctx.db.RefreshSession(sessionInfo, sessionId, updateKey, r.Context())
 		if err != nil {
 			if _, isRefreshError := err.(db.RefreshError); isRefreshError {
 				responses[id] = "error"
 				errors[id] = err.Error()
+				if err == db.ErrBannedSession {
+					changed = true
+				}
 			} else {
 				log.Println("Session batch refresh error:", err)
 				return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 			}
 		} else {
+			flagFilteredSession(ctx, sessionId, filtered, r.Context())
 			responses[id] = "ok"
-			idlist = append(idlist, id)
+			refreshed = true
+			changed = changed || sessionChanged
 		}
 	}
 
+	// Most refreshes only keep the session alive, those don't change the list
+	if changed {
+		ctx.sessionsChanged()
+	} else if refreshed {
+		ctx.sessionsRefreshed()
+	}
+
 	return JsonResponseOk(map[string]interface{}{
 		"status":    "ok",
 		"responses": responses,
@@ -290,15 +460,32 @@ func apiRefreshHandler(r *http.Request) http.Handler {
 		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
 	}
 
-	err = ctx.db.RefreshSession(info, id, r.Header.Get("X-Update-Key"), r.Context())
+	filtered, err := filterRefreshTitle(ctx, info, r.Context())
+	if err != nil {
+		log.Println("Title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if filtered.Rejected {
+		return ErrorResponse(titlefilter.RejectedMessage, http.StatusBadRequest)
+	}
+
+	changed, err := ctx.db.RefreshSession(info, id, r.Header.Get("X-Update-Key"), r.Context())
 	if err != nil {
 		if _, isRefreshError := err.(db.RefreshError); isRefreshError {
+			if err == db.ErrBannedSession {
+				ctx.sessionsChanged()
+			}
 			return ErrorResponse(err.Error(), http.StatusBadRequest)
 		} else {
 			log.Println("Session refresh error:", err)
 			return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 		}
 	}
+	flagFilteredSession(ctx, id, filtered, r.Context())
+	if changed {
+		ctx.sessionsChanged()
+	} else {
+		ctx.sessionsRefreshed()
+	}
 
 	return JsonResponseOk(map[string]interface{}{
 		"status": "ok",
@@ -322,6 +509,7 @@ func apiUnlistHandler(r *http.Request) http.Handler {
 	}
 
 	if ok {
+		ctx.sessionsChanged()
 		return JsonResponseOk(map[string]string{
 			"status": "ok",
 		})
@@ -354,11 +542,97 @@ func apiAdminSessionPutHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findAuditSessions(ctx, info.Ids, r.Context())
+	if err != nil {
+		log.Println("Put session query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	updated, err := ctx.db.AdminUpdateSessions(info.Ids, info.Unlisted, info.UnlistReason, r.Context())
 	if err != nil {
 		log.Println("Put session error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
+	ctx.sessionsChanged()
+	recordAudit(r, "sessions.update", updated, before, map[string]interface{}{
+		"unlisted":     info.Unlisted,
+		"unlistreason": info.UnlistReason,
+	})
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status":  "ok",
+		"updated": updated,
+	})
+}
+
+type adminReviewRequest struct {
+	Ids          []int64 `json:"ids"`
+	Approve      bool    `json:"approve"`
+	RejectReason string  `json:"rejectreason"`
+}
+
+// Sessions waiting for approval
+func apiAdminPendingSessionListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view sessions", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+
+	sessions, err := ctx.db.AdminQuerySessions(r.Context())
+	if err != nil {
+		log.Println("List pending sessions error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	pending := []db.AdminSession{}
+	for _, s := range sessions {
+		if s.Pending && !s.Unlisted {
+			pending = append(pending, s)
+		}
+	}
+
+	return JsonResponseOk(pending)
+}
+
+func apiAdminPendingSessionPutHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessManage) {
+		return ErrorResponse("You're not allowed to edit sessions", http.StatusForbidden)
+	}
+
+	var info adminReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	} else if len(info.Ids) == 0 {
+		return ErrorResponse("No ids given", http.StatusBadRequest)
+	}
+
+	reason := strings.TrimSpace(info.RejectReason)
+	if reason == "" {
+		reason = "Rejected by a moderator"
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findAuditSessions(ctx, info.Ids, r.Context())
+	if err != nil {
+		log.Println("Review sessions query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	updated, err := ctx.db.AdminReviewSessions(info.Ids, info.Approve, reason, r.Context())
+	if err != nil {
+		log.Println("Review sessions error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	if info.Approve && len(updated) > 0 {
+		ctx.sessionsChanged()
+	}
+
+	after := map[string]interface{}{"approved": info.Approve}
+	if !info.Approve {
+		after["rejectreason"] = reason
+	}
+	recordAudit(r, "sessions.review", updated, before, after)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status":  "ok",
@@ -377,6 +651,7 @@ func apiAdminRootHandler(r *http.Request) http.Handler {
 			"maxsessionspernamedhost": apiCtx.cfg.MaxSessionsPerNamedHost,
 			"protocolwhitelist":       apiCtx.cfg.ProtocolWhitelist,
 			"sessiontimeout":          apiCtx.cfg.SessionTimeout,
+			"premoderation":           apiCtx.cfg.Premoderation,
 		},
 		"user": map[string]interface{}{
 			"id":    adminCtx.userId,
@@ -387,6 +662,8 @@ func apiAdminRootHandler(r *http.Request) http.Handler {
 				"hostbans": adminCtx.access[permHostBans],
 				"roles":    adminCtx.access[permRoles],
 				"users":    adminCtx.access[permUsers],
+				"backups":  adminCtx.access[permBackups],
+				"audit":    adminCtx.access[permAudit],
 			},
 		},
 	})
@@ -405,15 +682,47 @@ func apiAdminSessionListHandler(r *http.Request) http.Handler {
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
 
-	for i, urlString := range ctx.cfg.IncludeServers {
-		serverSessions, err := inclsrv.FetchServerAdminSessionList(urlString)
+	var overlays db.SessionOverlayIndex
+	if ctx.cfg.HasIncludes() {
+		overlayList, err := ctx.db.QuerySessionOverlays(r.Context())
+		if err != nil {
+			log.Println("List session overlays error:", err)
+			return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+		}
+		overlays = db.NewSessionOverlayIndex(overlayList)
+	}
+
+	for i := range ctx.cfg.includes {
+		server := &ctx.cfg.includes[i]
+		if !server.HasAdminApi() {
+			// Those sessions aren't ours to manage
+			continue
+		}
+
+		// Don't wait for servers that are known to be down
+		var serverSessions []db.AdminSession
+		lastError, circuitOpen := inclsrv.CircuitError(server)
+		if circuitOpen {
+			err = errors.New(lastError)
+		} else {
+			serverSessions, err = inclsrv.FetchServerAdminSessionList(r.Context(), server)
+			if err != nil {
+				log.Println("Include admin session list error:", err)
+			}
+		}
+
 		if err == nil {
+			for j := range serverSessions {
+				applySessionOverlay(&serverSessions[j], overlays)
+			}
 			sessions = append(sessions, serverSessions...)
 		} else {
-			host := ""
-			urlValue, urlParseErr := url.Parse(urlString)
-			if urlParseErr == nil {
-				host = urlValue.Hostname()
+			host := server.Host
+			if host == "" {
+				urlValue, urlParseErr := url.Parse(server.Url)
+				if urlParseErr == nil {
+					host = urlValue.Hostname()
+				}
 			}
 			if host == "" {
 				host = fmt.Sprintf("include server #%d", i)
@@ -421,7 +730,7 @@ func apiAdminSessionListHandler(r *http.Request) http.Handler {
 			sessions = append(sessions, db.AdminSession{
 				Included: true,
 				Host:     host,
-				Error:    fmt.Sprintf("Error including sessions"),
+				Error:    fmt.Sprintf("Error including sessions: %v", err),
 			})
 		}
 	}
@@ -429,8 +738,252 @@ func apiAdminSessionListHandler(r *http.Request) http.Handler {
 	return JsonResponseOk(sessions)
 }
 
+func apiAdminIncludeListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view sessions", http.StatusForbidden)
+	}
+
+	return JsonResponseOk(inclsrv.Health())
+}
+
+// Show an included session the way the moderation overlay lists it
+func applySessionOverlay(session *db.AdminSession, overlays db.SessionOverlayIndex) {
+	id := session.SessionId
+	if session.Alias != "" {
+		id = session.Alias
+	}
+	if o := overlays.Find(session.Host, session.Port, id); o != nil {
+		session.OverlayId = o.Id
+		if o.Unlisted {
+			session.Unlisted = true
+			session.UnlistReason = o.UnlistReason
+		}
+		if o.Nsfm {
+			session.Nsfm = true
+		}
+	}
+}
+
+type adminSessionOverlayRequest struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	SessionId    string `json:"sessionid"`
+	Unlisted     bool   `json:"unlisted"`
+	UnlistReason string `json:"unlistreason"`
+	Nsfm         bool   `json:"nsfm"`
+}
+
+func apiAdminOverlayListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view sessions", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+
+	overlays, err := ctx.db.QuerySessionOverlays(r.Context())
+	if err != nil {
+		log.Println("List session overlays error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(overlays)
+}
+
+func apiAdminOverlayPutHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessManage) {
+		return ErrorResponse("You're not allowed to edit sessions", http.StatusForbidden)
+	}
+
+	var info adminSessionOverlayRequest
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	}
+
+	info.Host = strings.TrimSpace(info.Host)
+	info.SessionId = strings.TrimSpace(info.SessionId)
+	if info.Host == "" || info.SessionId == "" {
+		return ErrorResponse("Host and session id can't be blank", http.StatusBadRequest)
+	} else if info.Port < 1 || info.Port > 0xffff {
+		return ErrorResponse("Invalid port", http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	overlayList, err := ctx.db.QuerySessionOverlays(r.Context())
+	if err != nil {
+		log.Println("List session overlays error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	before := db.NewSessionOverlayIndex(overlayList).Find(info.Host, info.Port, info.SessionId)
+
+	id, err := ctx.db.AdminPutSessionOverlay(db.SessionOverlay{
+		Host:         info.Host,
+		Port:         info.Port,
+		SessionId:    info.SessionId,
+		Unlisted:     info.Unlisted,
+		UnlistReason: info.UnlistReason,
+		Nsfm:         info.Nsfm,
+	}, r.Context())
+	if err != nil {
+		log.Println("Put session overlay error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	ctx.sessionsChanged()
+	recordAudit(r, "overlays.put", []int64{id}, before, info)
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status": "ok",
+		"id":     id,
+	})
+}
+
+func apiAdminOverlayDeleteHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessManage) {
+		return ErrorResponse("You're not allowed to edit sessions", http.StatusForbidden)
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return ErrorResponse("Invalid overlay id", http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findSessionOverlay(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Delete session overlay query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	deleted, err := ctx.db.AdminDeleteSessionOverlay(id, r.Context())
+	if err != nil {
+		log.Println("Delete session overlay error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if !deleted {
+		return ErrorResponse("Overlay not found", http.StatusNotFound)
+	}
+	ctx.sessionsChanged()
+	recordAudit(r, "overlays.delete", []int64{id}, before, nil)
+
+	return JsonResponseOk(map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+func apiAdminArchiveListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view sessions", http.StatusForbidden)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return ErrorResponse("Bad request", http.StatusBadRequest)
+	}
+
+	opts := db.ArchiveQueryOptions{
+		Host:   strings.TrimSpace(r.Form.Get("host")),
+		Owner:  strings.TrimSpace(r.Form.Get("owner")),
+		Title:  r.Form.Get("title"),
+		From:   r.Form.Get("from"),
+		To:     r.Form.Get("to"),
+		Limit:  100,
+		Offset: 0,
+	}
+
+	for _, date := range []string{opts.From, opts.To} {
+		if date != "" {
+			if _, err := time.Parse("2006-01-02", date); err != nil {
+				return ErrorResponse("Dates have wrong format, should be YYYY-mm-dd", http.StatusBadRequest)
+			}
+		}
+	}
+
+	if limit := r.Form.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > 1000 {
+			return ErrorResponse("Limit must be between 1 and 1000", http.StatusBadRequest)
+		}
+		opts.Limit = value
+	}
+
+	if offset := r.Form.Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return ErrorResponse("Invalid offset", http.StatusBadRequest)
+		}
+		opts.Offset = value
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	sessions, err := ctx.db.AdminQueryArchive(opts, r.Context())
+	if err != nil {
+		log.Println("List archived sessions error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(sessions)
+}
+
+func apiAdminCleanupHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessManage) {
+		return ErrorResponse("You're not allowed to clean up sessions", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	result, err := ctx.db.Cleanup(r.Context())
+	if err != nil {
+		log.Println("Cleanup error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	recordAudit(r, "sessions.cleanup", nil, nil, result)
+
+	return JsonResponseOk(map[string]interface{}{
+		"status": "ok",
+		"result": result,
+	})
+}
+
+func backupErrorResponse(err error) http.Handler {
+	if errors.Is(err, db.ErrBackupNotSupported) || errors.Is(err, db.ErrBackupNotConfigured) {
+		return ErrorResponse(err.Error(), http.StatusNotImplemented)
+	}
+	log.Println("Backup error:", err)
+	return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+}
+
+func apiAdminBackupListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permBackups, accessView) {
+		return ErrorResponse("You're not allowed to view backups", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	backups, err := ctx.db.QueryBackups(r.Context())
+	if err != nil {
+		return backupErrorResponse(err)
+	}
+
+	return JsonResponseOk(backups)
+}
+
+func apiAdminBackupCreateHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permBackups, accessManage) {
+		return ErrorResponse("You're not allowed to make backups", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	backup, err := ctx.db.Backup(r.Context())
+	if err != nil {
+		return backupErrorResponse(err)
+	}
+	recordAudit(r, "backups.create", nil, nil, backup)
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status": "ok",
+		"backup": backup,
+	})
+}
+
 type adminHostBanRequest struct {
+	Type    string `json:"type"` // host if not given
 	Host    string `json:"host"`
+	Pattern string `json:"pattern"`
 	Expires string `json:"expires"`
 	Notes   string `json:"notes"`
 }
@@ -441,11 +994,17 @@ func parseAdminHostBanRequest(r *http.Request) (adminHostBanRequest, error) {
 		return info, fmt.Errorf("Unparseable JSON request body")
 	}
 
-	info.Host = strings.TrimSpace(info.Host)
-	if info.Host == "" {
-		return info, fmt.Errorf("Host can't be blank")
+	if info.Type == "" {
+		info.Type = db.BanTypeHost
 	}
 
+	host, pattern, err := db.NormalizeBan(info.Type, info.Host, info.Pattern)
+	if err != nil {
+		return info, err
+	}
+	info.Host = host
+	info.Pattern = pattern
+
 	if info.Expires != "" {
 		if _, err := time.Parse("2006-01-02", info.Expires); err != nil {
 			return info, fmt.Errorf("Expires has wrong format, should be YYYY-mm-dd")
@@ -466,11 +1025,12 @@ func apiAdminBanCreateHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
-	id, err := ctx.db.AdminCreateHostBan(info.Host, info.Expires, info.Notes, r.Context())
+	id, err := ctx.db.AdminCreateHostBan(info.Type, info.Host, info.Pattern, info.Expires, info.Notes, r.Context())
 	if err != nil {
 		log.Println("Create host ban error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
+	recordAudit(r, "bans.create", []int64{id}, nil, info)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -494,13 +1054,20 @@ func apiAdminBanPutHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
-	updated, err := ctx.db.AdminUpdateHostBan(id, info.Host, info.Expires, info.Notes, r.Context())
+	before, err := findHostBan(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Put host ban query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	updated, err := ctx.db.AdminUpdateHostBan(id, info.Type, info.Host, info.Pattern, info.Expires, info.Notes, r.Context())
 	if err != nil {
 		log.Println("Put host ban error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	} else if !updated {
 		return ErrorResponse("Hostban not found", http.StatusNotFound)
 	}
+	recordAudit(r, "bans.update", []int64{id}, before, info)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -518,6 +1085,12 @@ func apiAdminBanDeleteHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findHostBan(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Delete host ban query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	deleted, err := ctx.db.AdminDeleteHostBan(id, r.Context())
 	if err != nil {
 		log.Println("Delete host ban error:", err)
@@ -525,6 +1098,7 @@ func apiAdminBanDeleteHandler(r *http.Request) http.Handler {
 	} else if !deleted {
 		return ErrorResponse("Hostban not found", http.StatusNotFound)
 	}
+	recordAudit(r, "bans.delete", []int64{id}, before, nil)
 
 	return JsonResponseOk(map[string]interface{}{
 		"status": "ok",
@@ -554,6 +1128,8 @@ type adminRoleRequest struct {
 	AccessHostBans int    `json:"accesshostbans"`
 	AccessRoles    int    `json:"accessroles"`
 	AccessUsers    int    `json:"accessusers"`
+	AccessBackups  int    `json:"accessbackups"`
+	AccessAudit    int    `json:"accessaudit"`
 }
 
 func isValidAccess(access int) bool {
@@ -580,7 +1156,9 @@ func parseAdminRoleRequest(r *http.Request) (adminRoleRequest, error) {
 	accessOk := isValidAccess(info.AccessSessions) &&
 		isValidAccess(info.AccessHostBans) &&
 		isValidViewAccess(info.AccessRoles) &&
-		isValidViewAccess(info.AccessUsers)
+		isValidViewAccess(info.AccessUsers) &&
+		isValidAccess(info.AccessBackups) &&
+		isValidViewAccess(info.AccessAudit)
 	if !accessOk {
 		return info, fmt.Errorf("Invalid access values")
 	}
@@ -609,11 +1187,13 @@ func apiAdminRoleCreateHandler(r *http.Request) http.Handler {
 
 	id, err := ctx.db.AdminCreateRole(
 		info.Name, info.Admin, int64(info.AccessSessions), int64(info.AccessHostBans),
-		int64(info.AccessRoles), int64(info.AccessUsers), r.Context())
+		int64(info.AccessRoles), int64(info.AccessUsers), int64(info.AccessBackups),
+		int64(info.AccessAudit), r.Context())
 	if err != nil {
 		log.Println("Create role error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
+	recordAudit(r, "roles.create", []int64{id}, nil, info)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -645,15 +1225,23 @@ func apiAdminRolePutHandler(r *http.Request) http.Handler {
 		return ErrorResponse("A different role with that name already exists", http.StatusBadRequest)
 	}
 
+	before, err := findRole(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Put role query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	updated, err := ctx.db.AdminUpdateRole(
 		id, info.Name, info.Admin, int64(info.AccessSessions), int64(info.AccessHostBans),
-		int64(info.AccessRoles), int64(info.AccessUsers), r.Context())
+		int64(info.AccessRoles), int64(info.AccessUsers), int64(info.AccessBackups),
+		int64(info.AccessAudit), r.Context())
 	if err != nil {
 		log.Println("Put role error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	} else if !updated {
 		return ErrorResponse("Role not found", http.StatusNotFound)
 	}
+	recordAudit(r, "roles.update", []int64{id}, before, info)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -671,6 +1259,12 @@ func apiAdminRoleDeleteHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findRole(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Delete role query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	deleted, err := ctx.db.AdminDeleteRole(id, r.Context())
 	if err != nil {
 		log.Println("Delete role error:", err)
@@ -678,6 +1272,7 @@ func apiAdminRoleDeleteHandler(r *http.Request) http.Handler {
 	} else if !deleted {
 		return ErrorResponse("Role not found", http.StatusNotFound)
 	}
+	recordAudit(r, "roles.delete", []int64{id}, before, nil)
 
 	return JsonResponseOk(map[string]interface{}{
 		"status": "ok",
@@ -774,6 +1369,7 @@ func apiAdminUserCreateHandler(r *http.Request) http.Handler {
 		log.Println("Create user error:", err)
 		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
 	}
+	recordAudit(r, "users.create", []int64{id}, nil, auditUser{Name: info.Name, Role: info.Role})
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -805,6 +1401,12 @@ func apiAdminUserPutHandler(r *http.Request) http.Handler {
 		return ErrorResponse("A different user with that name already exists", http.StatusBadRequest)
 	}
 
+	before, err := findUser(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Edit user query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	passwordHash := ""
 	if info.Password != "" {
 		passwordHash, err = hashPassword(info.Password)
@@ -822,6 +1424,11 @@ func apiAdminUserPutHandler(r *http.Request) http.Handler {
 	} else if !updated {
 		return ErrorResponse("User not found", http.StatusNotFound)
 	}
+	recordAudit(r, "users.update", []int64{id}, before, auditUser{
+		Name:            info.Name,
+		Role:            info.Role,
+		PasswordChanged: passwordHash != "",
+	})
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -839,6 +1446,12 @@ func apiAdminUserDeleteHandler(r *http.Request) http.Handler {
 	}
 
 	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findUser(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Delete user query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
 	deleted, err := ctx.db.AdminDeleteUser(id, r.Context())
 	if err != nil {
 		log.Println("Delete user error:", err)
@@ -846,6 +1459,7 @@ func apiAdminUserDeleteHandler(r *http.Request) http.Handler {
 	} else if !deleted {
 		return ErrorResponse("User not found", http.StatusNotFound)
 	}
+	recordAudit(r, "users.delete", []int64{id}, before, nil)
 
 	return JsonResponseOk(map[string]interface{}{
 		"status": "ok",
@@ -913,6 +1527,7 @@ func apiAdminUserSelfPasswordPutHandler(r *http.Request) http.Handler {
 	} else if !updated {
 		return ErrorResponse("User not found", http.StatusNotFound)
 	}
+	recordAudit(r, "users.password", []int64{id}, nil, nil)
 
 	return JsonResponseCreated(map[string]interface{}{
 		"status": "ok",
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+// How often the session list is checked for changes that don't go through
+// a request handler, i.e. timeouts and included servers
+const eventPollInterval = 10 * time.Second
+
+// How often to send a comment to keep idle connections from being closed
+const eventKeepaliveInterval = 30 * time.Second
+
+// Events that haven't been sent yet. A subscriber that falls this far behind
+// is disconnected, it gets a fresh snapshot when it reconnects.
+const eventBufferSize = 64
+
+type sessionEvent struct {
+	kind    string         // added, updated or removed
+	session db.SessionInfo // last known state if removed
+}
+
+type eventSubscriber struct {
+	opts   db.QueryOptions
+	events chan sessionEvent
+}
+
+// Watches the session list while anyone is subscribed to it and sends the
+// differences to the subscribers as added, updated and removed events.
+type eventHub struct {
+	apiCtx      apiContext
+	mutex       sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	sessions    map[string]db.SessionInfo // last seen list, nil when not watching
+	notify      chan struct{}
+	cancel      context.CancelFunc
+	closed      bool
+	done        chan struct{} // closed when shutting down
+	connections sync.WaitGroup
+}
+
+// The API context is used for querying the session list
+func newEventHub(apiCtx apiContext) *eventHub {
+	return &eventHub{
+		apiCtx:      apiCtx,
+		subscribers: make(map[*eventSubscriber]bool),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+func sessionKey(s *db.SessionInfo) string {
+	return fmt.Sprintf("%s-%d-%s", s.Host, s.Port, s.Id)
+}
+
+// The list is queried without any filters, each subscriber filters it on its own
+func (h *eventHub) queryAll(ctx context.Context) (map[string]db.SessionInfo, error) {
+	list, err := querySessionList(h.apiCtx, db.QueryOptions{Nsfm: true}, false, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string]db.SessionInfo, len(list))
+	for _, s := range list {
+		sessions[sessionKey(&s)] = s
+	}
+	return sessions, nil
+}
+
+// Check for changes right away. Called after handling requests that change
+// the session list, without waiting for the check.
+func (h *eventHub) changed() {
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the currently listed sessions matching the options and a
+// subscriber that receives the changes to them from then on
+func (h *eventHub) subscribe(opts db.QueryOptions, ctx context.Context) (*eventSubscriber, []db.SessionInfo, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return nil, nil, fmt.Errorf("Server is shutting down")
+	}
+
+	if h.sessions == nil {
+		sessions, err := h.queryAll(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.sessions = sessions
+
+		watchCtx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go h.watch(watchCtx)
+	}
+
+	sub := &eventSubscriber{
+		opts:   opts,
+		events: make(chan sessionEvent, eventBufferSize),
+	}
+	h.subscribers[sub] = true
+
+	snapshot := []db.SessionInfo{}
+	for _, s := range h.sessions {
+		if opts.Matches(&s) {
+			snapshot = append(snapshot, s)
+		}
+	}
+	db.SortSessionList(snapshot, opts)
+
+	return sub, snapshot, nil
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.removeSubscriber(sub)
+}
+
+// Must be called with the mutex held. Stops watching when the last
+// subscriber is gone.
+func (h *eventHub) removeSubscriber(sub *eventSubscriber) {
+	if !h.subscribers[sub] {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+
+	if len(h.subscribers) == 0 && h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+		h.sessions = nil
+	}
+}
+
+// Disconnect all subscribers, so that the server can shut down
+func (h *eventHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	for sub := range h.subscribers {
+		h.removeSubscriber(sub)
+	}
+}
+
+// Wait for hijacked connections to finish, which the HTTP server doesn't
+// keep track of itself
+func (h *eventHub) wait(ctx context.Context) {
+	finished := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
+
+func (h *eventHub) watch(ctx context.Context) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.notify:
+		}
+
+		sessions, err := h.queryAll(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Session event query error:", err)
+			}
+			continue
+		}
+
+		h.mutex.Lock()
+		if ctx.Err() == nil {
+			h.dispatch(sessions)
+		}
+		h.mutex.Unlock()
+	}
+}
+
+// Must be called with the mutex held
+func (h *eventHub) dispatch(sessions map[string]db.SessionInfo) {
+	old := h.sessions
+	h.sessions = sessions
+
+	// Most subscribers are idle, so only the changed sessions are checked
+	// against each subscriber's filters
+	type change struct {
+		old, new *db.SessionInfo
+	}
+	changes := []change{}
+	for key := range sessions {
+		s := sessions[key]
+		if o, found := old[key]; !found {
+			changes = append(changes, change{nil, &s})
+		} else if !reflect.DeepEqual(o, s) {
+			changes = append(changes, change{&o, &s})
+		}
+	}
+	for key := range old {
+		if _, found := sessions[key]; !found {
+			o := old[key]
+			changes = append(changes, change{&o, nil})
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	for sub := range h.subscribers {
+		for _, c := range changes {
+			wasListed := c.old != nil && sub.opts.Matches(c.old)
+			isListed := c.new != nil && sub.opts.Matches(c.new)
+
+			var e sessionEvent
+			if isListed && !wasListed {
+				e = sessionEvent{"added", *c.new}
+			} else if isListed {
+				e = sessionEvent{"updated", *c.new}
+			} else if wasListed {
+				e = sessionEvent{"removed", *c.old}
+			} else {
+				continue
+			}
+
+			select {
+			case sub.events <- e:
+			default:
+				h.removeSubscriber(sub)
+			}
+			if !h.subscribers[sub] {
+				break
+			}
+		}
+	}
+}
+
+// Removed sessions are identified by the same key the lists are merged on
+func sessionKeyInfo(s *db.SessionInfo) db.JoinSessionInfo {
+	return db.JoinSessionInfo{Host: s.Host, Port: s.Port, Id: s.Id}
+}
+
+func writeEvent(w http.ResponseWriter, kind string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+	return err
+}
+
+// Stream changes to the session list as Server-Sent Events
+func apiSessionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	if !ctx.cfg.Public && !ctx.cfg.HasIncludes() {
+		ErrorResponse("No public listings on this server", http.StatusNotFound).ServeHTTP(w, r)
+		return
+	}
+
+	opts, err := parseSessionQueryOptions(r)
+	if err != nil {
+		ErrorResponse(err.Error(), http.StatusBadRequest).ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Session events: response writer can't be flushed")
+		ErrorResponse("Server is misconfigured", http.StatusInternalServerError).ServeHTTP(w, r)
+		return
+	}
+
+	sub, snapshot, err := ctx.events.subscribe(opts, r.Context())
+	if err != nil {
+		log.Println("Session events subscription error:", err)
+		ErrorResponse("An error occurred while querying session list", http.StatusInternalServerError).ServeHTTP(w, r)
+		return
+	}
+	defer ctx.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx hold back events
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, "snapshot", snapshot); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			var err error
+			if e.kind == "removed" {
+				err = writeEvent(w, e.kind, sessionKeyInfo(&e.session))
+			} else {
+				err = writeEvent(w, e.kind, e.session)
+			}
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
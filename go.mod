@@ -7,8 +7,11 @@ require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/gorilla/handlers v1.5.2
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.18.0
+	golang.org/x/text v0.14.0
 )
 
 require github.com/felixge/httpsnoop v1.0.4 // indirect
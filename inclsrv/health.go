@@ -0,0 +1,120 @@
+package inclsrv
+
+import (
+	"net/url"
+	"time"
+)
+
+// Consecutive failures after which the circuit breaker opens. While it's
+// open, the server is only retried on a backoff and failures aren't logged.
+const failuresUntilOpen = 3
+
+type healthState struct {
+	LastAttempt time.Time
+	LastError   string
+	ErrorTime   time.Time
+	Latency     time.Duration // of the last successful fetch
+	NextAttempt time.Time
+}
+
+// Health of an included server as shown in the admin API
+type HealthStatus struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Url         string `json:"url"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Available   bool   `json:"available"`
+	CircuitOpen bool   `json:"circuitOpen"`
+	Failures    int    `json:"failures"`
+	Sessions    int    `json:"sessions"`
+	LastSuccess string `json:"lastSuccess"`
+	LastAttempt string `json:"lastAttempt"`
+	LastError   string `json:"lastError"`
+	ErrorTime   string `json:"errorTime"`
+	NextAttempt string `json:"nextAttempt"`
+	LatencyMs   int64  `json:"latencyMs"`
+}
+
+func (c *cachedSessionInfos) isCircuitOpen() bool {
+	return c.Failures >= failuresUntilOpen
+}
+
+// The URL without credentials, so that it can be shown and logged
+func (s *Server) DisplayUrl() string {
+	u, err := url.Parse(s.Url)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	u.User = nil
+	return u.String()
+}
+
+func formatHealthTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Get the health of all included servers, in the order they were configured
+func Health() []HealthStatus {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+	statuses := make([]HealthStatus, 0, len(servers))
+	for _, s := range servers {
+		value := cache[s]
+		status := HealthStatus{
+			Type:        s.Type,
+			Name:        s.Name,
+			Url:         s.DisplayUrl(),
+			Host:        value.Host,
+			Port:        value.Port,
+			Available:   value.isListed(now),
+			CircuitOpen: value.isCircuitOpen(),
+			Failures:    value.Failures,
+			LastSuccess: formatHealthTime(value.Time),
+			LastAttempt: formatHealthTime(value.LastAttempt),
+			LastError:   value.LastError,
+			ErrorTime:   formatHealthTime(value.ErrorTime),
+			NextAttempt: formatHealthTime(value.NextAttempt),
+			LatencyMs:   value.Latency.Milliseconds(),
+		}
+		if status.Available {
+			status.Sessions = len(value.SessionInfo)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Count the included servers and how many of them have their sessions listed
+func CountAvailable() (total int, available int) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+	for _, s := range servers {
+		if value := cache[s]; value.isListed(now) {
+			available++
+		}
+	}
+	return len(servers), available
+}
+
+// The last error of the given server if its circuit breaker is open, so that
+// it shouldn't be contacted right now
+func CircuitError(s *Server) (string, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	for _, polled := range servers {
+		if polled.Url == s.Url {
+			value := cache[polled]
+			return value.LastError, value.isCircuitOpen()
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,73 @@
+package inclsrv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drawpile/listserver/db"
+)
+
+// Sent with requests to other list servers. A list server that receives it
+// leaves out the sessions it included from other list servers, so that two
+// servers including each other don't echo sessions back and forth.
+const FederationHeader = "X-Drawpile-Listserver"
+
+const (
+	listserverApiName  = "drawpile-session-list"
+	listserverApiMajor = "1"
+)
+
+type listserverInfoResponse struct {
+	ApiName string `json:"api_name"`
+	Version string `json:"version"`
+	Public  *bool  `json:"public"`
+}
+
+// Make sure the server speaks a compatible version of the session list API
+// and has a public list
+func checkListserver(ctx context.Context, s *Server) error {
+	var info listserverInfoResponse
+	if err := fetchJson(ctx, s, "/", &info); err != nil {
+		return err
+	}
+
+	if info.ApiName != listserverApiName {
+		return fmt.Errorf("/: unexpected API %q", info.ApiName)
+	}
+	if major, _, _ := strings.Cut(info.Version, "."); major != listserverApiMajor {
+		return fmt.Errorf("/: incompatible API version %q", info.Version)
+	}
+	if info.Public != nil && !*info.Public {
+		return fmt.Errorf("/: server has no public list")
+	}
+	return nil
+}
+
+// Fetch the public session list of another list server. Its API info is
+// only checked if it hasn't been recently.
+func fetchListserverSessionList(ctx context.Context, s *Server, checked bool) ([]db.SessionInfo, error) {
+	if !checked {
+		if err := checkListserver(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+
+	var listResponse []db.SessionInfo
+	if err := fetchJson(ctx, s, "/sessions/?nsfm=true", &listResponse); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]db.SessionInfo, 0, len(listResponse))
+	for _, session := range listResponse {
+		if session.Host == "" || session.Id == "" || session.Private {
+			continue
+		}
+		if session.Usernames == nil {
+			session.Usernames = []string{}
+		}
+		sessions = append(sessions, session)
+	}
+
+	return s.adjustSessionList(sessions), nil
+}
@@ -0,0 +1,253 @@
+package inclsrv
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+// How long the last fetched sessions of a server stay listed while it can't
+// be reached
+var MaxStale = 5 * time.Minute
+
+const (
+	minPollInterval = 5 * time.Second
+	maxRetryDelay   = 10 * time.Minute
+	defaultTimeout  = 10 * time.Second
+
+	// How long starting to poll waits for the first fetches at most
+	maxStartupWait = 5 * time.Second
+)
+
+type cachedSessionInfos struct {
+	Time        time.Time // of the last successful fetch
+	StatusTime  time.Time // when the host and port were fetched
+	Host        string
+	Port        int
+	SessionInfo []db.SessionInfo
+	Failures    int  // consecutive failed fetches since then
+	Push        bool // pushed by the server rather than fetched
+	pushReplay
+	healthState
+}
+
+var servers = []*Server{}
+var cache = map[*Server]cachedSessionInfos{}
+var cacheMutex = sync.Mutex{}
+var lastChange = time.Time{} // protected by cacheMutex
+
+var pollCancel context.CancelFunc
+var pollers sync.WaitGroup
+
+// Are the sessions listed at the given time, or have they gone stale. Pushed
+// sessions go stale if the server stops pushing.
+func (c *cachedSessionInfos) isListed(now time.Time) bool {
+	return !c.Time.IsZero() && (c.Failures == 0 && !c.Push || now.Sub(c.Time) <= MaxStale)
+}
+
+func (s *Server) pollInterval() time.Duration {
+	if s.CacheTtl < minPollInterval {
+		return minPollInterval
+	}
+	return s.CacheTtl
+}
+
+// Once the circuit breaker is open, the delay doubles with each failure, so
+// that servers that are down aren't hammered with requests
+func (s *Server) retryDelay(failures int) time.Duration {
+	delay := s.pollInterval()
+	for i := failuresUntilOpen; i <= failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+func getCached(s *Server) (cachedSessionInfos, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	value, found := cache[s]
+	return value, found
+}
+
+func putCached(s *Server, value cachedSessionInfos) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	now := time.Now()
+	old, found := cache[s]
+	if found && old.isListed(now) != value.isListed(now) ||
+		value.isListed(now) && !reflect.DeepEqual(old.SessionInfo, value.SessionInfo) {
+		lastChange = now
+	}
+	cache[s] = value
+}
+
+// Fetch the session list of a server once. Returns how long to wait until
+// the next fetch.
+func refresh(ctx context.Context, s *Server) time.Duration {
+	value, _ := getCached(s)
+
+	now := time.Now()
+	statusValid := now.Sub(value.StatusTime) <= s.StatusCacheTtl
+
+	var sessions []db.SessionInfo
+	var host string
+	var port int
+	var err error
+	if s.IsListserver() {
+		sessions, err = fetchListserverSessionList(ctx, s, statusValid)
+	} else if statusValid {
+		sessions, host, port, err = fetchServerSessionList(ctx, s, value.Host, value.Port)
+	} else {
+		sessions, host, port, err = fetchServerSessionList(ctx, s, "", 0)
+	}
+	if ctx.Err() != nil {
+		// Polling was stopped, that's not the server's fault
+		return 0
+	}
+	value.LastAttempt = now
+
+	var delay time.Duration
+	if err != nil {
+		value.Failures++
+		value.LastError = err.Error()
+		value.ErrorTime = now
+		delay = s.retryDelay(value.Failures)
+
+		if value.Failures < failuresUntilOpen {
+			log.Printf("Error including %v: %v\n", s.DisplayUrl(), err)
+		} else if value.Failures == failuresUntilOpen {
+			log.Printf("Error including %v, failed %d times, retrying in %v: %v\n",
+				s.DisplayUrl(), value.Failures, delay, err)
+		}
+	} else {
+		if value.isCircuitOpen() {
+			log.Printf("Including %v again after %d failures\n", s.DisplayUrl(), value.Failures)
+		}
+		if host != value.Host || port != value.Port || !statusValid {
+			value.StatusTime = now
+		}
+		value.Time = now
+		value.Host = host
+		value.Port = port
+		value.SessionInfo = sessions
+		value.Failures = 0
+		value.Latency = time.Since(now)
+		delay = s.pollInterval()
+	}
+
+	value.NextAttempt = time.Now().Add(delay)
+	putCached(s, value)
+	return delay
+}
+
+func poll(ctx context.Context, s *Server, first *sync.WaitGroup) {
+	defer pollers.Done()
+	for {
+		delay := refresh(ctx, s)
+		if first != nil {
+			first.Done()
+			first = nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Start refreshing the session lists of the given servers in the background.
+// Waits a few seconds for the first fetch from each of them to finish, so
+// that the sessions are usually there from the start, but a server that
+// doesn't answer doesn't hold up the start.
+func StartPolling(included ...Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pollCancel = cancel
+
+	cacheMutex.Lock()
+	for i := range included {
+		servers = append(servers, &included[i])
+	}
+	cacheMutex.Unlock()
+
+	var first sync.WaitGroup
+	for _, s := range servers {
+		if s.IsPush() {
+			continue
+		}
+		first.Add(1)
+		pollers.Add(1)
+		go poll(ctx, s, &first)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		first.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(maxStartupWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Println("Not all included servers answered yet, starting anyway")
+	}
+}
+
+// Stop polling and wait for fetches in progress to finish
+func StopPolling() {
+	if pollCancel != nil {
+		pollCancel()
+		pollers.Wait()
+	}
+}
+
+// Get the sessions of the included servers that were last fetched, the
+// servers are never contacted here. Sessions included from other list
+// servers are left out when answering another list server. The moderation
+// overlays are applied before filtering, so NSFM tags set by an admin count.
+func CachedSessionLists(opts db.QueryOptions, federation bool, overlays db.SessionOverlayIndex) []db.SessionInfo {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+	sessions := []db.SessionInfo{}
+	for _, s := range servers {
+		if federation && s.IsListserver() {
+			continue
+		}
+		if value, found := cache[s]; found && value.isListed(now) {
+			sessions = append(sessions, filterSessionList(overlays.Apply(value.SessionInfo), opts)...)
+		}
+	}
+	return sessions
+}
+
+// When the listed sessions of any included server last changed, including
+// when they dropped out of the list after going stale
+func LastChange() time.Time {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+	last := lastChange
+	for _, value := range cache {
+		if (value.Failures > 0 || value.Push) && !value.Time.IsZero() {
+			if expired := value.Time.Add(MaxStale); expired.Before(now) && expired.After(last) {
+				last = expired
+			}
+		}
+	}
+	return last
+}
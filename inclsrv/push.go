@@ -0,0 +1,181 @@
+package inclsrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+// Pushes signed further away from the current time than this are rejected,
+// so that captured requests can't be replayed later
+const maxPushClockSkew = 5 * time.Minute
+
+var ErrPushSignature = errors.New("Bad signature")
+var ErrPushReplayed = errors.New("Push was replayed or is older than the last one")
+var ErrPushNoSnapshot = errors.New("No full snapshot received yet")
+
+// The newest push accepted from a server. Timestamps only have a resolution
+// of seconds, so several pushes may share one, but each of them only once.
+type pushReplay struct {
+	pushTimestamp  int64
+	pushSignatures []string
+}
+
+// Record an accepted push. Fails if it's older than the newest one or if the
+// same push was accepted before.
+func (p *pushReplay) accept(timestamp int64, signature string) error {
+	if timestamp < p.pushTimestamp {
+		return ErrPushReplayed
+	} else if timestamp > p.pushTimestamp {
+		p.pushTimestamp = timestamp
+		p.pushSignatures = nil
+	}
+
+	for _, s := range p.pushSignatures {
+		if s == signature {
+			return ErrPushReplayed
+		}
+	}
+	p.pushSignatures = append(p.pushSignatures, signature)
+	return nil
+}
+
+// Session snapshot posted by a server. The sessions are in the same format
+// as drawpile-srv's admin API returns them.
+type PushRequest struct {
+	// "full" replaces all sessions of the server, "update" only adds or
+	// replaces the given sessions and removes the ones in Removed
+	Type     string                  `json:"type"`
+	Host     string                  `json:"host"`
+	Port     int                     `json:"port"`
+	Sessions []sessionServerResponse `json:"sessions"`
+	Removed  []string                `json:"removed"`
+}
+
+func (s *Server) IsPush() bool {
+	return s.Type == TypePush
+}
+
+// Find the push server with the given name
+func FindPushServer(name string) *Server {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for _, s := range servers {
+		if s.IsPush() && s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Compute the signature of a push, which is the hex encoded HMAC-SHA256 of
+// the timestamp, a dot and the request body
+func PushSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature and timestamp (in Unix seconds) sent with a push. A
+// valid push is remembered, so that it's rejected if it's sent again.
+func (s *Server) VerifyPush(timestamp string, signature string, body []byte, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrPushSignature
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > maxPushClockSkew || skew < -maxPushClockSkew {
+		return ErrPushSignature
+	}
+
+	expected := PushSignature(s.Secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrPushSignature
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	value := cache[s]
+	if err := value.accept(seconds, expected); err != nil {
+		return err
+	}
+	cache[s] = value
+	return nil
+}
+
+// Apply a pushed snapshot to the included sessions. Returns the number of
+// sessions the server has listed now.
+func (s *Server) ApplyPush(push *PushRequest) (int, error) {
+	host, port := s.address(push.Host, push.Port)
+	if host == "" || port == 0 {
+		return 0, fmt.Errorf("Host and port are required")
+	}
+
+	// Sessions that were updated to something that's filtered out must be
+	// removed too, so the IDs are collected before filtering
+	converted := make([]db.SessionInfo, len(push.Sessions))
+	replaced := append([]string{}, push.Removed...)
+	for i := range push.Sessions {
+		converted[i] = push.Sessions[i].sessionInfo(host, port)
+		replaced = append(replaced, converted[i].Id)
+	}
+	converted = s.adjustSessionList(converted)
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+	value := cache[s]
+
+	var sessions []db.SessionInfo
+	switch push.Type {
+	case "full":
+		sessions = converted
+	case "update":
+		if value.Time.IsZero() || !value.isListed(now) || value.Host != host || value.Port != port {
+			return 0, ErrPushNoSnapshot
+		}
+		sessions = mergePush(value.SessionInfo, converted, replaced)
+	default:
+		return 0, fmt.Errorf("Unknown push type %q", push.Type)
+	}
+
+	old := value
+	value.Push = true
+	value.Time = now
+	value.LastAttempt = now
+	value.StatusTime = now
+	value.Host = host
+	value.Port = port
+	value.SessionInfo = sessions
+	if !old.isListed(now) || !reflect.DeepEqual(old.SessionInfo, sessions) {
+		lastChange = now
+	}
+	cache[s] = value
+	return len(sessions), nil
+}
+
+// Drop the replaced sessions by ID and add the updated ones
+func mergePush(sessions []db.SessionInfo, updated []db.SessionInfo, replaced []string) []db.SessionInfo {
+	drop := make(map[string]bool, len(replaced))
+	for _, id := range replaced {
+		drop[id] = true
+	}
+
+	merged := make([]db.SessionInfo, 0, len(sessions)+len(updated))
+	for _, s := range sessions {
+		if !drop[s.Id] {
+			merged = append(merged, s)
+		}
+	}
+	return append(merged, updated...)
+}
@@ -0,0 +1,119 @@
+package inclsrv
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+func TestVerifyPush(t *testing.T) {
+	s := &Server{Type: TypePush, Name: "test", Secret: "secret"}
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"full"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := PushSignature("secret", timestamp, body)
+
+	defer func() {
+		cacheMutex.Lock()
+		delete(cache, s)
+		cacheMutex.Unlock()
+	}()
+
+	if err := s.VerifyPush(timestamp, signature, body, now); err != nil {
+		t.Error("Valid signature rejected:", err)
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      string
+		now       time.Time
+	}{
+		{"wrong secret", timestamp, PushSignature("other", timestamp, body), string(body), now},
+		{"changed body", timestamp, signature, `{"type":"update"}`, now},
+		{"changed timestamp", "1700000001", signature, string(body), now},
+		{"replayed", timestamp, signature, string(body), now.Add(10 * time.Minute)},
+		{"bad timestamp", "soon", signature, string(body), now},
+		{"no signature", timestamp, "", string(body), now},
+	}
+
+	for _, test := range tests {
+		if err := s.VerifyPush(test.timestamp, test.signature, []byte(test.body), test.now); err != ErrPushSignature {
+			t.Errorf("%s: expected signature error, got %v", test.name, err)
+		}
+	}
+
+	sign := func(seconds int64, body string) (string, string, []byte) {
+		timestamp := strconv.FormatInt(seconds, 10)
+		return timestamp, PushSignature("secret", timestamp, []byte(body)), []byte(body)
+	}
+
+	replays := []struct {
+		name     string
+		seconds  int64
+		body     string
+		expected error
+	}{
+		{"same push again", now.Unix(), string(body), ErrPushReplayed},
+		{"other push in the same second", now.Unix(), `{"type":"update"}`, nil},
+		{"newer push", now.Unix() + 1, string(body), nil},
+		{"older push", now.Unix(), `{"type":"full","sessions":[]}`, ErrPushReplayed},
+	}
+
+	for _, test := range replays {
+		timestamp, signature, body := sign(test.seconds, test.body)
+		if err := s.VerifyPush(timestamp, signature, body, now); err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestApplyPush(t *testing.T) {
+	s := &Server{Type: TypePush, Name: "test", Host: "example.com", Protocols: []string{"dp:4.24.0"}}
+	cacheMutex.Lock()
+	servers = append(servers, s)
+	cacheMutex.Unlock()
+	defer func() {
+		cacheMutex.Lock()
+		servers = servers[:len(servers)-1]
+		delete(cache, s)
+		cacheMutex.Unlock()
+	}()
+
+	update := &PushRequest{Type: "update", Port: 27750}
+	if _, err := s.ApplyPush(update); err != ErrPushNoSnapshot {
+		t.Fatal("Update without a snapshot: expected ErrPushNoSnapshot, got", err)
+	}
+
+	full := &PushRequest{Type: "full", Port: 27750, Sessions: []sessionServerResponse{
+		{Id: "a", Title: "A", Protocol: "dp:4.24.0"},
+		{Id: "b", Alias: "bee", Title: "B", Protocol: "dp:4.24.0"},
+		{Id: "c", Title: "C", Protocol: "dp:4.21.2"},
+	}}
+	if count, err := s.ApplyPush(full); err != nil || count != 2 {
+		t.Fatalf("Full snapshot: expected 2 sessions, got %d (%v)", count, err)
+	}
+
+	update.Sessions = []sessionServerResponse{
+		{Id: "a", Title: "A", Protocol: "dp:4.21.2"},
+		{Id: "d", Title: "D", Protocol: "dp:4.24.0"},
+	}
+	update.Removed = []string{"bee"}
+	if count, err := s.ApplyPush(update); err != nil || count != 1 {
+		t.Fatalf("Update: expected 1 session, got %d (%v)", count, err)
+	}
+
+	sessions := CachedSessionLists(db.QueryOptions{Nsfm: true}, false, nil)
+	if len(sessions) != 1 || sessions[0].Id != "d" || sessions[0].Host != "example.com" {
+		t.Errorf("Expected only session d on example.com, got %+v", sessions)
+	}
+
+	// Included sessions are filtered just like announced ones
+	opts := db.QueryOptions{Title: "d", Protocol: "dp:4.21.2,dp:4.24.0"}
+	if sessions := CachedSessionLists(opts, false, nil); len(sessions) != 1 {
+		t.Errorf("Expected session d to match %+v, got %+v", opts, sessions)
+	}
+}
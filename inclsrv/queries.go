@@ -1,15 +1,12 @@
 package inclsrv
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/drawpile/listserver/db"
 )
@@ -37,24 +34,6 @@ type sessionServerResponse struct {
 	AllowWeb               bool
 }
 
-type cachedSessionInfos struct {
-	Time        time.Time
-	Host        string
-	Port        int
-	SessionInfo []db.SessionInfo
-}
-
-type sessionFetchResult struct {
-	index    int
-	sessions []db.SessionInfo
-}
-
-var cache = map[string]cachedSessionInfos{}
-var cacheMutex = sync.Mutex{}
-var CacheTtl = time.Duration(0)
-var StatusCacheTtl = time.Duration(0)
-var Timeout = time.Duration(0)
-
 func (ssr *sessionServerResponse) AliasOrId() string {
 	if ssr.Alias != "" {
 		return ssr.Alias
@@ -63,146 +42,109 @@ func (ssr *sessionServerResponse) AliasOrId() string {
 	}
 }
 
+func (ssr *sessionServerResponse) sessionInfo(host string, port int) db.SessionInfo {
+	return db.SessionInfo{
+		Host:               host,
+		Port:               port,
+		Id:                 ssr.AliasOrId(),
+		Protocol:           ssr.Protocol,
+		Title:              ssr.Title,
+		Users:              ssr.UserCount,
+		Usernames:          []string{},
+		Password:           ssr.HasPassword,
+		Nsfm:               ssr.Nsfm,
+		Owner:              ssr.Founder,
+		Started:            ssr.StartTime,
+		MaxUsers:           ssr.MaxUserCount,
+		Closed:             ssr.Closed,
+		ActiveDrawingUsers: ssr.ActiveDrawingUserCount,
+		AllowWeb:           ssr.AllowWeb,
+	}
+}
+
 func (ssr *sessionServerResponse) UnmarshalJSON(data []byte) error {
 	ssr.ActiveDrawingUserCount = -1
 	type jsonSessionServerResponse sessionServerResponse
 	return json.Unmarshal(data, (*jsonSessionServerResponse)(ssr))
 }
 
-func fetchJson(url string, v interface{}) error {
-	client := http.Client{Timeout: Timeout}
-	resp, err := client.Get(url)
+// Errors are returned with the path that failed, but not logged. The caller
+// decides whether they're worth logging.
+func fetchJson(ctx context.Context, s *Server, path string, v interface{}) error {
+	req, err := s.newRequest(ctx, path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	client := http.Client{Timeout: s.timeout()}
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Println(url, "fetch error:", err)
-		return err
+		return fmt.Errorf("%s: %w", path, err)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Println(url, "got status", resp.Status)
-		return errors.New("Server returned bad status")
+		return fmt.Errorf("%s: server returned status %s", path, resp.Status)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
-
 	if err != nil {
-		log.Println(url, "read error:", err)
-		return err
+		return fmt.Errorf("%s: read error: %w", path, err)
 	}
 
-	err = json.Unmarshal(body, v)
-	if err != nil {
-		log.Println(url, "parse error:", err)
-		return err
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s: parse error: %w", path, err)
 	}
 
 	return nil
 }
 
-// Fetch a list of sessions from the given Drawpile server admin API URLs.
-// A BASIC Auth username:password pair can be included in the URL if needed.
-func fetchServerSessionList(urlString string, host string, port int) ([]db.SessionInfo, string, int, error) {
+// Fetch the listed sessions from the given Drawpile server's admin API. The
+// status is only fetched if no host is given.
+func fetchServerSessionList(ctx context.Context, s *Server, host string, port int) ([]db.SessionInfo, string, int, error) {
 	var err error
 
 	if host == "" {
-		var info statusServerResponse
-		if err = fetchJson(urlString+"/status/", &info); err != nil {
-			return nil, "", 0, err
+		host, port = s.address("", 0)
+		if host == "" || port == 0 {
+			var info statusServerResponse
+			if err = fetchJson(ctx, s, "/status/", &info); err != nil {
+				return nil, "", 0, err
+			}
+			host, port = s.address(info.Hostname, info.Port)
 		}
-		host = info.Hostname
-		port = info.Port
 	}
 
 	var listResponse []sessionServerResponse
-	if err = fetchJson(urlString+"/sessions/?listed=true", &listResponse); err != nil {
+	if err = fetchJson(ctx, s, "/sessions/?listed=true", &listResponse); err != nil {
 		return nil, "", 0, err
 	}
 
 	sessions := make([]db.SessionInfo, len(listResponse))
-	for i, v := range listResponse {
-		sessions[i] = db.SessionInfo{
-			Host:               host,
-			Port:               port,
-			Id:                 v.AliasOrId(),
-			Protocol:           v.Protocol,
-			Title:              v.Title,
-			Users:              v.UserCount,
-			Usernames:          []string{},
-			Password:           v.HasPassword,
-			Nsfm:               v.Nsfm,
-			Owner:              v.Founder,
-			Started:            v.StartTime,
-			MaxUsers:           v.MaxUserCount,
-			Closed:             v.Closed,
-			ActiveDrawingUsers: v.ActiveDrawingUserCount,
-			AllowWeb:           v.AllowWeb,
-		}
-	}
-
-	return sessions, host, port, nil
-}
-
-func getCached(urlString string) (cachedSessionInfos, bool) {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	value, found := cache[urlString]
-	return value, found
-}
-
-func putCached(urlString string, host string, port int, sessions []db.SessionInfo) {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	cache[urlString] = cachedSessionInfos{
-		Time:        time.Now(),
-		Host:        host,
-		Port:        port,
-		SessionInfo: sessions,
+	for i := range listResponse {
+		sessions[i] = listResponse[i].sessionInfo(host, port)
 	}
-}
-
-func cachedFetchServerSessionList(urlString string) ([]db.SessionInfo, error) {
-	if CacheTtl > 0 {
-		cachedHost := ""
-		cachedPort := 0
-		value, found := getCached(urlString)
-		if found {
-			dt := time.Now().Sub(value.Time)
-			if dt <= CacheTtl {
-				return value.SessionInfo, nil
-			}
-			if dt <= StatusCacheTtl {
-				cachedHost = value.Host
-				cachedPort = value.Port
-			}
-		}
-
-		sessions, host, port, err := fetchServerSessionList(urlString, cachedHost, cachedPort)
-		if err != nil {
-			return nil, err
-		}
 
-		putCached(urlString, host, port, sessions)
-		return sessions, nil
-	} else {
-		sessions, host, port, err := fetchServerSessionList(urlString, "", 0)
-		putCached(urlString, host, port, nil)
-		return sessions, err
-	}
+	return s.adjustSessionList(sessions), host, port, nil
 }
 
-// Fetch a list of sessions from the given Drawpile server admin API URLs.
-// A BASIC Auth username:password pair can be included in the URL if needed.
-func FetchServerAdminSessionList(urlString string) ([]db.AdminSession, error) {
+// Fetch all sessions, including unlisted ones, from the given Drawpile
+// server's admin API
+func FetchServerAdminSessionList(ctx context.Context, s *Server) ([]db.AdminSession, error) {
 	var err error
 	var info statusServerResponse
 
-	if err = fetchJson(urlString+"/status/", &info); err != nil {
-		return nil, err
+	info.Hostname, info.Port = s.address("", 0)
+	if info.Hostname == "" || info.Port == 0 {
+		if err = fetchJson(ctx, s, "/status/", &info); err != nil {
+			return nil, err
+		}
+		info.Hostname, info.Port = s.address(info.Hostname, info.Port)
 	}
 
 	var listResponse []sessionServerResponse
-	if err = fetchJson(urlString+"/sessions/", &listResponse); err != nil {
+	if err = fetchJson(ctx, s, "/sessions/", &listResponse); err != nil {
 		return nil, err
 	}
 
@@ -234,73 +176,13 @@ func FetchServerAdminSessionList(urlString string) ([]db.AdminSession, error) {
 func filterSessionList(sessions []db.SessionInfo, opts db.QueryOptions) []db.SessionInfo {
 	filtered := []db.SessionInfo{}
 	for _, s := range sessions {
-		if (opts.Title == "" || strings.Contains(s.Title, opts.Title)) &&
-			(opts.Nsfm || !s.Nsfm) &&
-			(opts.Protocol == "" || strings.Contains(s.Protocol, opts.Protocol)) {
-
+		if opts.Matches(&s) {
 			filtered = append(filtered, s)
 		}
 	}
 	return filtered
 }
 
-func asyncFetchSessionList(opts db.QueryOptions, url string, ch chan sessionFetchResult, index int) {
-	defer func() {
-		if err := recover(); err != nil {
-			ch <- sessionFetchResult{index, nil}
-			log.Printf("Panic including %v: %v\n", url, err)
-		}
-	}()
-	ses, err := cachedFetchServerSessionList(url)
-	if err != nil {
-		log.Printf("Error including %v: %v\n", url, err)
-		ch <- sessionFetchResult{index, ses}
-	} else {
-		ch <- sessionFetchResult{index, filterSessionList(ses, opts)}
-	}
-}
-
-func FetchFilteredSessionLists(opts db.QueryOptions, urls ...string) []db.SessionInfo {
-	urlCount := len(urls)
-	if urlCount == 0 {
-		return []db.SessionInfo{}
-	} else if urlCount == 1 {
-		url := urls[0]
-		sessions, err := cachedFetchServerSessionList(url)
-		if err != nil {
-			log.Printf("Error including %v: %v\n", url, err)
-			return []db.SessionInfo{}
-		}
-		return filterSessionList(sessions, opts)
-	} else {
-		ch := make(chan sessionFetchResult, urlCount)
-		for index, url := range urls {
-			go asyncFetchSessionList(opts, url, ch, index)
-		}
-
-		results := make([]sessionFetchResult, urlCount)
-		sessionCount := 0
-		for i := 0; i < urlCount; i++ {
-			result := <-ch
-			results[result.index] = result
-			if result.sessions != nil {
-				sessionCount += len(result.sessions)
-			}
-		}
-
-		if sessionCount == 0 {
-			return []db.SessionInfo{}
-		}
-		sessions := make([]db.SessionInfo, 0, sessionCount)
-		for _, result := range results {
-			if result.sessions != nil {
-				sessions = append(sessions, result.sessions...)
-			}
-		}
-		return sessions
-	}
-}
-
 func MergeLists(lists ...[]db.SessionInfo) []db.SessionInfo {
 	ids := make(map[string]bool)
 	merged := []db.SessionInfo{}
@@ -0,0 +1,130 @@
+package inclsrv
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+)
+
+const (
+	TypeDrawpile   = "drawpile"   // drawpile-srv admin API
+	TypeListserver = "listserver" // another list server's public session list
+	TypePush       = "push"       // server that pushes its sessions to us
+)
+
+// A Drawpile server or another list server whose sessions are included in
+// the list
+type Server struct {
+	// TypeDrawpile, TypeListserver or TypePush, empty means TypeDrawpile
+	Type string
+
+	// Identifies a push server in the push URL
+	Name string
+
+	// Shared secret push requests are signed with
+	Secret string
+
+	// Admin API URL or list server URL. A BASIC Auth username:password pair
+	// can be included in the URL instead of setting the username and
+	// password below.
+	Url      string
+	Username string
+	Password string
+
+	// How often to fetch the session list, at least every five seconds
+	CacheTtl time.Duration
+
+	// How often to fetch the host name and port again
+	StatusCacheTtl time.Duration
+
+	// Timeout for requests, zero means the default of ten seconds
+	Timeout time.Duration
+
+	// Mark all sessions as NSFM
+	ForceNsfm bool
+
+	// Prepended to all session titles
+	TitlePrefix string
+
+	// Used instead of the external host name and port the server reports,
+	// if set. The status isn't fetched at all if both are set. Not used for
+	// list servers, their sessions are hosted on many different servers.
+	Host string
+	Port int
+
+	// Only include sessions with one of these protocol versions, or all of
+	// them if empty
+	Protocols []string
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s *Server) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != "" || s.Password != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	if s.IsListserver() {
+		req.Header.Set(FederationHeader, "1")
+	}
+	return req, nil
+}
+
+func (s *Server) IsListserver() bool {
+	return s.Type == TypeListserver
+}
+
+// Only drawpile-srv servers have an admin API that can be queried
+func (s *Server) HasAdminApi() bool {
+	return s.Type == "" || s.Type == TypeDrawpile
+}
+
+// Apply the host and port overrides
+func (s *Server) address(host string, port int) (string, int) {
+	if s.Host != "" {
+		host = s.Host
+	}
+	if s.Port != 0 {
+		port = s.Port
+	}
+	return host, port
+}
+
+func (s *Server) acceptsProtocol(protocol string) bool {
+	if len(s.Protocols) == 0 {
+		return true
+	}
+	for _, p := range s.Protocols {
+		if strings.EqualFold(p, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the per-server settings to a fetched session list
+func (s *Server) adjustSessionList(sessions []db.SessionInfo) []db.SessionInfo {
+	adjusted := make([]db.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		if !s.acceptsProtocol(session.Protocol) {
+			continue
+		}
+		if s.ForceNsfm {
+			session.Nsfm = true
+		}
+		session.Title = s.TitlePrefix + session.Title
+		adjusted = append(adjusted, session)
+	}
+	return adjusted
+}
@@ -32,6 +32,11 @@ func main() {
 	dbName := flag.String("d", "", "database path")
 	inclServer := flag.String("s", "", "include session from server")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+	}
 	flag.Parse()
 
 	if *showVersion {
@@ -63,27 +68,51 @@ func main() {
 
 	if len(*inclServer) > 0 {
 		cfg.IncludeServers = []string{*inclServer}
+		cfg.IncludeServer = nil
 	}
 
 	if cfg.Database == "none" {
 		cfg.Database = ""
 	}
 
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	adminUser, _ := os.LookupEnv("DRAWPILE_LISTSERVER_USER")
 	adminPass, _ := os.LookupEnv("DRAWPILE_LISTSERVER_PASS")
 
-	inclsrv.CacheTtl = time.Duration(cfg.IncludeCacheTtl) * time.Second
-	inclsrv.StatusCacheTtl = time.Duration(cfg.IncludeStatusCacheTtl) * time.Second
-	inclsrv.Timeout = time.Duration(cfg.IncludeTimeout) * time.Second
-	inclsrv.FetchFilteredSessionLists(db.QueryOptions{}, cfg.IncludeServers...)
+	if err := cfg.resolveIncludes(); err != nil {
+		log.Fatal(err)
+	}
+	inclsrv.StartPolling(cfg.includes...)
 
 	// Start the server
-	startServer(cfg, db.InitDatabase(cfg.Database, cfg.SessionTimeout), adminUser, adminPass)
+	database := db.InitDatabase(cfg.Database, cfg.SessionTimeout, db.CleanupSettings{
+		Interval:          time.Duration(cfg.CleanupInterval) * time.Minute,
+		TimedOutRetention: time.Duration(cfg.TimedOutRetention) * time.Minute,
+		KickedRetention:   time.Duration(cfg.KickedRetention) * time.Minute,
+		ArchiveRetention:  time.Duration(cfg.ArchiveRetention) * 24 * time.Hour,
+		HostBanRetention:  time.Duration(cfg.HostBanRetention) * 24 * time.Hour,
+	}, db.BackupSettings{
+		Dir:      cfg.BackupDir,
+		Interval: time.Duration(cfg.BackupInterval) * time.Minute,
+		Keep:     cfg.BackupKeep,
+	})
+	startServer(cfg, database, adminUser, adminPass)
 }
 
 type apiContext struct {
-	cfg *config
-	db  db.Database
+	cfg     *config
+	db      db.Database
+	changes *changeTracker
+	events  *eventHub
+	limits  *rateLimits
+
+	titleFilter *titleFilterCache
 }
 
 type apiContextKey = int
@@ -105,7 +134,14 @@ func normalizeSlashesHandler(next http.Handler) http.Handler {
 }
 
 func startServer(cfg *config, database db.Database, adminUser string, adminPass string) {
-	apictx := apiContext{cfg, database}
+	apictx := apiContext{
+		cfg:         cfg,
+		db:          database,
+		changes:     newChangeTracker(cfg),
+		limits:      newRateLimits(cfg),
+		titleFilter: newTitleFilterCache(cfg),
+	}
+	apictx.events = newEventHub(apictx)
 	router := mux.NewRouter()
 
 	if cfg.ProxyHeaders {
@@ -120,23 +156,50 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 
 	mainRouter := router.NewRoute().Subrouter()
 	mainRouter.Handle("/", ResponseHandler(apiRootHandler)).Methods(http.MethodGet, http.MethodOptions)
+	limits := apictx.limits
 	mainRouter.Handle("/sessions/", handlers.MethodHandler{
-		"GET":  ResponseHandler(apiSessionListHandler),
-		"POST": ResponseHandler(apiAnnounceSessionHandler),
-		"PUT":  ResponseHandler(apiBatchRefreshHandler),
+		"GET":  rateLimited(limits.list, ResponseHandler(apiSessionListHandler)),
+		"POST": rateLimited(limits.announce, ResponseHandler(apiAnnounceSessionHandler)),
+		"PUT":  rateLimited(limits.refresh, ResponseHandler(apiBatchRefreshHandler)),
+	})
+	mainRouter.Handle("/sessions/events/", handlers.MethodHandler{
+		"GET": rateLimited(limits.list, http.HandlerFunc(apiSessionEventsHandler)),
+	})
+	mainRouter.Handle("/sessions/ws/", handlers.MethodHandler{
+		"GET": rateLimited(limits.list, http.HandlerFunc(apiSessionWebSocketHandler)),
 	})
 	mainRouter.Handle("/sessions/{id:[0-9]+}/", handlers.MethodHandler{
-		"PUT":    ResponseHandler(apiRefreshHandler),
+		"PUT":    rateLimited(limits.refresh, ResponseHandler(apiRefreshHandler)),
 		"DELETE": ResponseHandler(apiUnlistHandler),
 	})
+	mainRouter.Handle("/push/{name:[A-Za-z0-9_-]+}/", handlers.MethodHandler{
+		"POST": rateLimited(limits.push, ResponseHandler(apiPushHandler)),
+	})
 	mainRouter.Handle("/join/{code:[A-Z]{5}}/",
 		ResponseHandler(apiRoomCodeHandler)).Methods(http.MethodGet, http.MethodOptions)
 
 	mainRouter.Use(handlers.CORS(
 		handlers.AllowedOrigins(cfg.AllowOrigins),
 		handlers.AllowedMethods([]string{http.MethodGet}),
+		handlers.ExposedHeaders([]string{"X-Total-Count"}),
+	))
+
+	// Reports come from list viewers on web pages, so unlike the rest of the
+	// public API, they need cross-origin POSTs with a JSON body
+	reportRouter := router.NewRoute().Subrouter()
+	reportRouter.Handle("/sessions/{host}/{port:[0-9]+}/{id}/report/", handlers.MethodHandler{
+		"POST": rateLimited(limits.report, ResponseHandler(apiReportSessionHandler)),
+	})
+	reportRouter.Use(handlers.CORS(
+		handlers.AllowedOrigins(cfg.AllowOrigins),
+		handlers.AllowedMethods([]string{http.MethodPost}),
+		handlers.AllowedHeaders([]string{"Content-Type"}),
 	))
 
+	if cfg.Premoderation && !cfg.EnableAdminApi {
+		log.Println("Warning: premoderation is enabled, but there's no admin API to approve sessions with")
+	}
+
 	if cfg.EnableAdminApi {
 		if database == nil {
 			log.Println("Not enabling admin API because of read-only mode")
@@ -150,6 +213,37 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 				"GET": ResponseHandler(apiAdminSessionListHandler),
 				"PUT": ResponseHandler(apiAdminSessionPutHandler),
 			})
+			adminRouter.Handle("/sessions/pending/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminPendingSessionListHandler),
+				"PUT": ResponseHandler(apiAdminPendingSessionPutHandler),
+			})
+			adminRouter.Handle("/reports/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminReportListHandler),
+				"PUT": ResponseHandler(apiAdminReportResolveHandler),
+			})
+			adminRouter.Handle("/reports/sessions/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminReportGroupListHandler),
+			})
+			adminRouter.Handle("/includes/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminIncludeListHandler),
+			})
+			adminRouter.Handle("/overlays/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminOverlayListHandler),
+				"PUT": ResponseHandler(apiAdminOverlayPutHandler),
+			})
+			adminRouter.Handle("/overlays/{id:[0-9]+}/", handlers.MethodHandler{
+				"DELETE": ResponseHandler(apiAdminOverlayDeleteHandler),
+			})
+			adminRouter.Handle("/archive/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminArchiveListHandler),
+			})
+			adminRouter.Handle("/cleanup/", handlers.MethodHandler{
+				"POST": ResponseHandler(apiAdminCleanupHandler),
+			})
+			adminRouter.Handle("/backups/", handlers.MethodHandler{
+				"GET":  ResponseHandler(apiAdminBackupListHandler),
+				"POST": ResponseHandler(apiAdminBackupCreateHandler),
+			})
 			adminRouter.Handle("/bans/", handlers.MethodHandler{
 				"GET":  ResponseHandler(apiAdminBanListHandler),
 				"POST": ResponseHandler(apiAdminBanCreateHandler),
@@ -158,6 +252,20 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 				"PUT":    ResponseHandler(apiAdminBanPutHandler),
 				"DELETE": ResponseHandler(apiAdminBanDeleteHandler),
 			})
+			adminRouter.Handle("/titlefilters/", handlers.MethodHandler{
+				"GET":  ResponseHandler(apiAdminTitleFilterListHandler),
+				"POST": ResponseHandler(apiAdminTitleFilterCreateHandler),
+			})
+			adminRouter.Handle("/titlefilters/{id:[0-9]+}/", handlers.MethodHandler{
+				"PUT":    ResponseHandler(apiAdminTitleFilterPutHandler),
+				"DELETE": ResponseHandler(apiAdminTitleFilterDeleteHandler),
+			})
+			adminRouter.Handle("/titlefilters/check/", handlers.MethodHandler{
+				"POST": ResponseHandler(apiAdminTitleFilterCheckHandler),
+			})
+			adminRouter.Handle("/ratelimits/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminRateLimitListHandler),
+			})
 			adminRouter.Handle("/roles/", handlers.MethodHandler{
 				"GET":  ResponseHandler(apiAdminRoleListHandler),
 				"POST": ResponseHandler(apiAdminRoleCreateHandler),
@@ -177,6 +285,9 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 			adminRouter.Handle("/users/self/password/", handlers.MethodHandler{
 				"PUT": ResponseHandler(apiAdminUserSelfPasswordPutHandler),
 			})
+			adminRouter.Handle("/audit/", handlers.MethodHandler{
+				"GET": ResponseHandler(apiAdminAuditListHandler),
+			})
 
 			adminRouter.Use(handlers.CORS(
 				handlers.AllowedOrigins(cfg.AllowOrigins),
@@ -200,8 +311,12 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 		handler = handlers.LoggingHandler(os.Stdout, handler)
 	}
 
-	if len(cfg.IncludeServers) > 0 {
-		log.Println("Including session from:", cfg.IncludeServers)
+	for _, s := range cfg.includes {
+		if s.IsPush() {
+			log.Println("Including sessions pushed to:", "/push/"+s.Name+"/")
+		} else {
+			log.Println("Including sessions from:", s.DisplayUrl())
+		}
 	}
 
 	c := make(chan os.Signal, 1)
@@ -209,6 +324,7 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 		Addr:    cfg.Listen,
 		Handler: handler,
 	}
+	srv.RegisterOnShutdown(apictx.events.close)
 
 	go func() {
 		log.Println("Listening at", cfg.Listen)
@@ -227,6 +343,8 @@ func startServer(cfg *config, database db.Database, adminUser string, adminPass
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.SessionTimeout)*time.Second)
 		defer cancel()
 		srv.Shutdown(ctx)
+		apictx.events.wait(ctx)
+		inclsrv.StopPolling()
 		if err := database.Close(); err != nil {
 			log.Println("Error closing database:", err)
 		}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/drawpile/listserver/inclsrv"
+	"github.com/gorilla/mux"
+)
+
+// Snapshots of busy servers can get fairly big, but not this big
+const maxPushSize = 4 * 1024 * 1024
+
+// Receive a session snapshot pushed by an included server. The request must
+// be signed with the server's shared secret.
+func apiPushHandler(r *http.Request) http.Handler {
+	server := inclsrv.FindPushServer(mux.Vars(r)["name"])
+	if server == nil {
+		return ErrorResponse("No such push server", http.StatusNotFound)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPushSize+1))
+	if err != nil {
+		return ErrorResponse("Couldn't read request body", http.StatusBadRequest)
+	} else if len(body) > maxPushSize {
+		return ErrorResponse("Request body is too large", http.StatusRequestEntityTooLarge)
+	}
+
+	timestamp := r.Header.Get("X-Drawpile-Timestamp")
+	signature := r.Header.Get("X-Drawpile-Signature")
+	if err := server.VerifyPush(timestamp, signature, body, time.Now()); err != nil {
+		log.Printf("Rejected push from %s (%s): %v\n", server.Name, r.RemoteAddr, err)
+		return ErrorResponse(err.Error(), http.StatusUnauthorized)
+	}
+
+	var push inclsrv.PushRequest
+	if err := json.Unmarshal(body, &push); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	}
+
+	count, err := server.ApplyPush(&push)
+	if errors.Is(err, inclsrv.ErrPushNoSnapshot) {
+		return ErrorResponse(err.Error(), http.StatusConflict)
+	} else if err != nil {
+		return ErrorResponse(err.Error(), http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	ctx.sessionsChanged()
+
+	return JsonResponseOk(map[string]interface{}{
+		"status":   "ok",
+		"sessions": count,
+	})
+}
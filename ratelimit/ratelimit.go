@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets that have filled up again are dropped this often, so that clients
+// that went away don't take up memory forever
+const pruneInterval = 10 * time.Minute
+
+// How many limited keys Status lists at most
+const maxListedKeys = 100
+
+// A token bucket rate limiter keyed by e.g. client IP address. Every key gets
+// a bucket holding up to burst tokens that refills at the configured rate,
+// each request takes one token. A nil limiter allows everything.
+type Limiter struct {
+	name      string
+	perMinute int
+	burst     int
+	rate      float64 // tokens per second
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	rejected  int64
+}
+
+type bucket struct {
+	tokens   float64
+	updated  time.Time
+	rejected int64
+}
+
+// Current state of a limiter, as shown in the admin API
+type Status struct {
+	Name      string      `json:"name"`
+	PerMinute int         `json:"perminute"`
+	Burst     int         `json:"burst"`
+	Tracked   int         `json:"tracked"`
+	Rejected  int64       `json:"rejected"`
+	Limited   []KeyStatus `json:"limited"`
+}
+
+// A key that had requests rejected since its bucket was last full
+type KeyStatus struct {
+	Key        string  `json:"key"`
+	Tokens     float64 `json:"tokens"`
+	Rejected   int64   `json:"rejected"`
+	RetryAfter int     `json:"retryafter"` // seconds, zero if not limited right now
+}
+
+// Create a limiter that allows perMinute requests per key on average and up
+// to burst at once. Returns nil if perMinute isn't positive, i.e. the limit is
+// disabled. The burst is at least one.
+func New(name string, perMinute int, burst int) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		name:      name,
+		perMinute: perMinute,
+		burst:     burst,
+		rate:      float64(perMinute) / 60,
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// Refill the bucket for the time passed since it was last used.
+// Must be called with the lock held.
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.burst), b.tokens+elapsed*l.rate)
+		b.updated = now
+	}
+}
+
+func (l *Limiter) retryAfter(b *bucket) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1-b.tokens)/l.rate*1000)) * time.Millisecond
+}
+
+// Take a token for the key. If there is none left, returns false and how long
+// to wait until the next one is available.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+
+	b, found := l.buckets[key]
+	if found {
+		l.refill(b, now)
+	} else {
+		b = &bucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	if b.tokens < 1 {
+		b.rejected++
+		l.rejected++
+		return false, l.retryAfter(b)
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// Drop the buckets that are full, they're no different from new ones.
+// Must be called with the lock held.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (l *Limiter) Status(now time.Time) Status {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	status := Status{
+		Name:      l.name,
+		PerMinute: l.perMinute,
+		Burst:     l.burst,
+		Tracked:   len(l.buckets),
+		Rejected:  l.rejected,
+		Limited:   []KeyStatus{},
+	}
+
+	for key, b := range l.buckets {
+		if b.rejected == 0 {
+			continue
+		}
+		l.refill(b, now)
+		status.Limited = append(status.Limited, KeyStatus{
+			Key:        key,
+			Tokens:     math.Floor(b.tokens*100) / 100,
+			Rejected:   b.rejected,
+			RetryAfter: RetryAfterSeconds(l.retryAfter(b)),
+		})
+	}
+
+	sort.Slice(status.Limited, func(i, j int) bool {
+		if status.Limited[i].Rejected != status.Limited[j].Rejected {
+			return status.Limited[i].Rejected > status.Limited[j].Rejected
+		}
+		return status.Limited[i].Key < status.Limited[j].Key
+	})
+	if len(status.Limited) > maxListedKeys {
+		status.Limited = status.Limited[:maxListedKeys]
+	}
+
+	return status
+}
+
+// Round a wait time up to whole seconds, as used in Retry-After headers
+func RetryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// The key to limit a client IP address by. IPv6 clients usually get a whole
+// /64 network to themselves, so they're limited by that instead of single
+// addresses.
+func IpKey(ip net.IP) string {
+	if ip.To4() == nil && len(ip) == net.IPv6len {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New("test", 60, 3)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("Request %d within burst rejected", i+1)
+		}
+	}
+
+	if ok, wait := l.Allow("a", now); ok {
+		t.Fatal("Request over burst allowed")
+	} else if wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %v", wait)
+	}
+
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Error("Other key was limited too")
+	}
+
+	if ok, _ := l.Allow("a", now.Add(time.Second)); !ok {
+		t.Error("Request after refill rejected")
+	}
+
+	status := l.Status(now.Add(time.Second))
+	if status.Tracked != 2 || status.Rejected != 1 || len(status.Limited) != 1 || status.Limited[0].Key != "a" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// Full buckets are forgotten
+	l.Allow("c", now.Add(pruneInterval))
+	if status := l.Status(now.Add(pruneInterval)); status.Tracked != 1 {
+		t.Errorf("Expected only the new bucket after pruning, got %+v", status)
+	}
+}
+
+func TestDisabledLimiter(t *testing.T) {
+	l := New("test", 0, 10)
+	if l != nil {
+		t.Fatal("Limiter without a rate was created")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a", time.Now()); !ok {
+			t.Fatal("Disabled limiter rejected a request")
+		}
+	}
+}
+
+func TestIpKey(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"192.168.1.1", "192.168.1.1"},
+		{"::ffff:192.168.1.1", "192.168.1.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+	}
+
+	for _, test := range tests {
+		if key := IpKey(net.ParseIP(test.ip)); key != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.ip, test.expected, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drawpile/listserver/ratelimit"
+)
+
+// Request rate limits. Announcements are limited per client IP and per
+// announced host, refreshes, list reads, reports and pushes only per client IP.
+// Disabled limits are nil.
+type rateLimits struct {
+	announce     *ratelimit.Limiter
+	announceHost *ratelimit.Limiter
+	refresh      *ratelimit.Limiter
+	list         *ratelimit.Limiter
+	report       *ratelimit.Limiter
+	push         *ratelimit.Limiter
+}
+
+func newRateLimits(cfg *config) *rateLimits {
+	return &rateLimits{
+		announce:     ratelimit.New("announce", cfg.AnnounceRateLimit, cfg.AnnounceRateBurst),
+		announceHost: ratelimit.New("announcehost", cfg.AnnounceHostRateLimit, cfg.AnnounceHostRateBurst),
+		refresh:      ratelimit.New("refresh", cfg.RefreshRateLimit, cfg.RefreshRateBurst),
+		list:         ratelimit.New("list", cfg.ListRateLimit, cfg.ListRateBurst),
+		report:       ratelimit.New("report", cfg.ReportRateLimit, cfg.ReportRateBurst),
+		push:         ratelimit.New("push", cfg.PushRateLimit, cfg.PushRateBurst),
+	}
+}
+
+func (rl *rateLimits) enabled() []*ratelimit.Limiter {
+	limiters := []*ratelimit.Limiter{}
+	for _, l := range []*ratelimit.Limiter{rl.announce, rl.announceHost, rl.refresh, rl.list, rl.report, rl.push} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
+
+func rateLimitedResponse(wait time.Duration) http.Handler {
+	return ErrorResponse("Too many requests, try again later", http.StatusTooManyRequests).(JsonResponseHandler).
+		WithHeader("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(wait)))
+}
+
+// Limit the requests to the handler per client IP. The address has already
+// been taken from the proxy headers at this point, if they're enabled.
+func rateLimited(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientIP := parseIp(r.RemoteAddr); clientIP != nil {
+			if ok, wait := limiter.Allow(ratelimit.IpKey(clientIP), time.Now()); !ok {
+				rateLimitedResponse(wait).ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiAdminRateLimitListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessView) {
+		return ErrorResponse("You're not allowed to view rate limits", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+
+	now := time.Now()
+	statuses := []ratelimit.Status{}
+	for _, l := range ctx.limits.enabled() {
+		statuses = append(statuses, l.Status(now))
+	}
+
+	return JsonResponseOk(statuses)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drawpile/listserver/db"
+	"github.com/drawpile/listserver/inclsrv"
+	"github.com/gorilla/mux"
+)
+
+// What a session can be reported for
+var reportCategories = map[string]bool{
+	"title": true, // offensive title
+	"nsfm":  true, // NSFM content in a session that isn't tagged as such
+	"spam":  true,
+	"other": true,
+}
+
+const maxReportMessageLength = 1000
+
+type sessionReportRequest struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// Find a listed session the way the public session list shows it, either
+// announced here or from an included server
+func findListedSession(ctx apiContext, host string, port int, id string, reqCtx context.Context) (*db.SessionInfo, bool, error) {
+	opts := db.QueryOptions{Nsfm: true, Host: host}
+	matches := func(s *db.SessionInfo) bool {
+		return strings.EqualFold(s.Host, host) && s.Port == port && s.Id == id
+	}
+
+	sessions, err := ctx.db.QuerySessionList(opts, reqCtx)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range sessions {
+		if matches(&sessions[i]) {
+			return &sessions[i], false, nil
+		}
+	}
+
+	if ctx.cfg.HasIncludes() {
+		overlays, err := ctx.db.QuerySessionOverlays(reqCtx)
+		if err != nil {
+			return nil, false, err
+		}
+		sessions = inclsrv.CachedSessionLists(opts, false, db.NewSessionOverlayIndex(overlays))
+		for i := range sessions {
+			if matches(&sessions[i]) {
+				return &sessions[i], true, nil
+			}
+		}
+	}
+
+	return nil, false, nil
+}
+
+// Report a listed session to the admins
+func apiReportSessionHandler(r *http.Request) http.Handler {
+	clientIP := parseIp(r.RemoteAddr)
+	if clientIP == nil || clientIP.IsUnspecified() {
+		log.Println("Couldn't parse IP address:", r.RemoteAddr)
+		return ErrorResponse("Server is misconfigured", http.StatusInternalServerError)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	if ctx.db == nil {
+		return ErrorResponse("Reports are not accepted on this server", http.StatusNotFound)
+	}
+
+	vars := mux.Vars(r)
+	port, err := strconv.Atoi(vars["port"])
+	if err != nil || port < 1 || port > 0xffff {
+		return ErrorResponse("Invalid port", http.StatusBadRequest)
+	}
+
+	var info sessionReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	}
+
+	if !reportCategories[info.Category] {
+		return ErrorResponse("Unknown report category", http.StatusBadRequest)
+	}
+	info.Message = strings.TrimSpace(info.Message)
+	if utf8.RuneCountInString(info.Message) > maxReportMessageLength {
+		return ErrorResponse(fmt.Sprintf("Message can't be longer than %d characters", maxReportMessageLength), http.StatusBadRequest)
+	}
+
+	session, included, err := findListedSession(ctx, vars["host"], port, vars["id"], r.Context())
+	if err != nil {
+		log.Println("Find reported session error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if session == nil {
+		return ErrorResponse("Session not found", http.StatusNotFound)
+	}
+
+	_, err = ctx.db.InsertSessionReport(db.SessionReport{
+		Host:      session.Host,
+		Port:      session.Port,
+		SessionId: session.Id,
+		Included:  included,
+		Title:     session.Title,
+		Owner:     session.Owner,
+		Category:  info.Category,
+		Message:   info.Message,
+		ClientIp:  clientIP.String(),
+	}, r.Context())
+	if err != nil {
+		log.Println("Session report insertion error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+func apiAdminReportListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view reports", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	includeResolved := r.URL.Query().Get("resolved") == "true"
+
+	reports, err := ctx.db.AdminQuerySessionReports(includeResolved, r.Context())
+	if err != nil {
+		log.Println("List session reports error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(reports)
+}
+
+// Open reports, grouped by the session they're about
+func apiAdminReportGroupListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessView) {
+		return ErrorResponse("You're not allowed to view reports", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+
+	reports, err := ctx.db.AdminQuerySessionReports(false, r.Context())
+	if err != nil {
+		log.Println("List session reports error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(db.GroupSessionReports(reports))
+}
+
+type adminReportResolveRequest struct {
+	Ids          []int64 `json:"ids"`
+	Resolution   string  `json:"resolution"`
+	Unlist       bool    `json:"unlist"`
+	UnlistReason string  `json:"unlistreason"`
+	Ban          string  `json:"ban"` // host, owner or session, nothing if empty
+	BanExpires   string  `json:"banexpires"`
+}
+
+// A session some of the resolved reports are about
+type reportedSession struct {
+	host      string
+	port      int
+	sessionId string
+	owner     string
+	included  bool
+}
+
+// Resolve reports, optionally unlisting the reported sessions and banning
+// them in the same go
+func apiAdminReportResolveHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permSessions, accessManage) {
+		return ErrorResponse("You're not allowed to resolve reports", http.StatusForbidden)
+	}
+
+	var info adminReportResolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	} else if len(info.Ids) == 0 {
+		return ErrorResponse("No ids given", http.StatusBadRequest)
+	}
+
+	if info.Ban != "" {
+		if !adminAccess(r, permHostBans, accessManage) {
+			return ErrorResponse("You're not allowed to create bans", http.StatusForbidden)
+		}
+		switch info.Ban {
+		case db.BanTypeHost, db.BanTypeOwner, db.BanTypeSession:
+		default:
+			return ErrorResponse(fmt.Sprintf("Can't ban reported sessions by %q", info.Ban), http.StatusBadRequest)
+		}
+		if info.BanExpires != "" {
+			if _, err := time.Parse("2006-01-02", info.BanExpires); err != nil {
+				return ErrorResponse("Ban expiry has wrong format, should be YYYY-mm-dd", http.StatusBadRequest)
+			}
+		}
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	adminCtx := r.Context().Value(adminCtxKey).(adminContext)
+
+	openReports, err := ctx.db.AdminQuerySessionReports(false, r.Context())
+	if err != nil {
+		log.Println("List session reports error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	wanted := map[int64]bool{}
+	for _, id := range info.Ids {
+		wanted[id] = true
+	}
+	reportIds := []int64{}
+	sessions := []reportedSession{}
+	seen := map[reportedSession]bool{}
+	for _, report := range openReports {
+		if wanted[report.Id] {
+			reportIds = append(reportIds, report.Id)
+			s := reportedSession{
+				strings.ToLower(report.Host), report.Port, report.SessionId, report.Owner, report.Included,
+			}
+			if !seen[s] {
+				sessions = append(sessions, s)
+				seen[s] = true
+			}
+		}
+	}
+	if len(reportIds) == 0 {
+		return ErrorResponse("No open reports with these ids", http.StatusNotFound)
+	}
+
+	// Check the bans before changing anything
+	type ban struct{ host, pattern string }
+	bans := []ban{}
+	if info.Ban != "" {
+		for _, s := range sessions {
+			if s.included {
+				return ErrorResponse("Sessions from included servers can't be banned, unlist them instead", http.StatusBadRequest)
+			}
+			var host, pattern string
+			switch info.Ban {
+			case db.BanTypeHost:
+				host = s.host
+			case db.BanTypeOwner:
+				pattern = s.owner
+			case db.BanTypeSession:
+				host, pattern = s.host, s.sessionId
+			}
+			host, pattern, err := db.NormalizeBan(info.Ban, host, pattern)
+			if err != nil {
+				return ErrorResponse(err.Error(), http.StatusBadRequest)
+			}
+			bans = append(bans, ban{host, pattern})
+		}
+	}
+
+	actions := []string{}
+
+	unlisted := 0
+	if info.Unlist {
+		unlisted, err = unlistReportedSessions(ctx, sessions, strings.TrimSpace(info.UnlistReason), r.Context())
+		if err != nil {
+			log.Println("Unlist reported sessions error:", err)
+			return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+		}
+		ctx.sessionsChanged()
+		actions = append(actions, fmt.Sprintf("Unlisted %d session(s)", unlisted))
+	}
+
+	banIds := []int64{}
+	notes := fmt.Sprintf("Reports %s", formatIds(reportIds))
+	var banErr error
+	for _, b := range bans {
+		id, err := ctx.db.AdminCreateHostBan(info.Ban, b.host, b.pattern, info.BanExpires, notes, r.Context())
+		if err != nil {
+			banErr = err
+			break
+		}
+		banIds = append(banIds, id)
+	}
+	if len(banIds) > 0 {
+		actions = append(actions, fmt.Sprintf("Created %s ban(s) %s", info.Ban, formatIds(banIds)))
+	}
+
+	changed := len(actions) > 0
+	if banErr != nil {
+		log.Println("Create host ban error:", banErr)
+		if !changed {
+			return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+		}
+		actions = append(actions, "Creating the other bans failed")
+	} else if resolution := strings.TrimSpace(info.Resolution); resolution != "" {
+		actions = append(actions, resolution)
+	}
+
+	// What has been done before a failure can't be undone, so it's recorded
+	// on the reports and in the audit log all the same
+	resolution := strings.Join(actions, ". ")
+	resolved, err := ctx.db.AdminResolveSessionReports(reportIds, adminCtx.userName, resolution, r.Context())
+	if err != nil {
+		log.Println("Resolve session reports error:", err)
+		resolved = reportIds
+	}
+	if err == nil || changed {
+		recordAudit(r, "reports.resolve", resolved, nil, map[string]interface{}{
+			"resolution": resolution,
+			"unlisted":   unlisted,
+			"bans":       banIds,
+		})
+	}
+	if err != nil || banErr != nil {
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status":   "ok",
+		"resolved": resolved,
+		"unlisted": unlisted,
+		"bans":     banIds,
+	})
+}
+
+// Unlist reported sessions that are still listed. Included sessions get a
+// moderation overlay, keeping the NSFM tag of an existing one.
+func unlistReportedSessions(ctx apiContext, sessions []reportedSession, reason string, reqCtx context.Context) (int, error) {
+	if reason == "" {
+		reason = "Unlisted because of reports"
+	}
+
+	hasIncluded, hasOwn := false, false
+	for _, s := range sessions {
+		if s.included {
+			hasIncluded = true
+		} else {
+			hasOwn = true
+		}
+	}
+
+	var overlays db.SessionOverlayIndex
+	if hasIncluded {
+		overlayList, err := ctx.db.QuerySessionOverlays(reqCtx)
+		if err != nil {
+			return 0, err
+		}
+		overlays = db.NewSessionOverlayIndex(overlayList)
+	}
+
+	var ownSessions []db.AdminSession
+	if hasOwn {
+		var err error
+		ownSessions, err = ctx.db.AdminQuerySessions(reqCtx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	unlisted := 0
+	ids := []int64{}
+	for _, s := range sessions {
+		if s.included {
+			overlay := db.SessionOverlay{
+				Host:         s.host,
+				Port:         s.port,
+				SessionId:    s.sessionId,
+				Unlisted:     true,
+				UnlistReason: reason,
+			}
+			if o := overlays.Find(s.host, s.port, s.sessionId); o != nil {
+				overlay.Nsfm = o.Nsfm
+			}
+			if _, err := ctx.db.AdminPutSessionOverlay(overlay, reqCtx); err != nil {
+				return unlisted, err
+			}
+			unlisted++
+		} else {
+			for _, o := range ownSessions {
+				if strings.EqualFold(o.Host, s.host) && o.Port == s.port && o.SessionId == s.sessionId &&
+					!o.Unlisted && !o.TimedOut {
+					ids = append(ids, o.Id)
+				}
+			}
+		}
+	}
+
+	if len(ids) > 0 {
+		updated, err := ctx.db.AdminUpdateSessions(ids, true, reason, reqCtx)
+		if err != nil {
+			return unlisted, err
+		}
+		unlisted += len(updated)
+	}
+
+	return unlisted, nil
+}
+
+func formatIds(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = "#" + strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ", ")
+}
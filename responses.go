@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ResponseHandler func(*http.Request) http.Handler
@@ -16,9 +21,14 @@ func (f ResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type JsonResponseHandler struct {
 	Body       interface{}
 	StatusCode int
+	Headers    http.Header
+
+	// Conditional GET support, see WithValidators
+	Validate     bool
+	LastModified time.Time
 }
 
-func (jr JsonResponseHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+func (jr JsonResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	content, err := json.MarshalIndent(jr.Body, "", "\t")
 	if err != nil {
 		log.Println("JSON response marshalling error:", err.Error())
@@ -26,6 +36,23 @@ func (jr JsonResponseHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request)
 		return
 	}
 
+	// Added to the headers set by middleware, e.g. the CORS handler's Vary
+	for key, values := range jr.Headers {
+		w.Header()[key] = append(w.Header()[key], values...)
+	}
+
+	if jr.Validate && jr.StatusCode == http.StatusOK {
+		etag := responseETag(content, jr.Headers)
+		w.Header().Set("ETag", etag)
+		if !jr.LastModified.IsZero() {
+			w.Header().Set("Last-Modified", jr.LastModified.UTC().Format(http.TimeFormat))
+		}
+		if isNotModified(r, etag, jr.LastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
 
@@ -34,11 +61,72 @@ func (jr JsonResponseHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request)
 }
 
 func JsonResponseOk(body interface{}) JsonResponseHandler {
-	return JsonResponseHandler{body, http.StatusOK}
+	return JsonResponseHandler{Body: body, StatusCode: http.StatusOK}
 }
 
 func JsonResponseCreated(body interface{}) JsonResponseHandler {
-	return JsonResponseHandler{body, http.StatusCreated}
+	return JsonResponseHandler{Body: body, StatusCode: http.StatusCreated}
+}
+
+// Returns a copy of the response with an extra header set
+func (jr JsonResponseHandler) WithHeader(key, value string) JsonResponseHandler {
+	headers := jr.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set(key, value)
+	jr.Headers = headers
+	return jr
+}
+
+// Returns a copy of the response that has an ETag and answers conditional
+// requests with 304 Not Modified. If lastModified is zero, only the ETag is
+// used.
+func (jr JsonResponseHandler) WithValidators(lastModified time.Time) JsonResponseHandler {
+	jr.Validate = true
+	jr.LastModified = lastModified
+	return jr
+}
+
+// The extra headers are part of the representation too, e.g. X-Total-Count
+func responseETag(content []byte, headers http.Header) string {
+	hash := sha256.New()
+	hash.Write(content)
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hash.Write([]byte("\n" + key + ": " + strings.Join(headers[key], ", ")))
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// If-None-Match takes precedence over If-Modified-Since, as per RFC 7232
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
 }
 
 func ErrorResponse(message string, status int) http.Handler {
@@ -0,0 +1,197 @@
+package titlefilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// What a rule's pattern is
+const (
+	KindWord  = "word"  // matched anywhere in the title, after folding both
+	KindRegex = "regex" // case-insensitive regular expression matched against the folded title
+)
+
+// What happens to a title a rule matches
+const (
+	ActionReject = "reject" // the announcement or refresh is refused
+	ActionNsfm   = "nsfm"   // the session is marked as NSFM
+	ActionMask   = "mask"   // the matched text is replaced with asterisks
+	ActionFlag   = "flag"   // the session is listed, but flagged for review by an admin
+)
+
+// Shown to clients whose title was rejected
+const RejectedMessage = "The session title contains words that are not allowed here"
+
+type Rule struct {
+	Kind    string
+	Pattern string
+	Action  string
+}
+
+type compiledRule struct {
+	Rule
+	word  string
+	regex *regexp.Regexp
+}
+
+// A set of title filter rules
+type Filter struct {
+	rules []compiledRule
+}
+
+// Outcome of running a title through a filter
+type Result struct {
+	Title    string   // the normalized title with masked text replaced
+	Rejected bool     // a reject rule matched
+	Nsfm     bool     // an nsfm rule matched
+	Flagged  []string // patterns of the matching flag rules
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{Rule: rule}
+
+	switch rule.Action {
+	case ActionReject, ActionNsfm, ActionMask, ActionFlag:
+	default:
+		return compiled, fmt.Errorf("Unknown action '%s'", rule.Action)
+	}
+
+	switch rule.Kind {
+	case KindWord:
+		compiled.word = Fold(rule.Pattern)
+		if compiled.word == "" {
+			return compiled, fmt.Errorf("Word can't be blank")
+		}
+	case KindRegex:
+		if rule.Pattern == "" {
+			return compiled, fmt.Errorf("Regular expression can't be blank")
+		}
+		if r, ok := findUnfoldedRune(rule.Pattern); ok {
+			return compiled, fmt.Errorf("Regular expression contains '%c', which folded titles never do", r)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return compiled, fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		re := regexp.MustCompile("(?i)" + rule.Pattern)
+		if re.MatchString("") {
+			return compiled, fmt.Errorf("Regular expression matches every title")
+		}
+		compiled.regex = re
+	default:
+		return compiled, fmt.Errorf("Unknown filter type '%s'", rule.Kind)
+	}
+
+	return compiled, nil
+}
+
+// Regular expressions are matched against the folded title, so characters
+// that folding changes other than by lowercasing would never match. Escape
+// sequences for them can't be caught here.
+func findUnfoldedRune(pattern string) (rune, bool) {
+	for _, r := range pattern {
+		if Fold(string(r)) != string(unicode.ToLower(r)) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// Check that a rule can be used
+func Validate(rule Rule) error {
+	_, err := compileRule(rule)
+	return err
+}
+
+// Create a filter from the given rules. Invalid rules are skipped.
+func New(rules []Rule) *Filter {
+	f := &Filter{}
+	for _, rule := range rules {
+		if compiled, err := compileRule(rule); err == nil {
+			f.rules = append(f.rules, compiled)
+		}
+	}
+	return f
+}
+
+// Byte ranges of the folded string the rule matches
+func (r *compiledRule) find(folded string) [][]int {
+	if r.regex != nil {
+		return r.regex.FindAllStringIndex(folded, -1)
+	}
+
+	var matches [][]int
+	for offset := 0; offset < len(folded); {
+		i := strings.Index(folded[offset:], r.word)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		matches = append(matches, []int{start, start + len(r.word)})
+		offset = start + len(r.word)
+	}
+	return matches
+}
+
+// Run a title through the filter. The title is normalized first and masks
+// are applied to the normalized title. A nil filter only normalizes it.
+func (f *Filter) Check(title string) Result {
+	title = Normalize(title)
+	result := Result{Title: title}
+	if f == nil || len(f.rules) == 0 {
+		return result
+	}
+
+	folded, spans := fold(title)
+	var masked []span
+
+	for i := range f.rules {
+		rule := &f.rules[i]
+		matches := rule.find(folded)
+		if len(matches) == 0 {
+			continue
+		}
+
+		switch rule.Action {
+		case ActionReject:
+			result.Rejected = true
+		case ActionNsfm:
+			result.Nsfm = true
+		case ActionMask:
+			for _, m := range matches {
+				if m[1] > m[0] {
+					masked = append(masked, span{spans[m[0]].start, spans[m[1]-1].end})
+				}
+			}
+		case ActionFlag:
+			result.Flagged = append(result.Flagged, rule.Pattern)
+		}
+	}
+
+	if len(masked) > 0 {
+		result.Title = mask(title, masked)
+	}
+	return result
+}
+
+// Replace every character in the given ranges with an asterisk. Whitespace
+// is kept, so that masked words can still be told apart.
+func mask(s string, spans []span) string {
+	var sb strings.Builder
+	for i, r := range s {
+		inSpan := false
+		for _, sp := range spans {
+			if i >= sp.start && i < sp.end {
+				inSpan = true
+				break
+			}
+		}
+		if inSpan && !unicode.IsSpace(r) {
+			sb.WriteRune('*')
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
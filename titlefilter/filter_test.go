@@ -0,0 +1,89 @@
+package titlefilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"Hello", "hello"},
+		{"ＮＳＦＷ", "nsfw"},                   // fullwidth
+		{"𝐍𝐒𝐅𝐖", "nsfw"},                   // mathematical bold
+		{"N\u200bS\u200dF\u2060W", "nsfw"}, // zero width characters
+		{"NЅFW", "nsfw"},                   // Cyrillic Dze
+		{"nѕfω", "nsfw"},                   // Cyrillic Dze, Greek omega
+		{"Ñ̷S̈F̤W", "nsfw"},                // combining marks
+		{"N\u3164SFW\u0007", "nsfw"},       // filler and control characters
+		{"Café ①", "cafe 1"},
+	}
+
+	for _, test := range tests {
+		if folded := Fold(test.in); folded != test.expected {
+			t.Errorf("Fold(%q): expected %q, got %q", test.in, test.expected, folded)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []Rule{
+		{KindWord, "", ActionReject},
+		{KindWord, "\u200b", ActionReject},
+		{KindRegex, "(", ActionReject},
+		{KindRegex, "x*", ActionReject},
+		{KindWord, "x", "delete"},
+		{"glob", "x", ActionReject},
+		{KindRegex, "café", ActionReject},
+		{KindRegex, "ｘ+", ActionReject},
+	}
+	for _, rule := range invalid {
+		if Validate(rule) == nil {
+			t.Errorf("Expected %+v to be invalid", rule)
+		}
+	}
+
+	for _, pattern := range []string{`\bbad\b`, `NSFW|18\+`} {
+		if err := Validate(Rule{KindRegex, pattern, ActionMask}); err != nil {
+			t.Error("Valid rule rejected:", err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f := New([]Rule{
+		{KindWord, "NSFW", ActionNsfm},
+		{KindWord, "darn", ActionMask},
+		{KindRegex, `\bheck+\b`, ActionMask},
+		{KindWord, "forbidden", ActionReject},
+		{KindRegex, `free\s*art`, ActionFlag},
+		{KindRegex, "(", ActionReject}, // skipped
+	})
+
+	tests := []struct {
+		title    string
+		expected Result
+	}{
+		{"Just drawing", Result{Title: "Just drawing"}},
+		{"ｎｓｆｗ stuff", Result{Title: "nsfw stuff", Nsfm: true}},
+		{"Dа\u200brn it, HECKK", Result{Title: "**** it, *****"}},
+		{"Café\u0007 ① darn", Result{Title: "Café 1 ****"}},
+		{"daaarn checkers", Result{Title: "daaarn checkers"}},
+		{"DARN darn", Result{Title: "**** ****"}},
+		{"F0rbidden fоrbіddеn", Result{Title: "F0rbidden fоrbіddеn", Rejected: true}},
+		{"FREE ART", Result{Title: "FREE ART", Flagged: []string{`free\s*art`}}},
+	}
+
+	for _, test := range tests {
+		if result := f.Check(test.title); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("Check(%q): expected %+v, got %+v", test.title, test.expected, result)
+		}
+	}
+
+	var nilFilter *Filter
+	if result := nilFilter.Check("ｄａｒｎ\u200b\u3164\u2800"); result.Title != "darn" {
+		t.Error("Nil filter didn't only normalize the title:", result.Title)
+	}
+}
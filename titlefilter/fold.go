@@ -0,0 +1,106 @@
+package titlefilter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Letters from other scripts that look like Latin ones. Compatibility
+// normalization already takes care of fullwidth, mathematical and other
+// styled variants of Latin letters, but not of these.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'г': 'r', 'е': 'e', 'з': '3',
+	'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'п': 'n', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ь': 'b', 'ѕ': 's', 'і': 'i',
+	'ј': 'j', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	'А': 'a', 'В': 'b', 'Е': 'e', 'З': '3', 'К': 'k', 'М': 'm', 'Н': 'h',
+	'О': 'o', 'Р': 'p', 'С': 'c', 'Т': 't', 'У': 'y', 'Х': 'x', 'Ѕ': 's',
+	'І': 'i', 'Ј': 'j', 'Ԛ': 'q', 'Ԝ': 'w', 'Ӏ': 'l',
+	// Greek
+	'α': 'a', 'β': 'b', 'γ': 'y', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	'Α': 'a', 'Β': 'b', 'Ε': 'e', 'Ζ': 'z', 'Η': 'h', 'Ι': 'i', 'Κ': 'k',
+	'Μ': 'm', 'Ν': 'n', 'Ο': 'o', 'Ρ': 'p', 'Τ': 't', 'Υ': 'y', 'Χ': 'x',
+	// Latin letters that don't decompose into a base letter and a mark
+	'ı': 'i', 'ȷ': 'j', 'ł': 'l', 'đ': 'd', 'ħ': 'h', 'ø': 'o', 'ŧ': 't',
+	'ɡ': 'g', 'ɑ': 'a', 'ʏ': 'y', 'ɪ': 'i', 'ʀ': 'r', 'ᴀ': 'a', 'ᴄ': 'c',
+	'ᴅ': 'd', 'ᴇ': 'e', 'ᴊ': 'j', 'ᴋ': 'k', 'ᴍ': 'm', 'ɴ': 'n', 'ᴏ': 'o',
+	'ᴘ': 'p', 'ᴛ': 't', 'ᴜ': 'u', 'ᴠ': 'v', 'ᴡ': 'w', 'ᴢ': 'z',
+}
+
+// Blank characters that aren't in the format category, but are commonly used
+// to hide text or to pad it out
+var invisibles = map[rune]bool{
+	'ᅟ': true, // Hangul choseong filler
+	'ᅠ': true, // Hangul jungseong filler
+	'⠀': true, // Braille pattern blank
+	'ㅤ': true, // Hangul filler
+	'ﾠ': true, // halfwidth Hangul filler
+}
+
+// Range of the original string a folded character came from
+type span struct {
+	start int
+	end   int
+}
+
+func isStripped(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Cc, unicode.Cf, unicode.Co) ||
+		invisibles[r] || r == utf8.RuneError
+}
+
+// Bring a title into the form it's listed with: compatibility normalized and
+// with control, format and other invisible characters, like zero-width spaces
+// and Hangul fillers, removed. Unlike folding, this leaves letters, accents
+// and case alone.
+func Normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.In(r, unicode.Cc, unicode.Cf) || invisibles[r] {
+			return -1
+		}
+		return r
+	}, norm.NFKC.String(s))
+}
+
+// Bring a string into the form filters are matched against: compatibility
+// normalized, with combining marks, control and invisible characters
+// removed, lookalike letters from other scripts replaced by Latin ones and
+// lowercased.
+func Fold(s string) string {
+	folded, _ := fold(s)
+	return folded
+}
+
+// Like Fold, but also returns the range of the original string each byte of
+// the folded string came from
+func fold(s string) (string, []span) {
+	var sb strings.Builder
+	spans := make([]span, 0, len(s))
+
+	for i, r := range s {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		origin := span{i, i + size}
+		// Decomposing each character on its own is enough here, because
+		// the marks that canonical composition would merge are dropped
+		for _, d := range norm.NFKD.String(string(r)) {
+			if isStripped(d) {
+				continue
+			}
+			if c, ok := confusables[d]; ok {
+				d = c
+			} else {
+				d = unicode.ToLower(d)
+			}
+			n, _ := sb.WriteRune(d)
+			for ; n > 0; n-- {
+				spans = append(spans, origin)
+			}
+		}
+	}
+
+	return sb.String(), spans
+}
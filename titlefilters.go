@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+	"github.com/drawpile/listserver/titlefilter"
+	"github.com/gorilla/mux"
+)
+
+// How long the compiled title filter is kept when other list servers may
+// change the rules in a shared database
+const sharedTitleFilterTtl = time.Minute
+
+// The compiled title filter, so that the rules aren't queried and compiled
+// for every announcement and refresh. Changes made through this instance
+// invalidate it right away.
+type titleFilterCache struct {
+	mutex      sync.Mutex
+	filter     *titlefilter.Filter
+	loaded     time.Time
+	generation int
+	ttl        time.Duration
+}
+
+func newTitleFilterCache(cfg *config) *titleFilterCache {
+	c := &titleFilterCache{}
+	if db.IsSharedDatabase(cfg.Database) {
+		c.ttl = sharedTitleFilterTtl
+	}
+	return c
+}
+
+// Get the cached filter and the generation to store a reloaded one under
+func (c *titleFilterCache) get(now time.Time) (*titlefilter.Filter, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.filter != nil && c.ttl > 0 && now.Sub(c.loaded) > c.ttl {
+		c.filter = nil
+	}
+	return c.filter, c.generation
+}
+
+// A filter loaded while the rules were being changed is outdated already,
+// so it's only kept if there was no invalidation since loading started
+func (c *titleFilterCache) put(filter *titlefilter.Filter, generation int, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation == c.generation {
+		c.filter = filter
+		c.loaded = now
+	}
+}
+
+func (c *titleFilterCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.filter = nil
+	c.generation++
+}
+
+// Get the title filter, built from the nsfmWords setting and the rules in
+// the database
+func loadTitleFilter(ctx apiContext, reqCtx context.Context) (*titlefilter.Filter, error) {
+	now := time.Now()
+	filter, generation := ctx.titleFilter.get(now)
+	if filter != nil {
+		return filter, nil
+	}
+
+	rules := make([]titlefilter.Rule, 0, len(ctx.cfg.NsfmWords))
+	for _, word := range ctx.cfg.NsfmWords {
+		rules = append(rules, titlefilter.Rule{
+			Kind:    titlefilter.KindWord,
+			Pattern: word,
+			Action:  titlefilter.ActionNsfm,
+		})
+	}
+
+	filters, err := ctx.db.QueryTitleFilters(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filters {
+		rules = append(rules, titlefilter.Rule{Kind: f.Type, Pattern: f.Pattern, Action: f.Action})
+	}
+
+	filter = titlefilter.New(rules)
+	ctx.titleFilter.put(filter, generation, now)
+	return filter, nil
+}
+
+// Run the title of a refresh through the filter, if it has one, and put the
+// filtered title back into the refresh fields
+func filterRefreshTitle(ctx apiContext, fields map[string]interface{}, reqCtx context.Context) (titlefilter.Result, error) {
+	title, ok := fields["title"].(string)
+	if !ok {
+		return titlefilter.Result{}, nil
+	}
+
+	filter, err := loadTitleFilter(ctx, reqCtx)
+	if err != nil {
+		return titlefilter.Result{}, err
+	}
+
+	result := filter.Check(title)
+	fields["title"] = result.Title
+	if result.Nsfm {
+		fields["nsfm"] = true
+	}
+	return result, nil
+}
+
+// Mark a session for review if flag rules matched its title. Failing to do
+// so isn't worth failing the request over.
+func flagFilteredSession(ctx apiContext, listingId int64, result titlefilter.Result, reqCtx context.Context) {
+	if len(result.Flagged) == 0 {
+		return
+	}
+	reason := "Title matches " + strings.Join(result.Flagged, ", ")
+	if err := ctx.db.FlagSession(listingId, reason, reqCtx); err != nil {
+		log.Println("Flag session error:", err)
+	}
+}
+
+type adminTitleFilterRequest struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Notes   string `json:"notes"`
+}
+
+func parseAdminTitleFilterRequest(r *http.Request) (db.TitleFilter, error) {
+	var info adminTitleFilterRequest
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return db.TitleFilter{}, fmt.Errorf("Unparseable JSON request body")
+	}
+
+	rule := titlefilter.Rule{Kind: info.Type, Pattern: info.Pattern, Action: info.Action}
+	if err := titlefilter.Validate(rule); err != nil {
+		return db.TitleFilter{}, err
+	}
+
+	return db.TitleFilter{
+		Type:    info.Type,
+		Pattern: info.Pattern,
+		Action:  info.Action,
+		Notes:   info.Notes,
+	}, nil
+}
+
+func apiAdminTitleFilterListHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessView) {
+		return ErrorResponse("You're not allowed to view title filters", http.StatusForbidden)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+
+	filters, err := ctx.db.QueryTitleFilters(r.Context())
+	if err != nil {
+		log.Println("List title filters error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	return JsonResponseOk(filters)
+}
+
+func apiAdminTitleFilterCreateHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessManage) {
+		return ErrorResponse("You're not allowed to create title filters", http.StatusForbidden)
+	}
+
+	filter, err := parseAdminTitleFilterRequest(r)
+	if err != nil {
+		return ErrorResponse(err.Error(), http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	id, err := ctx.db.AdminCreateTitleFilter(filter, r.Context())
+	if err != nil {
+		log.Println("Create title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+	filter.Id = id
+	ctx.titleFilter.invalidate()
+	recordAudit(r, "titlefilters.create", []int64{id}, nil, filter)
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status": "ok",
+		"id":     id,
+	})
+}
+
+func apiAdminTitleFilterPutHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessManage) {
+		return ErrorResponse("You're not allowed to edit title filters", http.StatusForbidden)
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return ErrorResponse("Invalid title filter id", http.StatusBadRequest)
+	}
+
+	filter, err := parseAdminTitleFilterRequest(r)
+	if err != nil {
+		return ErrorResponse(err.Error(), http.StatusBadRequest)
+	}
+	filter.Id = id
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findTitleFilter(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Put title filter query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	updated, err := ctx.db.AdminUpdateTitleFilter(filter, r.Context())
+	if err != nil {
+		log.Println("Put title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if !updated {
+		return ErrorResponse("Title filter not found", http.StatusNotFound)
+	}
+	ctx.titleFilter.invalidate()
+	recordAudit(r, "titlefilters.update", []int64{id}, before, filter)
+
+	return JsonResponseCreated(map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+func apiAdminTitleFilterDeleteHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessManage) {
+		return ErrorResponse("You're not allowed to delete title filters", http.StatusForbidden)
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return ErrorResponse("Invalid title filter id", http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	before, err := findTitleFilter(ctx, id, r.Context())
+	if err != nil {
+		log.Println("Delete title filter query error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	deleted, err := ctx.db.AdminDeleteTitleFilter(id, r.Context())
+	if err != nil {
+		log.Println("Delete title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	} else if !deleted {
+		return ErrorResponse("Title filter not found", http.StatusNotFound)
+	}
+	ctx.titleFilter.invalidate()
+	recordAudit(r, "titlefilters.delete", []int64{id}, before, nil)
+
+	return JsonResponseOk(map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Run a title through the current filter, so that rules can be tried out
+func apiAdminTitleFilterCheckHandler(r *http.Request) http.Handler {
+	if !adminAccess(r, permHostBans, accessView) {
+		return ErrorResponse("You're not allowed to view title filters", http.StatusForbidden)
+	}
+
+	var info struct {
+		Title string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		return ErrorResponse("Unparseable JSON request body", http.StatusBadRequest)
+	}
+
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	filter, err := loadTitleFilter(ctx, r.Context())
+	if err != nil {
+		log.Println("Load title filter error:", err)
+		return ErrorResponse("An internal error occurred", http.StatusInternalServerError)
+	}
+
+	result := filter.Check(info.Title)
+	flagged := result.Flagged
+	if flagged == nil {
+		flagged = []string{}
+	}
+
+	return JsonResponseOk(map[string]interface{}{
+		"title":    result.Title,
+		"folded":   titlefilter.Fold(info.Title),
+		"rejected": result.Rejected,
+		"nsfm":     result.Nsfm,
+		"flagged":  flagged,
+	})
+}
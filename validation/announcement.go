@@ -1,6 +1,7 @@
 package validation
 
 import (
+	"context"
 	"github.com/drawpile/listserver/db"
 	"net"
 )
@@ -11,31 +12,33 @@ type AnnouncementValidationRules struct {
 	ProtocolWhitelist   []string
 }
 
-func ValidateAnnouncement(session db.SessionInfo, rules AnnouncementValidationRules) error {
+// Returns the addresses the announced hostname resolved to, if one was given
+func ValidateAnnouncement(ctx context.Context, session db.SessionInfo, rules AnnouncementValidationRules) ([]net.IP, error) {
 	// Hostname (if present) must be valid
-	if err := ValidateHostname(session.Host, rules.ClientIP); err != nil {
-		return err
+	hostIps, err := ResolveHostname(ctx, session.Host, rules.ClientIP)
+	if err != nil {
+		return nil, err
 	}
 
 	// Port number must be in the valid range
 	if session.Port < 0 || session.Port > 0xffff {
-		return ValidationError{"port", "invalid number"}
+		return nil, ValidationError{"port", "invalid number"}
 	}
 	if !rules.AllowWellKnownPorts && session.Port != 0 && session.Port < 1024 {
-		return ValidationError{"port", "range 1-1024 not allowed"}
+		return nil, ValidationError{"port", "range 1-1024 not allowed"}
 	}
 
 	// Session ID may consist of characters a-z, A-Z and '-'
 	if len(session.Id) < 1 || len(session.Id) > 36 {
-		return ValidationError{"id", "invalid ID"}
+		return nil, ValidationError{"id", "invalid ID"}
 	}
 
 	// Protocol version number must be syntactically correct
 	if !IsValidProtocol(session.Protocol, rules.ProtocolWhitelist) {
-		return ValidationError{"protocol", "unsupported protocol version"}
+		return nil, ValidationError{"protocol", "unsupported protocol version"}
 	}
 
-	return nil
+	return hostIps, nil
 }
 
 func isValidSessionId(id string) bool {
@@ -1,50 +1,69 @@
 package validation
 
 import (
+	"context"
 	"net"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// How long resolving an announced hostname may take
+const lookupTimeout = 5 * time.Second
+
 func ValidateHostname(hostname string, clientIp net.IP) error {
+	_, err := ResolveHostname(context.Background(), hostname, clientIp)
+	return err
+}
+
+// Like ValidateHostname, but also returns the addresses the hostname resolved
+// to, so that they don't need to be looked up again. No addresses are
+// returned for an empty hostname.
+func ResolveHostname(ctx context.Context, hostname string, clientIp net.IP) ([]net.IP, error) {
 	isLocalIp := isLocalIp(clientIp)
 
 	// Empty hostname means we use the client IP
 	if len(hostname) == 0 {
 		// Except if client IP is localhost
 		if isLocalIp {
-			return ValidationError{"host", "hostname must be set when announcing from localhost"}
+			return nil, ValidationError{"host", "hostname must be set when announcing from localhost"}
 		} else {
-			return nil
+			return nil, nil
 		}
 	}
 
 	// Validate hostname syntax
 	if m, _ := regexp.MatchString(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`, hostname); !m {
-		return ValidationError{"host", "Invalid hostname"}
+		return nil, ValidationError{"host", "Invalid hostname"}
 	}
 
 	// Check that the hostname actually resolves
-	ips, err := net.LookupIP(hostname)
+	lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, hostname)
 	if err != nil {
-		return ValidationError{"host", "Hostname lookup failed"}
+		return nil, ValidationError{"host", "Hostname lookup failed"}
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
 	}
 
 	// If client IP is localhost, allow any valid hostname
 	// (We could have a list of allowed local hostnames, but generally
 	//  if the server is running on localhost, we can trust it.)
 	if isLocalIp {
-		return nil
+		return ips, nil
 	}
 
 	// For non-localhosts, hostname must resolve to the client IP
 	for _, ip := range ips {
 		if ip.Equal(clientIp) {
-			return nil
+			return ips, nil
 		}
 	}
 
-	return ValidationError{"host", "Hostname does not match client IP"}
+	return nil, ValidationError{"host", "Hostname does not match client IP"}
 }
 
 func IsValidProtocol(protocol string, whitelist []string) bool {
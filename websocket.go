@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/drawpile/listserver/db"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+	wsMaxMessage   = 4096
+)
+
+// Sent by the client to start receiving changes. Sending another one
+// replaces the filter and starts over with a new snapshot.
+type wsSubscribeRequest struct {
+	Type     string `json:"type"`
+	Nsfm     bool   `json:"nsfm"`
+	Protocol string `json:"protocol"`
+	Title    string `json:"title"`
+}
+
+// Browsers don't apply CORS to WebSockets, so the allowed origins have to be
+// checked here. Clients other than browsers don't send an origin at all.
+func wsOriginChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if o == "*" || o == origin {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Reads subscription requests until the connection is closed or the handler
+// stops. Unparseable messages are passed on with an empty type.
+func wsReadLoop(conn *websocket.Conn, requests chan<- wsSubscribeRequest, stop <-chan struct{}) {
+	defer close(requests)
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req wsSubscribeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			req = wsSubscribeRequest{}
+		}
+
+		select {
+		case requests <- req:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func wsWrite(conn *websocket.Conn, msg map[string]interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(msg)
+}
+
+func wsClose(conn *websocket.Conn, code int, text string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text),
+		time.Now().Add(wsWriteTimeout))
+}
+
+// Live session list over a WebSocket: the client sends a subscribe message
+// with its filter and receives a snapshot followed by the changes to it
+func apiSessionWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context().Value(apiCtxKey).(apiContext)
+	if !ctx.cfg.Public && !ctx.cfg.HasIncludes() {
+		ErrorResponse("No public listings on this server", http.StatusNotFound).ServeHTTP(w, r)
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: wsOriginChecker(ctx.cfg.AllowOrigins)}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already sent an error response
+		return
+	}
+	defer conn.Close()
+
+	ctx.events.connections.Add(1)
+	defer ctx.events.connections.Done()
+
+	requests := make(chan wsSubscribeRequest)
+	stop := make(chan struct{})
+	defer close(stop)
+	go wsReadLoop(conn, requests, stop)
+
+	var sub *eventSubscriber
+	defer func() {
+		if sub != nil {
+			ctx.events.unsubscribe(sub)
+		}
+	}()
+
+	// Nil until subscribed, so that nothing is received from it
+	var events <-chan sessionEvent
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.events.done:
+			wsClose(conn, websocket.CloseGoingAway, "Server is shutting down")
+			return
+
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+
+		case req, ok := <-requests:
+			if !ok {
+				return
+			}
+			if req.Type != "subscribe" {
+				err = wsWrite(conn, map[string]interface{}{
+					"type":    "error",
+					"message": "Expected a subscribe message",
+				})
+				break
+			}
+
+			if sub != nil {
+				ctx.events.unsubscribe(sub)
+				sub, events = nil, nil
+			}
+
+			opts := db.QueryOptions{Nsfm: req.Nsfm, Protocol: req.Protocol, Title: req.Title}
+			var snapshot []db.SessionInfo
+			sub, snapshot, err = ctx.events.subscribe(opts, r.Context())
+			if err != nil {
+				log.Println("Session WebSocket subscription error:", err)
+				wsClose(conn, websocket.CloseInternalServerErr, "Couldn't query session list")
+				return
+			}
+			events = sub.events
+			err = wsWrite(conn, map[string]interface{}{
+				"type":     "snapshot",
+				"sessions": snapshot,
+			})
+
+		case e, ok := <-events:
+			if !ok {
+				// Fell too far behind or shutting down. The client can
+				// subscribe again to get a fresh snapshot.
+				wsClose(conn, websocket.CloseTryAgainLater, "Subscription ended")
+				return
+			}
+			msg := map[string]interface{}{
+				"type": e.kind,
+				"key":  sessionKeyInfo(&e.session),
+			}
+			if e.kind != "removed" {
+				msg["session"] = e.session
+			}
+			err = wsWrite(conn, msg)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}